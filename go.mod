@@ -1,3 +1,5 @@
 module github.com/pendulm/fileflip
 
-go 1.13
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
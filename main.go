@@ -1,41 +1,558 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/pendulm/fileflip/pkg/env"
 	"github.com/pendulm/fileflip/pkg/flip"
 	"github.com/pendulm/fileflip/pkg/log"
+	"github.com/pendulm/fileflip/pkg/ptrace"
+	"github.com/pendulm/fileflip/pkg/version"
 )
 
+// usageIndent is width of option column in usage
+const usageIndent = 17
+
+var flags = flag.NewFlagSet("fileflip", flag.ContinueOnError)
+
 func usage() {
-	log.Error("Usage: fileflip [PID] [FILE]\n")
-	log.Error("rotate opened file promptly while nobody knows\n")
+	out := flags.Output()
+	fmt.Fprintf(out, "Usage: fileflip [OPTIONS] [PID] [FILE]\n")
+	fmt.Fprintf(out, "       fileflip [OPTIONS] --stdio [PID]\n")
+	fmt.Fprintf(out, "       fileflip [OPTIONS] --regex PATTERN [PID]\n")
+	fmt.Fprintf(out, "       fileflip [OPTIONS] --plan FILE\n")
+	fmt.Fprintf(out, "       fileflip [OPTIONS] --inspect PID FD\n")
+	fmt.Fprintf(out, "       fileflip --check\n")
+	fmt.Fprintf(out, "rotate opened file promptly while nobody knows\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Options:\n")
+	flags.VisitAll(func(f *flag.Flag) {
+		argName, text := flag.UnquoteUsage(f)
+		name := "--" + f.Name
+		if argName != "" {
+			name += " " + argName
+		}
+		fmt.Fprintf(out, "  %-*s %s\n", usageIndent, name, text)
+	})
 }
 
-func parseArgs() (pid int, filePath string) {
-	var err error
-	if len(os.Args) < 3 {
-		goto printUsage
+var jsonOutput bool
+var jsonStream bool
+var quiet bool
+var listOnly bool
+var inspectOnly bool
+var inspectFd int
+var explainOnly bool
+var metricsFile string
+var stdio bool
+var glob bool
+var regex string
+var planFile string
+
+// octalMode is a flag.Value of file permission bits in octal
+type octalMode struct {
+	mode *os.FileMode
+}
+
+func (m octalMode) String() string {
+	if m.mode == nil || *m.mode == 0 {
+		return ""
 	}
+	return fmt.Sprintf("%#o", uint32(*m.mode))
+}
 
-	pid, err = strconv.Atoi(os.Args[1])
-	if err != nil {
-		goto printUsage
+func (m octalMode) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return fmt.Errorf("invalid mode %q", s)
 	}
+	*m.mode = os.FileMode(mode)
+	return nil
+}
+
+func parseArgs() (pid int, filePath string, opts flip.Options) {
+	var showVersion, checkOnly bool
+	flags.SetOutput(os.Stderr)
+	flags.Usage = usage
+
+	flags.BoolVar(&opts.AllowLinks, "allow-links", false,
+		"flip even if file has more than one hard link")
+	flags.BoolVar(&checkOnly, "check", false,
+		"check if this system allows flips, change nothing")
+	flags.Var(&opts.Compress, "compress",
+		"compress rolled file with `CODEC` (gzip or zstd)")
+	flags.Func("compress-cmd", "compress rolled file by piping it through `CMD` run with sh -c", func(cmd string) error {
+		opts.CompressCmd = []string{"/bin/sh", "-c", cmd}
+		if opts.CompressExt == "" {
+			if fields := strings.Fields(cmd); len(fields) > 0 {
+				opts.CompressExt = flip.CompressorExt(fields[0])
+			}
+		}
+		return nil
+	})
+	flags.StringVar(&opts.CompressExt, "compress-ext", "",
+		"append `EXT` (e.g. .gz) to the archive of --compress-cmd, guessed for well known compressors")
+	flags.StringVar(&opts.Dest, "dest", "",
+		"rename original file to `PATH` instead of adding suffix")
+	flags.BoolVar(&opts.ExactMode, "exact-mode", false,
+		"give new file the mode of original, ignoring umask of process")
+	flags.BoolVar(&opts.ExitKill, "exit-kill", false,
+		"kill process if fileflip dies while attached")
+	flags.StringVar(&opts.ExpectComm, "expect-comm", "",
+		"refuse process unless its command name is `N`, guards against a reused pid")
+	flags.StringVar(&opts.ExpectExe, "expect-exe", "",
+		"refuse process unless it runs executable `P`")
+	flags.BoolVar(&explainOnly, "explain", false,
+		"print the exact syscalls a flip would inject, change nothing")
+	flags.IntVar(&opts.Fd, "fd", 0,
+		"replace descriptor `N` instead of finding it by path")
+	flags.Var(&opts.FdPolicy, "fd-policy",
+		"if one of several fds fails, `P` best-effort keeps the others, all-or-nothing puts all back")
+	flags.BoolVar(&opts.Force, "force", false,
+		"warn instead of refusing a file with hard links or a frozen process")
+	flags.BoolVar(&opts.Fsync, "fsync", false,
+		"sync archive and the directory entries of the flip to disk before exiting")
+	flags.BoolVar(&opts.FollowForks, "follow-forks", false,
+		"also flip child processes holding the file")
+	flags.BoolVar(&opts.FollowSymlinks, "follow-symlinks", false,
+		"open new file even if a symlink took its path")
+	flags.BoolVar(&glob, "glob", false,
+		"take FILE as a glob pattern, flip every match opened by process")
+	flags.BoolVar(&opts.MatchInode, "inode", false,
+		"match opened file by inode instead of path")
+	flags.BoolVar(&inspectOnly, "inspect", false,
+		"show what descriptor FD of process opens, its flags and offset, change nothing")
+	flags.BoolVar(&jsonOutput, "json", false,
+		"print result as JSON")
+	flags.BoolVar(&jsonStream, "json-stream", false,
+		"print a JSON line for each file as soon as it is done, failures too")
+	flags.BoolVar(&opts.KeepAttrs, "keep-attrs", false,
+		"lift chattr +i and +a of file for the flip, then give them to archive and +a to new file")
+	flags.IntVar(&opts.Keep, "keep", 0,
+		"with --numbered, remove archives above `N`")
+	flags.BoolFunc("keep-offset", "same as --offset keep", func(string) error {
+		opts.Offset = flip.OffsetKeep
+		return nil
+	})
+	flags.BoolVar(&opts.Lenient, "lenient", false,
+		fmt.Sprintf("exit %d instead of error if file is not opened", env.ExitIgn))
+	flags.BoolVar(&listOnly, "list", false,
+		"show descriptors opening the file, change nothing")
+	flags.DurationVar(&opts.LockTimeout, "lock-timeout", 0,
+		"wait at most `D` (e.g. 5s) for another flip of the file")
+	flags.DurationVar(&opts.MaxStopped, "max-stopped-time", 0,
+		"abort and roll back rather than keep process stopped longer than `D` in total")
+	flags.StringVar(&metricsFile, "metrics-file", "",
+		"append a JSON record of the run to `F`")
+	flags.BoolVar(&opts.Mkdir, "mkdir", false,
+		"create the directory of --dest if missing, like the one of FILE")
+	flags.Int64Var(&opts.MinSize, "min-size", 0,
+		fmt.Sprintf("exit %d without flipping if file is smaller than `BYTES`", env.ExitSmall))
+	flags.Var(octalMode{&opts.Mode}, "mode",
+		"create new file with octal `MODE`, ignoring umask")
+	flags.BoolVar(&opts.NoLock, "no-lock", false,
+		"do not take the lock file FILE.flip-lock")
+	flags.BoolVar(&opts.NoRollback, "no-rollback", false,
+		"leave a failed flip half done for debugging, do not undo anything")
+	flags.BoolVar(&opts.Numbered, "numbered", false,
+		"rename file to FILE.1 after moving older FILE.N up by one")
+	flags.DurationVar(&opts.OpTimeout, "op-timeout", 0,
+		"abort and detach if process is held longer than `D`")
+	flags.Var(&opts.Offset, "offset",
+		"where writes go on in new file, `POS` is end (default), append, zero or keep")
+	flags.Func("post-cmd", "run `CMD` with sh -c after a successful flip", func(cmd string) error {
+		opts.PostCmd = []string{"/bin/sh", "-c", cmd}
+		return nil
+	})
+	flags.BoolVar(&opts.PostCmdFatal, "post-cmd-fatal", false,
+		fmt.Sprintf("exit %d if post command fails instead of warning", env.ExitPartial))
+	flags.StringVar(&planFile, "plan", "",
+		"flip files listed in `F` as \"PID FILE...\" lines, - for stdin")
+	flags.Int64Var(&opts.Prealloc, "prealloc", 0,
+		"reserve `BYTES` for the new file with fallocate")
+	flags.BoolVar(&quiet, "quiet", false,
+		"print only warnings and errors, and JSON if asked")
+	flags.StringVar(&regex, "regex", "",
+		"flip every file opened for writing whose fd link matches regular expression `PATTERN`, no FILE given")
+	flags.BoolVar(&opts.RenameOnly, "rename-only", false,
+		"only rename file aside, the process writes to it until it reopens FILE")
+	flags.IntVar(&opts.Retries, "retries", 0,
+		fmt.Sprintf("`N` attempts on transient ptrace failures (default %d)", ptrace.DefaultRetries))
+	flags.BoolVar(&opts.SkipExisting, "skip-existing", false,
+		fmt.Sprintf("exit %d instead of error if rolled file exists", env.ExitRotated))
+	flags.BoolVar(&stdio, "stdio", false,
+		"flip files stdout and stderr are redirected to, no FILE given")
+	flags.BoolVar(&opts.StackScratch, "stack-scratch", false,
+		"put the path below the stack pointer of process instead of mapping a page, not for Go programs")
+	flags.BoolVar(&opts.Swap, "swap", false,
+		"swap an empty file in by one rename, the path never goes missing")
+	flags.BoolVar(&opts.Tmpfile, "tmpfile", false,
+		"prepare new file with O_TMPFILE, then link it in place")
+	flags.BoolVar(&opts.TruncateOnly, "truncate-only", false,
+		"empty the file in place, no archive is produced")
+	flags.BoolVar(&opts.Verify, "verify", false,
+		fmt.Sprintf("exit %d if a flipped fd doesn't open FILE once process runs again", env.ExitUnverified))
+	flags.DurationVar(&opts.WaitWritable, "wait-writable", 0,
+		"wait up to `D` for the file to be opened by process")
+	flags.BoolVar(&showVersion, "version", false,
+		"print version and build info, then exit")
 
-	filePath = os.Args[2]
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			env.Exit(env.ExitOk)
+		}
+		printCategory(env.ExitArgs, err.Error())
+		env.Exit(env.ExitArgs)
+	}
+	opts.Logger = log.Std
+	// stdout carries JSON alone, info joins diagnostics on stderr
+	if jsonOutput || jsonStream {
+		log.SetInfoOutput(os.Stderr)
+	}
+	if quiet && log.IsDebug() == false {
+		log.SetLevel(log.LevelWarn)
+	}
+	if showVersion {
+		fmt.Println(version.String())
+		env.Exit(env.ExitOk)
+	}
+	if checkOnly {
+		selfCheck()
+	}
+
+	switch {
+	case opts.Fd < 0:
+		badArgs("invalid fd %d", opts.Fd)
+	case opts.LockTimeout < 0:
+		badArgs("invalid lock timeout %s", opts.LockTimeout)
+	case opts.OpTimeout < 0:
+		badArgs("invalid op timeout %s", opts.OpTimeout)
+	case opts.MaxStopped < 0:
+		badArgs("invalid max stopped time %s", opts.MaxStopped)
+	case opts.WaitWritable < 0:
+		badArgs("invalid wait %s", opts.WaitWritable)
+	case opts.MinSize < 0:
+		badArgs("invalid min size %d", opts.MinSize)
+	case opts.Prealloc < 0:
+		badArgs("invalid prealloc size %d", opts.Prealloc)
+	case opts.Retries < 0:
+		badArgs("invalid retries %d", opts.Retries)
+	case opts.Keep < 0:
+		badArgs("invalid keep %d", opts.Keep)
+	case opts.Mkdir && opts.Dest == "":
+		badArgs("--mkdir needs --dest")
+	case opts.Keep > 0 && opts.Numbered == false:
+		badArgs("--keep needs --numbered")
+	case opts.Numbered && (opts.Dest != "" || opts.SkipExisting || opts.TruncateOnly):
+		badArgs("--numbered can't be used with --dest, --skip-existing or --truncate-only")
+	case len(opts.CompressCmd) > 0 && opts.Compress != flip.CodecNone:
+		badArgs("--compress-cmd can't be used with --compress")
+	case len(opts.CompressCmd) > 0 && opts.CompressExt == "":
+		badArgs("--compress-cmd needs --compress-ext, the compressor is not a known one")
+	case opts.CompressExt != "" && len(opts.CompressCmd) == 0:
+		badArgs("--compress-ext needs --compress-cmd")
+	case opts.RenameOnly && (opts.TruncateOnly || opts.Tmpfile || opts.FollowForks || opts.Compress != flip.CodecNone || len(opts.CompressCmd) > 0):
+		badArgs("--rename-only can't be used with --truncate-only, --tmpfile, --follow-forks, --compress or --compress-cmd")
+	case opts.Swap && (opts.Tmpfile || opts.Numbered || opts.TruncateOnly):
+		badArgs("--swap can't be used with --tmpfile, --numbered or --truncate-only")
+	case explainOnly && (listOnly || stdio || glob || regex != "" || planFile != ""):
+		badArgs("--explain can't be used with --list, --stdio, --glob, --regex or --plan")
+	case stdio && (listOnly || opts.Fd > 0 || opts.Dest != ""):
+		badArgs("--stdio can't be used with --list, --fd or --dest")
+	case glob && (stdio || listOnly || opts.Fd > 0 || opts.Dest != ""):
+		badArgs("--glob can't be used with --stdio, --list, --fd or --dest")
+	case regex != "" && (stdio || glob || listOnly || opts.Fd > 0 || opts.Dest != ""):
+		badArgs("--regex can't be used with --stdio, --glob, --list, --fd or --dest")
+	case planFile != "" && (stdio || glob || regex != "" || listOnly || opts.Fd > 0 || opts.Dest != ""):
+		badArgs("--plan can't be used with --stdio, --glob, --regex, --list, --fd or --dest")
+	case inspectOnly && (explainOnly || stdio || glob || regex != "" || planFile != "" || listOnly || opts.Fd > 0):
+		badArgs("--inspect can't be used with --explain, --stdio, --glob, --regex, --plan, --list or --fd")
+	}
+
+	args := flags.Args()
+	switch {
+	case planFile != "" && len(args) != 0:
+		badArgs("--plan takes no PID or FILE")
+	case planFile != "":
+		return
+	case (stdio || regex != "") && len(args) != 1:
+		badArgs("need PID")
+	case inspectOnly && len(args) != 2:
+		badArgs("need PID and FD")
+	case stdio == false && regex == "" && len(args) != 2:
+		badArgs("need PID and FILE")
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		badArgs("invalid pid %q", args[0])
+	}
+	if inspectOnly {
+		inspectFd, err = strconv.Atoi(args[1])
+		if err != nil || inspectFd < 0 {
+			badArgs("invalid fd %q", args[1])
+		}
+		return
+	}
+	if stdio == false && regex == "" {
+		filePath = args[1]
+	}
 	return
+}
 
-printUsage:
+// badArgs reports a wrong argument with usage and exits
+func badArgs(format string, v ...interface{}) {
+	fmt.Fprintf(flags.Output(), format+"\n", v...)
 	usage()
-	os.Exit(env.ExitArgs)
-	return
+	printCategory(env.ExitArgs, fmt.Sprintf(format, v...))
+	env.Exit(env.ExitArgs)
+}
+
+// die reports a failure and exits with code, see printCategory
+func die(code int, format string, v ...interface{}) {
+	log.Error(format, v...)
+	printCategory(code, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+	env.Exit(code)
+}
+
+// printCategory prints a line classifying a failure for scripts
+// reading stderr, JSON output carries the exit code instead
+func printCategory(code int, msg string) {
+	if jsonOutput || jsonStream {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "fileflip: error: category=%s msg=%q\n", env.Category(code), msg)
+}
+
+// selfCheck prints what the system allows and exits, non-zero if a
+// flip can't work
+func selfCheck() {
+	checks := flip.SelfCheck()
+	if jsonOutput {
+		out, _ := json.Marshal(checks)
+		fmt.Println(string(out))
+	} else {
+		for _, check := range checks {
+			status := "pass"
+			if check.Passed == false && check.Optional {
+				status = "warn"
+			} else if check.Passed == false {
+				status = "FAIL"
+			}
+			fmt.Printf("%s  %-15s %s\n", status, check.Name, check.Detail)
+		}
+	}
+	if flip.CheckPassed(checks) == false {
+		env.Exit(env.ExitErr)
+	}
+	env.Exit(env.ExitOk)
+}
+
+func list(pid int, filePath string, opts flip.Options) {
+	infos, err := flip.List(pid, filePath, opts)
+	if err != nil {
+		die(flip.ExitCode(err), "%s\n", err)
+	}
+	if jsonOutput {
+		out, _ := json.Marshal(infos)
+		fmt.Println(string(out))
+		return
+	}
+	for _, info := range infos {
+		fmt.Printf("fd %d flags %s pos %d", info.Fd, info.FlagString(), info.Pos)
+		for _, lock := range info.Locks {
+			fmt.Printf(" lock %s", lock)
+		}
+		fmt.Println()
+	}
+}
+
+// inspect prints what a descriptor of pid refers to
+func inspect(pid int, fd int) {
+	info, err := flip.InspectFd(pid, fd)
+	if err != nil {
+		die(flip.ExitCode(err), "%s\n", err)
+	}
+	if jsonOutput {
+		out, _ := json.Marshal(info)
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("fd %d path %s dev %s ino %d flags %s pos %d", info.Fd, info.Path,
+		info.DevString(), info.Ino, info.FlagString(), info.Pos)
+	for _, lock := range info.Locks {
+		fmt.Printf(" lock %s", lock)
+	}
+	fmt.Println()
+}
+
+// explain prints what a flip would do without doing it
+func explain(pid int, filePath string, opts flip.Options) {
+	steps, err := flip.Explain(context.Background(), pid, filePath, opts)
+	if jsonOutput {
+		out, _ := json.Marshal(steps)
+		fmt.Println(string(out))
+	} else {
+		for _, step := range steps {
+			fmt.Println(step)
+		}
+	}
+	if flip.Skipped(err) {
+		log.Info("%s\n", err)
+		env.Exit(flip.ExitCode(err))
+	}
+	if err != nil {
+		die(flip.ExitCode(err), "%s\n", err)
+	}
 }
 
 func main() {
-	pid, filePath := parseArgs()
-	flip.RunForFile(pid, filePath)
-	os.Exit(env.ExitOk)
+	pid, filePath, opts := parseArgs()
+	if listOnly {
+		list(pid, filePath, opts)
+		env.Exit(env.ExitOk)
+	}
+	if inspectOnly {
+		inspect(pid, inspectFd)
+		env.Exit(env.ExitOk)
+	}
+	if explainOnly {
+		explain(pid, filePath, opts)
+		env.Exit(env.ExitOk)
+	}
+	// on SIGINT or SIGTERM flip stops at next step, rolls back and
+	// detaches, a second signal kills us at once. SIGKILL can't be
+	// handled and leaves kernel to detach the process
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Info("got %s, cleaning up\n", sig)
+		signal.Stop(sigCh)
+		cancel()
+	}()
+
+	var results []*flip.Result
+	var err error
+	streamed := 0
+	if jsonStream {
+		opts.OnResult = func(pid int, path string, result *flip.Result, err error) {
+			printRecord(pid, path, result, err)
+			streamed++
+		}
+	}
+	if planFile != "" {
+		results, err = flipPlan(ctx, opts)
+	} else if stdio {
+		results, err = flip.FlipStdio(ctx, pid, opts)
+	} else if glob {
+		results, err = flip.FlipGlob(ctx, pid, filePath, opts)
+	} else if regex != "" {
+		results, err = flip.FlipRegex(ctx, pid, regex, opts)
+	} else {
+		var result *flip.Result
+		result, err = flip.FlipContext(ctx, pid, filePath, opts)
+		if result != nil {
+			results = append(results, result)
+		}
+		if opts.OnResult != nil {
+			opts.OnResult(pid, filePath, result, err)
+		}
+	}
+	// a failure before any file was tried still makes a line
+	if jsonStream && err != nil && streamed == 0 {
+		printRecord(pid, filePath, nil, err)
+	}
+	if metricsFile != "" {
+		writeMetrics(pid, filePath, results, err, opts)
+	}
+	if flip.Skipped(err) {
+		log.Info("%s\n", err)
+		env.Exit(flip.ExitCode(err))
+	}
+	if err != nil {
+		die(flip.ExitCode(err), "%s\n", err)
+	}
+	for _, result := range results {
+		if jsonStream {
+			break
+		}
+		if jsonOutput {
+			out, _ := json.Marshal(result)
+			fmt.Println(string(out))
+		} else if quiet == false {
+			fmt.Println(result)
+		}
+	}
+	env.Exit(env.ExitOk)
+}
+
+// flipPlan reads the plan file and flips it
+func flipPlan(ctx context.Context, opts flip.Options) ([]*flip.Result, error) {
+	in := os.Stdin
+	if planFile != "-" {
+		file, err := os.Open(planFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+	plan, err := flip.ParsePlan(in)
+	if err != nil {
+		die(env.ExitArgs, "bad plan %s: %s\n", planFile, err)
+	}
+	return flip.FlipPlan(ctx, plan, opts)
+}
+
+// streamRecord is a line of --json-stream, the result of a file with
+// its outcome, result is nil if the flip failed early
+type streamRecord struct {
+	Pid  int    `json:"pid"`
+	Path string `json:"path"`
+	*flip.Result
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// printRecord prints a --json-stream line at once
+func printRecord(pid int, path string, result *flip.Result, err error) {
+	record := streamRecord{Result: result, Pid: pid, Path: path, ExitCode: env.Resolve(flip.ExitCode(err))}
+	if result != nil {
+		record.Path = result.Path
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	out, _ := json.Marshal(record)
+	fmt.Println(string(out))
+}
+
+// writeMetrics appends a metric for each flipped file, error goes to
+// the last one which is where flip stopped
+func writeMetrics(pid int, filePath string, results []*flip.Result, err error, opts flip.Options) {
+	var metrics []*flip.Metric
+	for i, result := range results {
+		var resultErr error
+		if i == len(results)-1 {
+			resultErr = err
+		}
+		metrics = append(metrics, flip.NewMetric(result.Pid, result.Path, result, resultErr))
+	}
+	if len(results) == 0 {
+		metrics = append(metrics, flip.NewMetric(pid, filePath, nil, err))
+	}
+	for _, metric := range metrics {
+		if metricErr := flip.AppendMetric(metricsFile, metric, opts); metricErr != nil {
+			log.Warn("write metrics to %s error: %s\n", metricsFile, metricErr)
+		}
+	}
 }
@@ -7,6 +7,73 @@ const (
 	ExitArgs
 	// ExitErr is return code for system internal error
 	ExitErr
-	// ExitIgn has no meaning yet
+	// ExitIgn is return code when there is nothing to do
 	ExitIgn
+	// ExitNotFound is return code when file or process can't be found
+	ExitNotFound
+	// ExitPerm is return code when permission is denied
+	ExitPerm
+	// ExitGone is return code when process quit during flip
+	ExitGone
+	// ExitPartial is return code when descriptors were replaced
+	// but a later step failed
+	ExitPartial
+	// ExitRotated is return code when the rolled file already exists
+	// and skipping it is asked, the file counts as rotated
+	ExitRotated
+	// ExitSmall is return code when the file is below the size
+	// threshold and left alone
+	ExitSmall
+	// ExitRefused is return code when the file is not safe to flip,
+	// e.g. it isn't a regular file, is on a pseudo filesystem like
+	// proc or has other hard links, or the process can't be attached
+	// as its cgroup is frozen or it is traced
+	ExitRefused
+	// ExitNoProcfs is return code when /proc is not mounted
+	ExitNoProcfs
+	// ExitMismatch is return code when process is not the expected
+	// program, e.g. the pid was reused after a stale pidfile
+	ExitMismatch
+	// ExitScope is return code when Yama ptrace_scope forbids the
+	// attach, see kernel.yama.ptrace_scope
+	ExitScope
+	// ExitIsDir is return code when the path or fd given is a
+	// directory, which a process may hold open for openat
+	ExitIsDir
+	// ExitUnverified is return code when a descriptor doesn't open the
+	// new file any more once process runs again, see Options.Verify
+	ExitUnverified
+	// ExitNotOpen is return code when the file exists but process
+	// doesn't have it open, not to be mistaken for a missing file
+	ExitNotOpen
 )
+
+// exitCategories name each code in the error line on stderr, they are
+// stable for scripts and not changed by FILEFLIP_EXIT_<NAME>
+var exitCategories = map[int]string{
+	ExitOk:         "ok",
+	ExitArgs:       "bad-args",
+	ExitErr:        "internal",
+	ExitIgn:        "nothing-to-do",
+	ExitNotFound:   "not-found",
+	ExitPerm:       "permission",
+	ExitGone:       "process-gone",
+	ExitPartial:    "partial",
+	ExitRotated:    "already-rotated",
+	ExitSmall:      "too-small",
+	ExitRefused:    "refused",
+	ExitNoProcfs:   "no-procfs",
+	ExitMismatch:   "mismatch",
+	ExitScope:      "ptrace-scope",
+	ExitIsDir:      "is-directory",
+	ExitUnverified: "unverified",
+	ExitNotOpen:    "not-open",
+}
+
+// Category returns the name of the class of an Exit* code
+func Category(code int) string {
+	if category, ok := exitCategories[code]; ok {
+		return category
+	}
+	return exitCategories[ExitErr]
+}
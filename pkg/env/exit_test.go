@@ -0,0 +1,52 @@
+package env
+
+import "testing"
+
+func TestCategory(t *testing.T) {
+	cases := []struct {
+		code     int
+		category string
+	}{
+		{ExitOk, "ok"},
+		{ExitArgs, "bad-args"},
+		{ExitGone, "process-gone"},
+		{ExitScope, "ptrace-scope"},
+		{ExitNotOpen, "not-open"},
+		// unknown codes are internal errors
+		{ExitNotOpen + 1, "internal"},
+		{-1, "internal"},
+	}
+	for _, c := range cases {
+		if category := Category(c.code); category != c.category {
+			t.Errorf("code %d is %q, want %q", c.code, category, c.category)
+		}
+	}
+}
+
+// scripts tell failures apart by category, so each code has its own
+func TestCategoriesDistinct(t *testing.T) {
+	seen := map[string]int{}
+	for code := ExitOk; code <= ExitNotOpen; code++ {
+		category, ok := exitCategories[code]
+		if ok == false {
+			t.Errorf("exit code %d has no category", code)
+			continue
+		}
+		if other, ok := seen[category]; ok {
+			t.Errorf("exit codes %d and %d are both %q", other, code, category)
+		}
+		seen[category] = code
+	}
+}
+
+// a remapped code keeps its category
+func TestCategoryNotRemapped(t *testing.T) {
+	saved := exitOverrides
+	defer func() {
+		exitOverrides = saved
+	}()
+	exitOverrides = map[int]int{ExitGone: ExitOk}
+	if category := Category(ExitGone); category != "process-gone" {
+		t.Errorf("remapped code is %q, want %q", category, "process-gone")
+	}
+}
@@ -0,0 +1,68 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// exitNames are the names used in FILEFLIP_EXIT_<NAME> to remap codes
+var exitNames = map[int]string{
+	ExitOk:         "OK",
+	ExitArgs:       "ARGS",
+	ExitErr:        "ERR",
+	ExitIgn:        "IGN",
+	ExitNotFound:   "NOTFOUND",
+	ExitPerm:       "PERM",
+	ExitGone:       "GONE",
+	ExitPartial:    "PARTIAL",
+	ExitRotated:    "ROTATED",
+	ExitSmall:      "SMALL",
+	ExitRefused:    "REFUSED",
+	ExitNoProcfs:   "NOPROCFS",
+	ExitMismatch:   "MISMATCH",
+	ExitScope:      "SCOPE",
+	ExitIsDir:      "ISDIR",
+	ExitUnverified: "UNVERIFIED",
+	ExitNotOpen:    "NOTOPEN",
+}
+
+// exitOverrides maps an Exit* code to the one asked by environment
+var exitOverrides = map[int]int{}
+
+func init() {
+	exitOverrides = parseOverrides(os.Getenv)
+}
+
+// parseOverrides reads FILEFLIP_EXIT_<NAME> with getenv, bad values
+// are reported and the default code is kept
+func parseOverrides(getenv func(string) string) map[int]int {
+	overrides := map[int]int{}
+	for code, name := range exitNames {
+		key := "FILEFLIP_EXIT_" + name
+		value := getenv(key)
+		if value == "" {
+			continue
+		}
+		mapped, err := strconv.Atoi(value)
+		if err != nil || mapped < 0 || mapped > 255 {
+			fmt.Fprintf(os.Stderr, "bad %s %q, want 0-255, use %d\n", key, value, code)
+			continue
+		}
+		overrides[code] = mapped
+	}
+	return overrides
+}
+
+// Resolve returns the exit code to use for an Exit* code
+func Resolve(code int) int {
+	if mapped, ok := exitOverrides[code]; ok {
+		return mapped
+	}
+	return code
+}
+
+// Exit exits with the resolved code of an Exit* code
+func Exit(code int) {
+	os.Exit(Resolve(code))
+}
@@ -0,0 +1,56 @@
+package env
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOverrides(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		want map[int]int
+	}{
+		{"none", map[string]string{}, map[int]int{}},
+		{"one", map[string]string{"FILEFLIP_EXIT_NOTOPEN": "4"}, map[int]int{ExitNotOpen: 4}},
+		{"several", map[string]string{"FILEFLIP_EXIT_IGN": "0", "FILEFLIP_EXIT_PARTIAL": "70"},
+			map[int]int{ExitIgn: 0, ExitPartial: 70}},
+		{"bounds", map[string]string{"FILEFLIP_EXIT_OK": "255", "FILEFLIP_EXIT_ERR": "0"},
+			map[int]int{ExitOk: 255, ExitErr: 0}},
+		{"out of range kept", map[string]string{"FILEFLIP_EXIT_GONE": "256", "FILEFLIP_EXIT_PERM": "-1"},
+			map[int]int{}},
+		{"not a number kept", map[string]string{"FILEFLIP_EXIT_GONE": "gone"}, map[int]int{}},
+		{"unknown name ignored", map[string]string{"FILEFLIP_EXIT_NOPE": "9"}, map[int]int{}},
+	}
+	for _, c := range cases {
+		got := parseOverrides(func(key string) string {
+			return c.env[key]
+		})
+		if reflect.DeepEqual(got, c.want) == false {
+			t.Errorf("%s: overrides %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	saved := exitOverrides
+	defer func() {
+		exitOverrides = saved
+	}()
+	exitOverrides = map[int]int{ExitNotOpen: ExitNotFound}
+	if code := Resolve(ExitNotOpen); code != ExitNotFound {
+		t.Errorf("remapped code resolves to %d, want %d", code, ExitNotFound)
+	}
+	if code := Resolve(ExitGone); code != ExitGone {
+		t.Errorf("code not remapped resolves to %d, want %d", code, ExitGone)
+	}
+}
+
+// every code needs a name, or it can't be remapped
+func TestExitNamesComplete(t *testing.T) {
+	for code := ExitOk; code <= ExitNotOpen; code++ {
+		if exitNames[code] == "" {
+			t.Errorf("exit code %d has no FILEFLIP_EXIT_ name", code)
+		}
+	}
+}
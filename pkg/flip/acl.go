@@ -0,0 +1,50 @@
+package flip
+
+import (
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// aclAccessXattr holds the POSIX access ACL of a file
+const aclAccessXattr = "system.posix_acl_access"
+
+// copyACL gives dst the access ACL of src, a file without one or a
+// filesystem without ACLs leaves nothing to do. Failure is only warned,
+// the new file keeps its mode
+func copyACL(src string, dst string, logger log.Logger) {
+	acl, err := getXattr(src, aclAccessXattr)
+	switch err {
+	case nil:
+	case syscall.ENODATA, syscall.EOPNOTSUPP:
+		return
+	default:
+		logger.Warn("read ACL of %s error: %s, new file goes without it\n", src, err)
+		return
+	}
+	if err := syscall.Setxattr(dst, aclAccessXattr, acl, 0); err != nil {
+		logger.Warn("copy ACL of %s to %s error: %s\n", src, dst, err)
+		return
+	}
+	logger.Debug("ACL of %s copied to %s\n", src, dst)
+}
+
+// getXattr reads attribute name of path, its size may change
+// between asking for it and reading
+func getXattr(path string, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,81 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// fOfdSetlk sets a lock owned by the open file description, it always
+// takes struct flock64
+const fOfdSetlk = 37
+
+// restoreLocks takes advisory locks held on the old descriptor again on
+// fd, they are tied to the old file and go away with dup3, struct flock
+// is written at bufAddr which has bufSize bytes free. A lock that can't
+// be taken again is only warned about
+func restoreLocks(trace Tracer, bufAddr uintptr, bufSize int, fd int64, locks []FdLock, logger log.Logger) error {
+	for _, lock := range locks {
+		var err error
+		switch lock.Kind {
+		case "FLOCK":
+			how := syscall.LOCK_SH
+			if lock.Write {
+				how = syscall.LOCK_EX
+			}
+			// never block the stopped process on a competing holder
+			_, err = trace.RemoteSyscall(
+				syscall.SYS_FLOCK,
+				uint64(fd),
+				uint64(how|syscall.LOCK_NB))
+		case "POSIX", "OFDLCK":
+			err = setRemoteLock(trace, bufAddr, bufSize, fd, lock)
+		default:
+			logger.Warn("lock %s is lost, it can't be taken again\n", lock)
+			continue
+		}
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			logger.Warn("lock %s is lost: %s\n", lock, errno)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		logger.Debug("lock %s taken again on fd %d\n", lock, fd)
+	}
+	return nil
+}
+
+// setRemoteLock takes a POSIX or OFD lock with fcntl in child
+func setRemoteLock(trace Tracer, bufAddr uintptr, bufSize int, fd int64, lock FdLock) error {
+	var lockType int16 = syscall.F_RDLCK
+	if lock.Write {
+		lockType = syscall.F_WRLCK
+	}
+	// zero length locks up to EOF and beyond
+	var length int64
+	if lock.End >= 0 {
+		length = lock.End - lock.Start + 1
+	}
+	flock := flockBytes(lockType, lock.Start, length)
+	if len(flock) > bufSize {
+		return fmt.Errorf("no room for struct flock in child buffer")
+	}
+	if err := trace.RemoteMemcp(flock, bufAddr, len(flock)); err != nil {
+		return fmt.Errorf("memcp error: %w", err)
+	}
+
+	cmd := fSetlk
+	if lock.Kind == "OFDLCK" {
+		cmd = fOfdSetlk
+	}
+	_, err := trace.RemoteSyscall(
+		sysFcntl,
+		uint64(fd),
+		uint64(cmd),
+		uint64(bufAddr))
+	return err
+}
@@ -0,0 +1,136 @@
+package flip
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// inode flags set by chattr +i and +a, both forbid rename and unlink
+const (
+	fsImmutableFl = 0x10
+	fsAppendFl    = 0x20
+)
+
+// inodeFlags reads the chattr flags of path
+func inodeFlags(path string) (int32, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var flags int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetflags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return 0, errno
+	}
+	return flags, nil
+}
+
+// setInodeFlags sets the chattr flags of path, +i and +a need
+// CAP_LINUX_IMMUTABLE
+func setInodeFlags(path string, flags int32) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocSetflags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// attrNames spells the +i and +a of flags the way chattr takes them
+func attrNames(flags int32) string {
+	var names []string
+	if flags&fsImmutableFl != 0 {
+		names = append(names, "immutable (chattr +i)")
+	}
+	if flags&fsAppendFl != 0 {
+		names = append(names, "append-only (chattr +a)")
+	}
+	return strings.Join(names, " and ")
+}
+
+// liftAttrs takes +i and +a off filePath for the flip, as they forbid
+// the rename. It returns the flags settleAttrs puts back, zero if none
+// is set, and the stat of the file. Without KeepAttrs such a file is
+// refused
+func liftAttrs(filePath string, opts Options) (int32, *syscall.Stat_t, error) {
+	flags, err := inodeFlags(filePath)
+	if err != nil {
+		// e.g. a filesystem without inode flags
+		opts.logger().Debug("read inode flags of %s error: %s\n", filePath, err)
+		return 0, nil, nil
+	}
+	if flags&(fsImmutableFl|fsAppendFl) == 0 {
+		return 0, nil, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(filePath, &st); err != nil {
+		return 0, nil, newError(env.ExitNotFound, "%s", err)
+	}
+	if opts.KeepAttrs == false {
+		return 0, nil, newError(env.ExitRefused,
+			"file %s is %s, it can't be renamed (use --keep-attrs to lift it during the flip)", filePath, attrNames(flags))
+	}
+	if opts.explain != nil {
+		opts.explain.local("lift %s of %q", attrNames(flags), filePath)
+		return flags, &st, nil
+	}
+	if err := setInodeFlags(filePath, flags&^(fsImmutableFl|fsAppendFl)); err != nil {
+		return 0, nil, newError(env.ExitPerm, "lift %s of %s error: %s, it needs CAP_LINUX_IMMUTABLE", attrNames(flags), filePath, err)
+	}
+	opts.logger().Debug("lifted %s of %s\n", attrNames(flags), filePath)
+	return flags, &st, nil
+}
+
+// settleAttrs puts back flags lifted by liftAttrs. If the file at
+// result.Path is still the one of origStat, nothing was rotated and it
+// gets them back. Otherwise the archive gets them, and the new file
+// only +a, process could not write to an immutable one
+func settleAttrs(result *Result, origStat *syscall.Stat_t, flags int32, opts Options) {
+	logger := opts.logger()
+	set := func(path string, flags int32) {
+		if opts.explain != nil {
+			opts.explain.local("set %s on %q", attrNames(flags), path)
+			return
+		}
+		current, err := inodeFlags(path)
+		if err == nil {
+			err = setInodeFlags(path, current|flags)
+		}
+		if err != nil {
+			logger.Error("set %s on %s error: %s\n", attrNames(flags), path, err)
+		}
+	}
+
+	// under Explain nothing is rotated, yet the flip goes on as if
+	var st syscall.Stat_t
+	if err := syscall.Stat(result.Path, &st); err == nil && st.Dev == origStat.Dev && st.Ino == origStat.Ino && opts.explain == nil {
+		set(result.Path, flags)
+		return
+	}
+	if flags&fsAppendFl != 0 && result.RenameOnly == false {
+		set(result.Path, fsAppendFl)
+	}
+	if flags&fsImmutableFl != 0 && result.RenameOnly == false {
+		logger.Warn("%s is not made immutable, process writes to it\n", result.Path)
+	}
+	archiveFlags := flags
+	if result.RenameOnly && flags&fsImmutableFl != 0 {
+		// process writes to the archive until it reopens the path
+		logger.Warn("%s is not made immutable, process writes to it until it reopens %s\n", result.RolledPath, result.Path)
+		archiveFlags &^= fsImmutableFl
+	}
+	switch {
+	case result.RolledPath == "" || archiveFlags == 0:
+	case result.pending && opts.compressed():
+		logger.Warn("%s is compressed later, it doesn't get %s back\n", result.RolledPath, attrNames(archiveFlags))
+	default:
+		set(result.RolledPath, archiveFlags)
+	}
+}
@@ -0,0 +1,87 @@
+package flip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// cgroupfs is where cgroup hierarchies are mounted
+var cgroupfs = "/sys/fs/cgroup"
+
+// frozenCgroup tells if process sits in a frozen cgroup, it can't
+// report the attach stop then and attach would wait forever. Both the
+// v1 freezer and v2 cgroup.freeze are checked, a cgroup that can't be
+// read is taken as not frozen
+func frozenCgroup(pid int, logger log.Logger) (string, bool) {
+	f, err := os.Open(fmt.Sprintf("%s/%d/cgroup", procfs, pid))
+	if err != nil {
+		logger.Debug("can't read cgroup of process %d: %s\n", pid, err)
+		return "", false
+	}
+	defer f.Close()
+
+	for _, cg := range parseCgroups(f) {
+		var stateFile string
+		switch {
+		case cg.hierarchy == "0" && cg.controllers == "":
+			// v2 mounted alone or beside v1 as unified
+			for _, root := range []string{cgroupfs, cgroupfs + "/unified"} {
+				if _, err := os.Stat(root + "/cgroup.controllers"); err == nil {
+					stateFile = filepath.Join(root, cg.path, "cgroup.freeze")
+					break
+				}
+			}
+		case hasController(cg.controllers, "freezer"):
+			stateFile = filepath.Join(cgroupfs, "freezer", cg.path, "freezer.state")
+		}
+		if stateFile == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(stateFile)
+		if err != nil {
+			logger.Debug("can't read %s: %s\n", stateFile, err)
+			continue
+		}
+		switch strings.TrimSpace(string(content)) {
+		case "1", "FROZEN", "FREEZING":
+			return cg.path, true
+		}
+	}
+	return "", false
+}
+
+// cgroupLine is a "hierarchy:controllers:path" line of /proc/<pid>/cgroup
+type cgroupLine struct {
+	hierarchy   string
+	controllers string
+	path        string
+}
+
+func parseCgroups(r io.Reader) []cgroupLine {
+	var cgroups []cgroupLine
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		cgroups = append(cgroups, cgroupLine{fields[0], fields[1], fields[2]})
+	}
+	return cgroups
+}
+
+func hasController(controllers string, name string) bool {
+	for _, controller := range strings.Split(controllers, ",") {
+		if controller == name {
+			return true
+		}
+	}
+	return false
+}
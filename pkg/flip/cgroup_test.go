@@ -0,0 +1,127 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCgroups(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    []cgroupLine
+	}{
+		{
+			name:    "v2",
+			content: "0::/system.slice/app.service\n",
+			want:    []cgroupLine{{"0", "", "/system.slice/app.service"}},
+		},
+		{
+			name:    "v1 with unified",
+			content: "12:freezer:/app\n4:cpu,cpuacct:/app\n0::/app\n",
+			want: []cgroupLine{
+				{"12", "freezer", "/app"},
+				{"4", "cpu,cpuacct", "/app"},
+				{"0", "", "/app"},
+			},
+		},
+		{
+			// a path may have colons, only the first two split
+			name:    "colon in path",
+			content: "0::/pod:abc\n",
+			want:    []cgroupLine{{"0", "", "/pod:abc"}},
+		},
+		{
+			name:    "malformed skipped",
+			content: "garbage\n\n3:freezer:/x\n",
+			want:    []cgroupLine{{"3", "freezer", "/x"}},
+		},
+	}
+	for _, c := range cases {
+		got := parseCgroups(strings.NewReader(c.content))
+		if reflect.DeepEqual(got, c.want) == false {
+			t.Errorf("%s: parsed %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHasController(t *testing.T) {
+	if hasController("cpu,cpuacct", "cpu") == false {
+		t.Error("cpu not found in cpu,cpuacct")
+	}
+	if hasController("cpuacct", "cpu") {
+		t.Error("cpu found in cpuacct")
+	}
+}
+
+// fakeSysfs points procfs and cgroupfs at a temp tree with files,
+// named under proc/ and cgroup/, written with their content
+func fakeSysfs(t *testing.T, files map[string]string) {
+	root := t.TempDir()
+	savedProcfs, savedCgroupfs := procfs, cgroupfs
+	procfs, cgroupfs = filepath.Join(root, "proc"), filepath.Join(root, "cgroup")
+	t.Cleanup(func() {
+		procfs, cgroupfs = savedProcfs, savedCgroupfs
+	})
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFrozenCgroup(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  map[string]string
+		frozen bool
+	}{
+		{"v1 frozen", map[string]string{
+			"proc/42/cgroup":                   "7:freezer:/app\n",
+			"cgroup/freezer/app/freezer.state": "FROZEN\n",
+		}, true},
+		{"v1 freezing", map[string]string{
+			"proc/42/cgroup":                   "7:freezer:/app\n",
+			"cgroup/freezer/app/freezer.state": "FREEZING\n",
+		}, true},
+		{"v1 thawed", map[string]string{
+			"proc/42/cgroup":                   "7:freezer:/app\n",
+			"cgroup/freezer/app/freezer.state": "THAWED\n",
+		}, false},
+		{"v2 frozen", map[string]string{
+			"proc/42/cgroup":            "0::/app\n",
+			"cgroup/cgroup.controllers": "cpu memory\n",
+			"cgroup/app/cgroup.freeze":  "1\n",
+		}, true},
+		{"v2 unified frozen", map[string]string{
+			"proc/42/cgroup":                    "0::/app\n",
+			"cgroup/unified/cgroup.controllers": "\n",
+			"cgroup/unified/app/cgroup.freeze":  "1\n",
+		}, true},
+		{"v2 running", map[string]string{
+			"proc/42/cgroup":            "0::/app\n",
+			"cgroup/cgroup.controllers": "cpu memory\n",
+			"cgroup/app/cgroup.freeze":  "0\n",
+		}, false},
+		{"state unreadable", map[string]string{
+			"proc/42/cgroup": "7:freezer:/app\n",
+		}, false},
+		{"no cgroup file", map[string]string{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fakeSysfs(t, c.files)
+			path, frozen := frozenCgroup(42, testLogger{t})
+			if frozen != c.frozen {
+				t.Errorf("frozen is %t (%s), want %t", frozen, path, c.frozen)
+			}
+		})
+	}
+}
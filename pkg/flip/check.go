@@ -0,0 +1,218 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// capSysPtrace is the capability bit allowing to trace any process
+const capSysPtrace = 19
+
+// Yama ptrace_scope values
+const (
+	// scopeClassic lets a process trace any of the same uid
+	scopeClassic = 0
+	// scopeRestricted lets a process trace only its descendants
+	scopeRestricted = 1
+	// scopeAdmin needs CAP_SYS_PTRACE to trace
+	scopeAdmin = 2
+	// scopeNone disables attaching
+	scopeNone = 3
+)
+
+// Check is the outcome of one diagnostic of SelfCheck
+type Check struct {
+	// Name is what is checked
+	Name string `json:"name"`
+	// Passed is true if flips aren't hindered by it
+	Passed bool `json:"passed"`
+	// Optional is true if flips may still work when it fails,
+	// e.g. on processes of our own
+	Optional bool `json:"optional"`
+	// Detail tells what was found
+	Detail string `json:"detail"`
+}
+
+// SelfCheck looks at what fileflip needs from the system without
+// touching any process
+func SelfCheck() []Check {
+	return []Check{
+		checkArch(),
+		checkProcMount(),
+		checkCapability(),
+		checkPtraceScope(),
+	}
+}
+
+// CheckPassed tells if every required check passed
+func CheckPassed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Passed == false && check.Optional == false {
+			return false
+		}
+	}
+	return true
+}
+
+func checkArch() Check {
+	check := Check{Name: "arch", Passed: detectSupportedLinux()}
+	if check.Passed {
+		check.Detail = fmt.Sprintf("%s build on a supported kernel", runtime.GOARCH)
+	} else {
+		check.Detail = fmt.Sprintf("%s build on unsupported machine, want one of %s",
+			runtime.GOARCH, strings.Join(supportedMachines, ", "))
+	}
+	return check
+}
+
+func checkProcMount() Check {
+	check := Check{Name: "procfs", Passed: true, Detail: procfs + " is mounted"}
+	if err := checkProcfs(); err != nil {
+		check.Passed = false
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+func checkCapability() Check {
+	check := Check{Name: "CAP_SYS_PTRACE", Optional: true}
+	has, err := hasCapability(capSysPtrace)
+	switch {
+	case err != nil:
+		check.Detail = err.Error()
+	case has:
+		check.Passed = true
+		check.Detail = "processes of any user can be flipped"
+	default:
+		check.Detail = fmt.Sprintf("missing, only processes of uid %d can be flipped", os.Getuid())
+	}
+	return check
+}
+
+func checkPtraceScope() Check {
+	check := Check{Name: "ptrace_scope"}
+	scope, err := ptraceScope()
+	if os.IsNotExist(err) {
+		check.Passed = true
+		check.Detail = "Yama is not enabled"
+		return check
+	}
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	has, _ := hasCapability(capSysPtrace)
+	check.Passed, check.Detail = scopeAllows(scope, has)
+	return check
+}
+
+// scopeAllows tells if attaching a process which is not our child
+// is allowed under Yama scope, with or without CAP_SYS_PTRACE
+func scopeAllows(scope int, capable bool) (bool, string) {
+	switch {
+	case scope == scopeClassic:
+		return true, "0, processes of the same uid can be attached"
+	case scope == scopeNone:
+		return false, "3, attaching is disabled until reboot"
+	case capable:
+		return true, fmt.Sprintf("%d, attaching is allowed by CAP_SYS_PTRACE", scope)
+	case scope == scopeRestricted:
+		return false, "1, only descendants can be attached, run with CAP_SYS_PTRACE or set it to 0"
+	case scope == scopeAdmin:
+		return false, "2, only CAP_SYS_PTRACE can attach"
+	}
+	return false, fmt.Sprintf("%d, unknown value", scope)
+}
+
+// explainAttach tells why an attach of pid, or access to its /proc
+// entries, was refused when it is Yama ptrace_scope or a missing
+// CAP_SYS_PTRACE, which are the usual first run failures
+func explainAttach(pid int, err error) error {
+	if errors.Is(err, syscall.EPERM) == false && errors.Is(err, syscall.EACCES) == false {
+		return err
+	}
+	capable, capErr := hasCapability(capSysPtrace)
+	if scope, scopeErr := ptraceScope(); scopeErr == nil {
+		if allowed, detail := scopeAllows(scope, capable); allowed == false {
+			return &Error{Code: env.ExitScope, Err: fmt.Errorf(
+				"%w: kernel.yama.ptrace_scope is %s", err, detail)}
+		}
+	}
+	if capErr != nil || capable {
+		return err
+	}
+	detail := "fileflip needs CAP_SYS_PTRACE, run as root or grant the capability"
+	if owned, ownErr := ownedBy(pid, os.Getuid()); ownErr == nil && owned == false {
+		detail = fmt.Sprintf("process %d runs as another user than uid %d, %s", pid, os.Getuid(), detail)
+	}
+	return &Error{Code: env.ExitPerm, Err: fmt.Errorf("%w: %s", err, detail)}
+}
+
+// ownedBy tells if real, effective and saved uids of pid are all uid,
+// only then it can be attached without CAP_SYS_PTRACE
+func ownedBy(pid int, uid int) (bool, error) {
+	value, err := statusField(pid, "Uid")
+	if err != nil {
+		return false, err
+	}
+	return parseUids(value, uid)
+}
+
+// parseUids checks the first three uids of a status Uid line against
+// uid, the fourth is the filesystem uid
+func parseUids(value string, uid int) (bool, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return false, fmt.Errorf("bad Uid %q", value)
+	}
+	for _, field := range fields[:3] {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return false, fmt.Errorf("bad Uid %q", value)
+		}
+		if id != uid {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ptraceScope reads kernel.yama.ptrace_scope, a kernel without Yama
+// gives an IsNotExist error
+func ptraceScope() (int, error) {
+	content, err := ioutil.ReadFile(procfs + "/sys/kernel/yama/ptrace_scope")
+	if err != nil {
+		return 0, err
+	}
+	return parsePtraceScope(string(content))
+}
+
+// parsePtraceScope parses content of ptrace_scope
+func parsePtraceScope(content string) (int, error) {
+	scope, err := strconv.Atoi(strings.TrimSpace(content))
+	if err != nil {
+		return 0, fmt.Errorf("bad ptrace_scope %q", content)
+	}
+	return scope, nil
+}
+
+// hasCapability tells if capability bit is in our effective set
+func hasCapability(bit uint) (bool, error) {
+	value, err := statusField(os.Getpid(), "CapEff")
+	if err != nil {
+		return false, err
+	}
+	caps, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return false, fmt.Errorf("bad CapEff %q", value)
+	}
+	return caps&(1<<bit) != 0, nil
+}
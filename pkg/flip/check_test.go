@@ -0,0 +1,106 @@
+package flip
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestHasCapability(t *testing.T) {
+	cases := []struct {
+		name   string
+		status string
+		has    bool
+		err    bool
+	}{
+		{"root", "Name:\tapp\nCapEff:\t000001ffffffffff\n", true, false},
+		{"only CAP_SYS_PTRACE", "CapEff:\t0000000000080000\n", true, false},
+		{"without bit 19", "CapEff:\t00000000fff7ffff\n", false, false},
+		{"none", "CapEff:\t0000000000000000\n", false, false},
+		{"malformed", "CapEff:\tzz\n", false, true},
+		{"missing line", "Name:\tapp\nCapPrm:\t0000000000080000\n", false, true},
+	}
+	for _, c := range cases {
+		fakeSysfs(t, map[string]string{fmt.Sprintf("proc/%d/status", os.Getpid()): c.status})
+		has, err := hasCapability(capSysPtrace)
+		if (err != nil) != c.err || has != c.has {
+			t.Errorf("%s: %t %v, want %t and error %t", c.name, has, err, c.has, c.err)
+		}
+	}
+}
+
+func TestParsePtraceScope(t *testing.T) {
+	cases := []struct {
+		content string
+		scope   int
+		err     bool
+	}{
+		{"0\n", scopeClassic, false},
+		{"1\n", scopeRestricted, false},
+		{"2\n", scopeAdmin, false},
+		{"3\n", scopeNone, false},
+		{"", 0, true},
+		{"one\n", 0, true},
+	}
+	for _, c := range cases {
+		scope, err := parsePtraceScope(c.content)
+		if (err != nil) != c.err || scope != c.scope {
+			t.Errorf("%q: %d %v, want %d and error %t", c.content, scope, err, c.scope, c.err)
+		}
+	}
+}
+
+func TestPtraceScope(t *testing.T) {
+	fakeSysfs(t, map[string]string{"proc/sys/kernel/yama/ptrace_scope": "2\n"})
+	if scope, err := ptraceScope(); err != nil || scope != scopeAdmin {
+		t.Errorf("scope %d %v, want %d", scope, err, scopeAdmin)
+	}
+	// a kernel without Yama has no file
+	fakeSysfs(t, nil)
+	if _, err := ptraceScope(); os.IsNotExist(err) == false {
+		t.Errorf("error %v without Yama, want one of a missing file", err)
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	cases := []struct {
+		scope   int
+		capable bool
+		allowed bool
+	}{
+		{scopeClassic, false, true},
+		{scopeRestricted, false, false},
+		{scopeRestricted, true, true},
+		{scopeAdmin, false, false},
+		{scopeAdmin, true, true},
+		{scopeNone, true, false},
+		{-1, false, false},
+	}
+	for _, c := range cases {
+		if allowed, detail := scopeAllows(c.scope, c.capable); allowed != c.allowed {
+			t.Errorf("scope %d capable %t: %t (%s), want %t", c.scope, c.capable, allowed, detail, c.allowed)
+		}
+	}
+}
+
+func TestParseUids(t *testing.T) {
+	cases := []struct {
+		value string
+		owned bool
+		err   bool
+	}{
+		{"1000\t1000\t1000\t1000", true, false},
+		// the filesystem uid doesn't matter
+		{"1000\t1000\t1000\t0", true, false},
+		{"1000\t0\t1000\t1000", false, false},
+		{"0\t1000\t1000\t1000", false, false},
+		{"1000\t1000", false, true},
+		{"1000\tx\t1000\t1000", false, true},
+	}
+	for _, c := range cases {
+		owned, err := parseUids(c.value, 1000)
+		if (err != nil) != c.err || owned != c.owned {
+			t.Errorf("%q: %t %v, want %t and error %t", c.value, owned, err, c.owned, c.err)
+		}
+	}
+}
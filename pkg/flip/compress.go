@@ -0,0 +1,185 @@
+package flip
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// Codec is how the rolled file is compressed
+type Codec int
+
+const (
+	// CodecNone keeps the rolled file as is
+	CodecNone Codec = iota
+	// CodecGzip compresses with gzip into .gz
+	CodecGzip
+	// CodecZstd compresses with zstd into .zst
+	CodecZstd
+)
+
+var codecNames = map[Codec]string{
+	CodecNone: "none",
+	CodecGzip: "gzip",
+	CodecZstd: "zstd",
+}
+
+var codecExts = map[Codec]string{
+	CodecNone: "",
+	CodecGzip: ".gz",
+	CodecZstd: ".zst",
+}
+
+// ParseCodec looks up codec by name, empty name means CodecNone
+func ParseCodec(name string) (Codec, error) {
+	if name == "" {
+		return CodecNone, nil
+	}
+	for codec, codecName := range codecNames {
+		if codecName == name {
+			return codec, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unknown codec %q", name)
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// Set parses codec name, it makes Codec a flag.Value
+func (c *Codec) Set(name string) error {
+	codec, err := ParseCodec(name)
+	if err != nil {
+		return err
+	}
+	*c = codec
+	return nil
+}
+
+// Ext is file extension appended by codec
+func (c Codec) Ext() string {
+	return codecExts[c]
+}
+
+func (c Codec) valid() bool {
+	_, ok := codecNames[c]
+	return ok
+}
+
+// encoder builds the compressing writer of codec
+func (c Codec) encoder(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("no encoder for codec %s", c)
+}
+
+// compressFile compresses rolledPath into rolledPath with extension of
+// codec and removes it, the compressed path and size are returned. The
+// rolled file is kept if anything fails
+func compressFile(rolledPath string, codec Codec, logger log.Logger) (string, int64, error) {
+	dst := rolledPath + codec.Ext()
+	if err := streamFile(rolledPath, dst, codec.encoder); err != nil {
+		if os.IsExist(err) == false {
+			os.Remove(dst)
+		}
+		return "", 0, fmt.Errorf("compress %s error: %w", rolledPath, err)
+	}
+	fInfo, err := os.Stat(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.Remove(rolledPath); err != nil {
+		logger.Error("remove %s error: %s\n", rolledPath, err)
+	}
+	return dst, fInfo.Size(), nil
+}
+
+// compressorExts are the extensions of well known compressors, by
+// program name
+var compressorExts = map[string]string{
+	"bzip2":  ".bz2",
+	"gzip":   ".gz",
+	"lbzip2": ".bz2",
+	"lz4":    ".lz4",
+	"pbzip2": ".bz2",
+	"pigz":   ".gz",
+	"pixz":   ".xz",
+	"pzstd":  ".zst",
+	"xz":     ".xz",
+	"zstd":   ".zst",
+}
+
+// CompressorExt is the extension of archives written by program, empty
+// if it is not a known compressor
+func CompressorExt(program string) string {
+	return compressorExts[filepath.Base(program)]
+}
+
+// compressWithCmd runs opts.CompressCmd with rolledPath on stdin and
+// rolledPath with opts.CompressExt on stdout, then removes rolledPath.
+// The compressed path and size are returned. The rolled file is kept
+// if the command fails
+func compressWithCmd(ctx context.Context, rolledPath string, opts Options) (string, int64, error) {
+	logger := opts.logger()
+	in, err := os.Open(rolledPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("compress %s error: %w", rolledPath, err)
+	}
+	defer in.Close()
+	fInfo, err := in.Stat()
+	if err != nil {
+		return "", 0, fmt.Errorf("compress %s error: %w", rolledPath, err)
+	}
+	dst := rolledPath + opts.CompressExt
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fInfo.Mode().Perm())
+	if err != nil {
+		return "", 0, fmt.Errorf("compress %s error: %w", rolledPath, err)
+	}
+
+	cmd := exec.CommandContext(ctx, opts.CompressCmd[0], opts.CompressCmd[1:]...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	logger.Debug("compress %s with %q\n", rolledPath, opts.CompressCmd)
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("compress command %q exited with %d", opts.CompressCmd, exitErr.ExitCode())
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", 0, fmt.Errorf("compress %s error: %w, it is kept uncompressed", rolledPath, err)
+	}
+
+	atime, mtime := fileTimes(fInfo)
+	if err := os.Chtimes(dst, atime, mtime); err != nil {
+		logger.Warn("set times of %s error: %s\n", dst, err)
+	}
+	if fInfo, err = os.Stat(dst); err != nil {
+		return "", 0, err
+	}
+	if err := os.Remove(rolledPath); err != nil {
+		logger.Error("remove %s error: %s\n", rolledPath, err)
+	}
+	return dst, fInfo.Size(), nil
+}
@@ -0,0 +1,55 @@
+package flip
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+func TestFlipCompressCmd(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	useFakeTracer(t, &fakeTracer{})
+
+	// cat compresses nothing, the archive is the rolled file as is
+	opts := Options{CompressCmd: []string{"cat"}, CompressExt: ".cat", Logger: testLogger{t}}
+	result, err := Flip(os.Getpid(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolledPath := path + rolledSuffix
+	if want := rolledPath + ".cat"; result.RolledPath != want {
+		t.Errorf("archive at %s, want %s", result.RolledPath, want)
+	}
+	if content, err := os.ReadFile(result.RolledPath); err != nil || string(content) != "before\n" {
+		t.Errorf("archive holds %q %v", content, err)
+	}
+	if result.CompressedBytes != int64(len("before\n")) {
+		t.Errorf("compressed %d bytes, want %d", result.CompressedBytes, len("before\n"))
+	}
+	if _, err := os.Stat(rolledPath); os.IsNotExist(err) == false {
+		t.Errorf("%s kept after compressed", rolledPath)
+	}
+}
+
+func TestFlipCompressCmdFails(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	useFakeTracer(t, &fakeTracer{})
+
+	opts := Options{CompressCmd: []string{"sh", "-c", "cat; exit 1"}, CompressExt: ".cat", Logger: testLogger{t}}
+	result, err := Flip(os.Getpid(), path, opts)
+	if code := ExitCode(err); code != env.ExitPartial {
+		t.Fatalf("exit code %d, want %d (%v)", code, env.ExitPartial, err)
+	}
+	// the flip is done, only the archive stays uncompressed
+	rolledPath := path + rolledSuffix
+	if result.RolledPath != rolledPath {
+		t.Errorf("archive at %s, want %s", result.RolledPath, rolledPath)
+	}
+	if content, err := os.ReadFile(rolledPath); err != nil || string(content) != "before\n" {
+		t.Errorf("uncompressed archive holds %q %v", content, err)
+	}
+	if _, err := os.Stat(rolledPath + ".cat"); os.IsNotExist(err) == false {
+		t.Errorf("half written %s kept", rolledPath+".cat")
+	}
+}
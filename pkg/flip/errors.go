@@ -0,0 +1,59 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+// Error is a flip failure with the exit code of its class
+type Error struct {
+	// Code is one of the env.Exit* codes
+	Code int
+	// Err is the underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code int, format string, v ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, v...)}
+}
+
+// Skipped tells if err only means there is nothing to do, which is
+// not a failure
+func Skipped(err error) bool {
+	switch ExitCode(err) {
+	case env.ExitIgn, env.ExitRotated, env.ExitSmall:
+		return true
+	}
+	return false
+}
+
+// ExitCode maps error returned by Flip to a process exit code
+func ExitCode(err error) int {
+	if err == nil {
+		return env.ExitOk
+	}
+	var flipErr *Error
+	if errors.As(err, &flipErr) {
+		return flipErr.Code
+	}
+	switch {
+	case errors.Is(err, ptrace.ErrProcessGone), errors.Is(err, syscall.ESRCH):
+		return env.ExitGone
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return env.ExitPerm
+	}
+	return env.ExitErr
+}
@@ -0,0 +1,363 @@
+package flip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+// explainFd is the first descriptor Explain makes up for a file process
+// would open, far above any it really has
+const explainFd = 1 << 30
+
+// explainAddr is the address Explain makes up for the mapping in process
+const explainAddr = 0x40000000
+
+// Step is one action of a flip as Explain shows it
+type Step struct {
+	// Remote is true for a syscall process is made to do, false for
+	// what fileflip does itself
+	Remote bool `json:"remote"`
+	// Call is the syscall or action with its arguments, a descriptor or
+	// address only known during the flip is shown as FD1 or ADDR
+	Call string `json:"call"`
+	// Ret is the result the flip goes on with, read from process where
+	// it can be, e.g. status flags of F_GETFL
+	Ret string `json:"ret,omitempty"`
+}
+
+func (s Step) String() string {
+	who := "fileflip"
+	if s.Remote {
+		who = "process"
+	}
+	if s.Ret == "" {
+		return fmt.Sprintf("%-8s %s", who, s.Call)
+	}
+	return fmt.Sprintf("%-8s %s = %s", who, s.Call, s.Ret)
+}
+
+// Explain tells each syscall a flip of filePath would inject in pid
+// with its exact arguments, and what fileflip does itself around them.
+// Process is attached and asked only for the flags of its descriptors
+// by fcntl F_GETFL and F_GETFD, nothing else is injected and no file
+// is touched
+func Explain(ctx context.Context, pid int, filePath string, opts Options) ([]Step, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	// all ptrace requests must come from the attaching thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	tracer := newTracer(pid, opts)
+	if err := tracer.Setup(); err != nil {
+		return nil, explainAttach(pid, err)
+	}
+	ex := &explainer{
+		heldTracer: heldTracer{tracer},
+		pid:        pid,
+		opts:       opts,
+		nextFd:     explainFd,
+		mem:        map[uintptr][]byte{},
+	}
+	opts.held, opts.heldPid, opts.explain = ex, pid, ex
+	result, err := FlipContext(ctx, pid, filePath, opts)
+	if cleanErr := tracer.Cleanup(); cleanErr != nil && err == nil {
+		err = cleanErr
+	}
+	if err != nil {
+		return ex.steps, err
+	}
+	ex.afterDetach(result)
+	return ex.steps, nil
+}
+
+// explainer stands in for the tracer of a flip under Explain. Each
+// syscall is recorded instead of injected and answered with what the
+// flip would get, queries are injected as they change nothing, other
+// results are made up
+type explainer struct {
+	heldTracer
+	pid   int
+	opts  Options
+	steps []Step
+	// nextFd is the next descriptor made up for process
+	nextFd  int64
+	mapSize uint64
+	// sp is the stack pointer of process once read for StackScratch
+	sp uintptr
+	// mem is what was written to process, so it can be read back
+	mem map[uintptr][]byte
+}
+
+// local records an action of fileflip itself
+func (ex *explainer) local(format string, v ...interface{}) {
+	ex.steps = append(ex.steps, Step{Call: fmt.Sprintf(format, v...)})
+}
+
+func (ex *explainer) RemoteMemcp(src []byte, addr uintptr, size int) error {
+	ex.mem[addr] = append([]byte(nil), src[:size]...)
+	ex.local("write %s %s", ex.addr(uint64(addr)), ex.fdNames(strconv.Quote(string(src[:size]))))
+	return nil
+}
+
+// StackPointer is the one of process, remembered so addresses below
+// show as SP-N
+func (ex *explainer) StackPointer() (uintptr, error) {
+	sp, err := ex.heldTracer.StackPointer()
+	if err == nil {
+		ex.sp = sp
+	}
+	return sp, err
+}
+
+func (ex *explainer) RemotePeek(addr uintptr, size int) ([]byte, error) {
+	written, ok := ex.mem[addr]
+	if ok == false || len(written) < size {
+		return nil, fmt.Errorf("nothing written at %#x", addr)
+	}
+	return written[:size], nil
+}
+
+func (ex *explainer) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	var ret int64
+	var retName string
+	switch {
+	case nr == sysFcntl && (args[1] == syscall.F_GETFL || args[1] == syscall.F_GETFD):
+		// queries change nothing, process answers them as in the flip
+		var err error
+		if ret, err = ex.heldTracer.RemoteSyscall(nr, args...); err != nil {
+			return ret, err
+		}
+		if args[1] == syscall.F_GETFL {
+			retName = decodeFlags(int(ret))
+		} else if ret&syscall.FD_CLOEXEC != 0 {
+			retName = "FD_CLOEXEC"
+		} else {
+			retName = "0"
+		}
+	case nr == sysFcntl && args[1] == syscall.F_DUPFD_CLOEXEC, nr == syscall.SYS_OPEN:
+		ret = ex.nextFd
+		ex.nextFd++
+		retName = ex.fd(uint64(ret))
+	case nr == sysMmap:
+		ret, retName = explainAddr, "ADDR"
+		ex.mapSize = args[1]
+	}
+	ex.steps = append(ex.steps, Step{Remote: true, Call: ex.call(nr, args), Ret: retName})
+	return ret, nil
+}
+
+// rollover records the rename a flip would do, see reopen
+func (ex *explainer) rollover(filePath string, rolledPath string, logger log.Logger) (os.FileMode, error) {
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0, newError(env.ExitNotFound, "%s", err)
+	}
+	switch {
+	case ex.opts.Numbered:
+		ex.local("move numbered archives of %q one number up", filePath)
+		ex.local("rename(%q, %q)", filePath, rolledPath)
+	case ex.opts.Swap:
+		swapPath := filePath + swapSuffix
+		ex.local("create %q with owner and mode of %q", swapPath, filePath)
+		ex.local("renameat2(%q, %q, RENAME_EXCHANGE)", swapPath, filePath)
+		ex.local("rename(%q, %q)", swapPath, rolledPath)
+	default:
+		ex.local("rename(%q, %q)", filePath, rolledPath)
+	}
+	return fInfo.Mode(), nil
+}
+
+// rollback does nothing as nothing was renamed
+func (ex *explainer) rollback(string, string, log.Logger) {}
+
+// afterDetach records what is done once process runs again
+func (ex *explainer) afterDetach(result *Result) {
+	opts := ex.opts
+	if opts.FollowForks && opts.RenameOnly == false {
+		ex.local("flip descendants of pid %d holding the old file the same way", ex.pid)
+	}
+	if opts.Verify && len(result.Fds) > 0 {
+		ex.local("check fd %s of pid %d open %q", result.fdList(), ex.pid, result.Path)
+	}
+	if result.Deleted == false && opts.Compress != CodecNone {
+		ex.local("compress %q with %s", result.RolledPath, opts.Compress)
+	}
+	if result.Deleted == false && len(opts.CompressCmd) > 0 {
+		ex.local("run %q < %q > %q", opts.CompressCmd, result.RolledPath, result.RolledPath+opts.CompressExt)
+	}
+	if opts.Fsync && result.Deleted == false {
+		ex.local("fsync %q and its directory", result.RolledPath)
+	}
+	if opts.Fsync && (result.Deleted || filepath.Dir(result.RolledPath) != filepath.Dir(result.Path)) {
+		ex.local("fsync directory %q", filepath.Dir(result.Path))
+	}
+	if result.Deleted == false && opts.Numbered && opts.Keep > 0 {
+		ex.local("remove archives of %q above %d", result.Path, opts.Keep)
+	}
+	if len(opts.PostCmd) > 0 {
+		ex.local("run %q", opts.PostCmd)
+	}
+}
+
+// call formats syscall nr with args the way strace does
+func (ex *explainer) call(nr int, args []uint64) string {
+	var fields []string
+	switch nr {
+	case sysFcntl:
+		fields = []string{ex.fd(args[0]), fcntlCmd(args[1])}
+		switch args[1] {
+		case syscall.F_SETFL:
+			fields = append(fields, flagsOrZero(decodeFlags(int(args[2]))))
+		case syscall.F_DUPFD_CLOEXEC:
+			fields = append(fields, strconv.FormatUint(args[2], 10))
+		case fSetlk, fOfdSetlk:
+			fields = append(fields, ex.addr(args[2]))
+		}
+	case sysMmap:
+		fields = []string{ex.addr(args[0]), strconv.FormatUint(args[1], 10),
+			mmapProt(args[2]), mmapFlags(args[3]),
+			strconv.FormatUint(args[4], 10), strconv.FormatUint(args[5], 10)}
+	case syscall.SYS_MUNMAP:
+		fields = []string{ex.addr(args[0]), strconv.FormatUint(args[1], 10)}
+	case syscall.SYS_OPEN:
+		fields = []string{ex.addr(args[0]), openFlagString(int(args[1])), fmt.Sprintf("%#o", args[2])}
+	case syscall.SYS_FCHMOD:
+		fields = []string{ex.fd(args[0]), fmt.Sprintf("%#o", args[1])}
+	case syscall.SYS_DUP3:
+		fields = []string{ex.fd(args[0]), ex.fd(args[1]), flagsOrZero(decodeFlags(int(args[2])))}
+	case syscall.SYS_CLOSE:
+		fields = []string{ex.fd(args[0])}
+	case syscall.SYS_LSEEK:
+		whence := map[uint64]string{0: "SEEK_SET", 1: "SEEK_CUR", 2: "SEEK_END"}[args[2]]
+		fields = []string{ex.fd(args[0]), strconv.FormatUint(args[1], 10), whence}
+	case syscall.SYS_FTRUNCATE:
+		fields = []string{ex.fd(args[0]), strconv.FormatUint(args[1], 10)}
+	case syscall.SYS_FALLOCATE:
+		fields = []string{ex.fd(args[0]), "FALLOC_FL_KEEP_SIZE"}
+		for _, arg := range args[2:] {
+			fields = append(fields, strconv.FormatUint(arg, 10))
+		}
+	case syscall.SYS_LINKAT:
+		fields = []string{"AT_FDCWD", ex.addr(args[1]), "AT_FDCWD", ex.addr(args[3]), "AT_SYMLINK_FOLLOW"}
+	case syscall.SYS_FLOCK:
+		how := "LOCK_SH|LOCK_NB"
+		if args[1]&syscall.LOCK_EX != 0 {
+			how = "LOCK_EX|LOCK_NB"
+		}
+		fields = []string{ex.fd(args[0]), how}
+	default:
+		for _, arg := range args {
+			fields = append(fields, fmt.Sprintf("%#x", arg))
+		}
+	}
+	return fmt.Sprintf("%s(%s)", ptrace.SyscallName(nr), strings.Join(fields, ", "))
+}
+
+// fd names a descriptor, FDn if it is made up
+func (ex *explainer) fd(v uint64) string {
+	if int64(v) >= explainFd && int64(v) < ex.nextFd {
+		return fmt.Sprintf("FD%d", int64(v)-explainFd+1)
+	}
+	return strconv.FormatInt(int64(int32(v)), 10)
+}
+
+// fdNames replaces made up descriptors in s by their names
+func (ex *explainer) fdNames(s string) string {
+	for fd := ex.nextFd - 1; fd >= explainFd; fd-- {
+		s = strings.ReplaceAll(s, strconv.FormatInt(fd, 10), ex.fd(uint64(fd)))
+	}
+	return s
+}
+
+// addr names an address in the made up mapping as ADDR+n
+func (ex *explainer) addr(v uint64) string {
+	switch {
+	case v == 0:
+		return "NULL"
+	case v == explainAddr:
+		return "ADDR"
+	case v > explainAddr && v < explainAddr+ex.mapSize:
+		return fmt.Sprintf("ADDR+%d", v-explainAddr)
+	case ex.sp != 0 && v < uint64(ex.sp) && v >= uint64(ex.sp)-2*syscall.PathMax:
+		return fmt.Sprintf("SP-%d", uint64(ex.sp)-v)
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+// openFlagNames are flags of open beyond those decodeFlags knows,
+// O_TMPFILE comes before O_DIRECTORY since it contains it
+var openFlagNames = []struct {
+	flag int
+	name string
+}{
+	{syscall.O_CREAT, "O_CREAT"},
+	{syscall.O_EXCL, "O_EXCL"},
+	{syscall.O_NOCTTY, "O_NOCTTY"},
+	{syscall.O_TRUNC, "O_TRUNC"},
+	{syscall.O_NOFOLLOW, "O_NOFOLLOW"},
+	{oTmpfile, "O_TMPFILE"},
+	{syscall.O_DIRECTORY, "O_DIRECTORY"},
+}
+
+// openFlagString decodes flags given to open
+func openFlagString(flags int) string {
+	names := []string{decodeFlags(flags)}
+	for _, fn := range openFlagNames {
+		if flags&fn.flag == fn.flag {
+			names = append(names, fn.name)
+			flags &^= fn.flag
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+func flagsOrZero(names string) string {
+	if names == "" || names == "O_RDONLY" {
+		return "0"
+	}
+	return strings.TrimPrefix(names, "O_RDONLY|")
+}
+
+func fcntlCmd(cmd uint64) string {
+	switch cmd {
+	case syscall.F_GETFL:
+		return "F_GETFL"
+	case syscall.F_SETFL:
+		return "F_SETFL"
+	case syscall.F_GETFD:
+		return "F_GETFD"
+	case syscall.F_DUPFD_CLOEXEC:
+		return "F_DUPFD_CLOEXEC"
+	case fSetlk:
+		return fSetlkName
+	case fOfdSetlk:
+		return "F_OFD_SETLK"
+	}
+	return strconv.FormatUint(cmd, 10)
+}
+
+func mmapProt(prot uint64) string {
+	if prot == syscall.PROT_READ|syscall.PROT_WRITE {
+		return "PROT_READ|PROT_WRITE"
+	}
+	return fmt.Sprintf("%#x", prot)
+}
+
+func mmapFlags(flags uint64) string {
+	if flags == syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS {
+		return "MAP_PRIVATE|MAP_ANONYMOUS"
+	}
+	return fmt.Sprintf("%#x", flags)
+}
@@ -0,0 +1,100 @@
+package flip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+func TestExplainOnlyQueries(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	steps, err := Explain(context.Background(), os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.setups != 1 || fake.cleanups != 1 {
+		t.Errorf("attached %d and detached %d times, want once", fake.setups, fake.cleanups)
+	}
+	// only fcntl queries reach the process
+	for _, nr := range fake.calls {
+		if nr != sysFcntl {
+			t.Errorf("syscall %d injected, want only fcntl", nr)
+		}
+	}
+	if len(fake.calls) == 0 {
+		t.Error("flags not asked from process")
+	}
+	var getfl string
+	for _, step := range steps {
+		if strings.Contains(step.Call, "F_GETFL") {
+			getfl = step.Ret
+		}
+	}
+	if want := decodeFlags(syscall.O_WRONLY | syscall.O_APPEND); getfl != want {
+		t.Errorf("F_GETFL step returns %q, want %q as process answered", getfl, want)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "before\n" {
+		t.Errorf("%s touched: %q %v", path, content, err)
+	}
+	if _, err := os.Stat(path + rolledSuffix); os.IsNotExist(err) == false {
+		t.Errorf("%s created by explain", path+rolledSuffix)
+	}
+}
+
+func TestExplainMatchesFlip(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"tmpfile", Options{Tmpfile: true}},
+		{"exact mode, prealloc", Options{ExactMode: true, Prealloc: 1 << 20}},
+		{"offset append", Options{Offset: OffsetAppend}},
+	} {
+		opts := c.opts
+		opts.Logger = testLogger{t}
+		explained := &fakeTracer{}
+		useFakeTracer(t, explained)
+		steps, err := Explain(context.Background(), os.Getpid(), openedFile(t, "app.log", "before\n"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flipped := &fakeTracer{}
+		useFakeTracer(t, flipped)
+		if _, err := Flip(os.Getpid(), openedFile(t, "app.log", "before\n"), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		var explainedCalls []string
+		for _, step := range steps {
+			if step.Remote {
+				explainedCalls = append(explainedCalls, step.Call)
+			}
+		}
+		if len(explainedCalls) != len(flipped.calls) {
+			t.Fatalf("%s: explained %d syscalls %q, flip injected %d", c.name, len(explainedCalls), explainedCalls, len(flipped.calls))
+		}
+		for i, nr := range flipped.calls {
+			// addresses differ, the exact flags and sizes don't
+			prefix, suffix := ptrace.SyscallName(nr)+"(", ")"
+			args := flipped.args[i]
+			switch nr {
+			case syscall.SYS_OPEN:
+				suffix = fmt.Sprintf(", %s, %#o)", openFlagString(int(args[1])), args[2])
+			case sysMmap:
+				prefix += fmt.Sprintf("NULL, %d, ", args[1])
+			}
+			if strings.HasPrefix(explainedCalls[i], prefix) == false || strings.HasSuffix(explainedCalls[i], suffix) == false {
+				t.Errorf("%s: step %d explained %s, flip injected %s...%s", c.name, i, explainedCalls[i], prefix, suffix)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package flip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+const (
+	// kernel always reports it on 64-bit, syscall package defines it as 0 there
+	oLargefile = 0100000
+	// not defined in syscall package
+	oPath = 010000000
+)
+
+// flagNames are status flags decoded from F_GETFL or fdinfo, O_SYNC
+// comes before O_DSYNC since it contains the O_DSYNC bit
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{syscall.O_APPEND, "O_APPEND"},
+	{syscall.O_NONBLOCK, "O_NONBLOCK"},
+	{syscall.O_SYNC, "O_SYNC"},
+	{syscall.O_DSYNC, "O_DSYNC"},
+	{syscall.O_ASYNC, "O_ASYNC"},
+	{syscall.O_DIRECT, "O_DIRECT"},
+	{oLargefile, "O_LARGEFILE"},
+	{syscall.O_NOATIME, "O_NOATIME"},
+	{syscall.O_CLOEXEC, "O_CLOEXEC"},
+	{oPath, "O_PATH"},
+}
+
+// FdInfo describes an opened descriptor of process
+type FdInfo struct {
+	// Fd is the descriptor number
+	Fd int `json:"fd"`
+	// Path is the fd link, a path in root of process which may end
+	// with " (deleted)"
+	Path string `json:"path"`
+	// Dev and Ino identify the opened file
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+	// Flags are file status flags and access mode
+	Flags int `json:"flags"`
+	// Pos is current file offset
+	Pos int64 `json:"pos"`
+	// Locks are advisory locks held through the descriptor
+	Locks []FdLock `json:"locks,omitempty"`
+}
+
+// FdLock is a lock line of fdinfo
+type FdLock struct {
+	// Kind is FLOCK, POSIX, OFDLCK or LEASE
+	Kind string `json:"kind"`
+	// Write is true for an exclusive lock
+	Write bool `json:"write"`
+	// Start is the first locked byte
+	Start int64 `json:"start"`
+	// End is the last locked byte, -1 means up to EOF
+	End int64 `json:"end"`
+}
+
+// String formats lock as KIND:MODE:START-END
+func (l FdLock) String() string {
+	mode := "READ"
+	if l.Write {
+		mode = "WRITE"
+	}
+	end := "EOF"
+	if l.End >= 0 {
+		end = strconv.FormatInt(l.End, 10)
+	}
+	return fmt.Sprintf("%s:%s:%d-%s", l.Kind, mode, l.Start, end)
+}
+
+// FlagString decodes Flags as O_* names joined by "|"
+func (info *FdInfo) FlagString() string {
+	return decodeFlags(info.Flags)
+}
+
+// DevString formats Dev as MAJOR:MINOR the way /proc shows it
+func (info *FdInfo) DevString() string {
+	major := (info.Dev>>8)&0xfff | (info.Dev>>32)&^0xfff
+	minor := info.Dev&0xff | (info.Dev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+func decodeFlags(flags int) string {
+	names := []string{}
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		names = append(names, "O_RDONLY")
+	case syscall.O_WRONLY:
+		names = append(names, "O_WRONLY")
+	case syscall.O_RDWR:
+		names = append(names, "O_RDWR")
+	}
+	for _, fn := range flagNames {
+		if flags&fn.flag == fn.flag {
+			names = append(names, fn.name)
+			flags &^= fn.flag
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ioFds drops O_PATH descriptors from fds, they only name the file
+// for *at calls and fstat, nothing is written through them. Those
+// dropped are returned too
+func ioFds(pid int, fds []int, logger log.Logger) ([]int, []int) {
+	var kept, pathFds []int
+	for _, fd := range fds {
+		info, err := readFdInfo(pid, fd)
+		if err == nil && info.Flags&oPath != 0 {
+			logger.Debug("fd %d of process %d is O_PATH, skipped\n", fd, pid)
+			pathFds = append(pathFds, fd)
+			continue
+		}
+		kept = append(kept, fd)
+	}
+	return kept, pathFds
+}
+
+// InspectFd describes fd of pid from /proc alone, what it opens, its
+// flags, offset and locks, without attaching to process
+func InspectFd(pid int, fd int) (*FdInfo, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	fdPath := fmt.Sprintf("%s/%d/fd/%d", procfs, pid, fd)
+	target, err := os.Readlink(fdPath)
+	if err != nil {
+		if _, statErr := os.Stat(fmt.Sprintf("%s/%d", procfs, pid)); os.IsNotExist(statErr) {
+			return nil, newError(env.ExitNotFound, "process %d not found", pid)
+		}
+		if os.IsPermission(err) {
+			return nil, newError(env.ExitPerm, "%s", err)
+		}
+		return nil, newError(env.ExitNotFound, "process %d has no fd %d", pid, fd)
+	}
+	var fdStat syscall.Stat_t
+	if err := syscall.Stat(fdPath, &fdStat); err != nil {
+		return nil, newError(env.ExitNotFound, "fd %d of process %d: %s", fd, pid, err)
+	}
+	info, err := readFdInfo(pid, fd)
+	if err != nil {
+		return nil, newError(env.ExitNotFound, "fd %d of process %d: %s", fd, pid, err)
+	}
+	info.Path = target
+	info.Dev, info.Ino = uint64(fdStat.Dev), uint64(fdStat.Ino)
+	return info, nil
+}
+
+// readFdInfo parses /proc/<pid>/fdinfo/<fd>
+func readFdInfo(pid int, fd int) (*FdInfo, error) {
+	f, err := os.Open(fmt.Sprintf("%s/%d/fdinfo/%d", procfs, pid, fd))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := parseFdInfo(f)
+	if err != nil {
+		return nil, err
+	}
+	info.Fd = fd
+	return info, nil
+}
+
+// parseFdInfo reads "key:\tvalue" lines of fdinfo, pos is decimal
+// and flags is octal, each held lock has a line like
+// "lock:\t1: FLOCK  ADVISORY  WRITE 1234 00:2d:5678 0 EOF"
+func parseFdInfo(r io.Reader) (*FdInfo, error) {
+	info := &FdInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "pos":
+			pos, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad fdinfo pos %q", value)
+			}
+			info.Pos = pos
+		case "flags":
+			flags, err := strconv.ParseInt(value, 8, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad fdinfo flags %q", value)
+			}
+			info.Flags = int(flags)
+		case "lock":
+			lock, ok, err := parseLockLine(value)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				info.Locks = append(info.Locks, lock)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// parseLockLine parses a lock line after "lock:", waiters blocked
+// on the lock are marked with "->" and skipped
+func parseLockLine(value string) (FdLock, bool, error) {
+	fields := strings.Fields(value)
+	if len(fields) > 1 && fields[1] == "->" {
+		return FdLock{}, false, nil
+	}
+	if len(fields) != 8 {
+		return FdLock{}, false, fmt.Errorf("bad fdinfo lock %q", value)
+	}
+	lock := FdLock{Kind: fields[1], Write: fields[3] == "WRITE", End: -1}
+	start, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return FdLock{}, false, fmt.Errorf("bad fdinfo lock %q", value)
+	}
+	lock.Start = start
+	if fields[7] != "EOF" {
+		end, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			return FdLock{}, false, fmt.Errorf("bad fdinfo lock %q", value)
+		}
+		lock.End = end
+	}
+	return lock, true, nil
+}
@@ -0,0 +1,137 @@
+package flip
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseFdInfo(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    *FdInfo
+		err     bool
+	}{
+		{
+			name:    "append",
+			content: "pos:\t1234\nflags:\t02102001\nmnt_id:\t29\nino:\t5678\n",
+			want:    &FdInfo{Pos: 1234, Flags: 02102001},
+		},
+		{
+			// a pos of digits 8 and 9 shows it is read as decimal
+			name:    "decimal pos, octal flags",
+			content: "pos:\t98\nflags:\t0100\n",
+			want:    &FdInfo{Pos: 98, Flags: 0100},
+		},
+		{
+			name: "locks and a waiter",
+			content: "pos:\t0\nflags:\t0102001\n" +
+				"lock:\t1: FLOCK  ADVISORY  WRITE 1234 fe:00:5678 0 EOF\n" +
+				"lock:\t1: -> FLOCK  ADVISORY  WRITE 4321 fe:00:5678 0 EOF\n" +
+				"lock:\t2: POSIX  ADVISORY  READ  1234 fe:00:5678 10 19\n",
+			want: &FdInfo{Flags: 0102001, Locks: []FdLock{
+				{Kind: "FLOCK", Write: true, Start: 0, End: -1},
+				{Kind: "POSIX", Write: false, Start: 10, End: 19},
+			}},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    &FdInfo{},
+		},
+		{
+			name:    "bad pos",
+			content: "pos:\tabc\nflags:\t02\n",
+			err:     true,
+		},
+		{
+			name:    "flags not octal",
+			content: "pos:\t0\nflags:\t0289\n",
+			err:     true,
+		},
+		{
+			name:    "bad lock",
+			content: "pos:\t0\nflags:\t02\nlock:\t1: FLOCK ADVISORY\n",
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info, err := parseFdInfo(strings.NewReader(c.content))
+			if c.err {
+				if err == nil {
+					t.Errorf("parsed %+v, want an error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(info, c.want) == false {
+				t.Errorf("parsed %+v, want %+v", info, c.want)
+			}
+		})
+	}
+}
+
+func TestParseLockLine(t *testing.T) {
+	cases := []struct {
+		value string
+		want  FdLock
+		ok    bool
+		err   bool
+	}{
+		{"1: FLOCK  ADVISORY  WRITE 1234 fe:00:5678 0 EOF", FdLock{Kind: "FLOCK", Write: true, End: -1}, true, false},
+		{"2: POSIX  ADVISORY  READ  1234 fe:00:5678 100 199", FdLock{Kind: "POSIX", Start: 100, End: 199}, true, false},
+		{"3: OFDLCK ADVISORY  WRITE -1 fe:00:5678 5 EOF", FdLock{Kind: "OFDLCK", Write: true, Start: 5, End: -1}, true, false},
+		{"1: -> FLOCK  ADVISORY  WRITE 4321 fe:00:5678 0 EOF", FdLock{}, false, false},
+		{"1: FLOCK  ADVISORY  WRITE 1234 fe:00:5678", FdLock{}, false, true},
+		{"1: POSIX  ADVISORY  WRITE 1234 fe:00:5678 x EOF", FdLock{}, false, true},
+		{"1: POSIX  ADVISORY  WRITE 1234 fe:00:5678 0 y", FdLock{}, false, true},
+	}
+	for _, c := range cases {
+		lock, ok, err := parseLockLine(c.value)
+		if (err != nil) != c.err {
+			t.Errorf("%q: error %v, want error %t", c.value, err, c.err)
+			continue
+		}
+		if ok != c.ok || lock != c.want {
+			t.Errorf("%q: parsed %+v %t, want %+v %t", c.value, lock, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestFdLockString(t *testing.T) {
+	cases := []struct {
+		lock FdLock
+		want string
+	}{
+		{FdLock{Kind: "FLOCK", Write: true, End: -1}, "FLOCK:WRITE:0-EOF"},
+		{FdLock{Kind: "POSIX", Start: 10, End: 19}, "POSIX:READ:10-19"},
+	}
+	for _, c := range cases {
+		if got := c.lock.String(); got != c.want {
+			t.Errorf("%+v is %q, want %q", c.lock, got, c.want)
+		}
+	}
+}
+
+func TestDecodeFlags(t *testing.T) {
+	cases := []struct {
+		flags int
+		want  string
+	}{
+		{syscall.O_RDONLY, "O_RDONLY"},
+		{syscall.O_WRONLY | syscall.O_APPEND, "O_WRONLY|O_APPEND"},
+		// O_SYNC contains O_DSYNC, which is not named again
+		{syscall.O_RDWR | syscall.O_SYNC, "O_RDWR|O_SYNC"},
+		{syscall.O_WRONLY | syscall.O_DSYNC, "O_WRONLY|O_DSYNC"},
+	}
+	for _, c := range cases {
+		if got := decodeFlags(c.flags); got != c.want {
+			t.Errorf("flags %#o decode to %q, want %q", c.flags, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package flip
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// FdPolicy tells what happens to the descriptors already flipped when
+// another one of the same file fails, e.g. fd 2 after fd 1 of stdio
+type FdPolicy int
+
+const (
+	// FdBestEffort keeps what was flipped, the flip exits ExitPartial
+	// and the failed ones keep writing to the old file
+	FdBestEffort FdPolicy = iota
+	// FdAllOrNothing puts the old file back on every descriptor and
+	// undoes the rename, so the process sees no change at all. The
+	// process is held stopped until all of them are flipped
+	FdAllOrNothing
+)
+
+var fdPolicyNames = map[FdPolicy]string{
+	FdBestEffort:   "best-effort",
+	FdAllOrNothing: "all-or-nothing",
+}
+
+// ParseFdPolicy looks up policy by name, empty name means FdBestEffort
+func ParseFdPolicy(name string) (FdPolicy, error) {
+	if name == "" {
+		return FdBestEffort, nil
+	}
+	for policy, policyName := range fdPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return FdBestEffort, fmt.Errorf("unknown fd policy %q", name)
+}
+
+func (p FdPolicy) String() string {
+	if name, ok := fdPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("FdPolicy(%d)", int(p))
+}
+
+// Set parses policy name, it makes FdPolicy a flag.Value
+func (p *FdPolicy) Set(name string) error {
+	policy, err := ParseFdPolicy(name)
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func (p FdPolicy) valid() bool {
+	_, ok := fdPolicyNames[p]
+	return ok
+}
+
+// FdFailure is a descriptor which failed to flip
+type FdFailure struct {
+	Fd    int    `json:"fd"`
+	Error string `json:"error"`
+}
+
+// savedFd is a copy of an old descriptor kept in process so it can be
+// put back
+type savedFd struct {
+	fd     int
+	copyFd int64
+	fdFlag int64
+}
+
+// fdHold keeps process stopped over the flips of all descriptors of a
+// file with copies of the old ones, see FdAllOrNothing
+type fdHold struct {
+	tracer Tracer
+	// own is false if FlipPlan already holds the process
+	own    bool
+	saved  []savedFd
+	locked bool
+}
+
+// holdFds attaches pid and copies fds, nil if opts doesn't ask to
+// flip them all or nothing, or there is only one
+func holdFds(pid int, fds []int, opts Options) (*fdHold, error) {
+	if opts.FdPolicy != FdAllOrNothing || len(fds) < 2 {
+		return nil, nil
+	}
+	hold := &fdHold{tracer: opts.held}
+	if opts.held == nil || opts.heldPid != pid {
+		// released by settle on the same thread
+		runtime.LockOSThread()
+		tracer := newTracer(pid, opts)
+		if err := tracer.Setup(); err != nil {
+			runtime.UnlockOSThread()
+			return nil, explainAttach(pid, err)
+		}
+		hold.tracer, hold.own = heldTracer{tracer}, true
+	}
+	for _, fd := range fds {
+		if info, err := readFdInfo(pid, fd); err == nil && len(info.Locks) > 0 {
+			hold.locked = true
+		}
+		fdFlag, err := hold.tracer.RemoteSyscall(sysFcntl, uint64(fd), syscall.F_GETFD, 0)
+		if err == nil {
+			var copyFd int64
+			copyFd, err = hold.tracer.RemoteSyscall(sysFcntl, uint64(fd), syscall.F_DUPFD_CLOEXEC, 3)
+			if err == nil {
+				hold.saved = append(hold.saved, savedFd{fd: fd, copyFd: copyFd, fdFlag: fdFlag})
+				continue
+			}
+		}
+		hold.release(nil, opts)
+		return nil, fmt.Errorf("copy fd %d error: %w", fd, err)
+	}
+	return hold, nil
+}
+
+// settle finishes the flip of all descriptors, err is the first
+// failure. On failure the old file is put back on each flipped
+// descriptor and the rename is undone. The process is released
+func (h *fdHold) settle(result *Result, err error, opts Options) error {
+	if err != nil && result.replaced {
+		err = h.restore(result, err, opts)
+	}
+	h.release(result, opts)
+	return err
+}
+
+// restore undoes a flip which failed on some descriptor
+func (h *fdHold) restore(result *Result, err error, opts Options) error {
+	logger := opts.logger()
+	for _, saved := range h.saved {
+		if containsFd(result.Fds, saved.fd) == false {
+			continue
+		}
+		if _, dupErr := h.tracer.RemoteSyscall(syscall.SYS_DUP3,
+			uint64(saved.copyFd), uint64(saved.fd), uint64(dup3Flags(saved.fdFlag))); dupErr != nil {
+			logger.Error("put old file back on fd %d error: %s\n", saved.fd, dupErr)
+			return &Error{Code: env.ExitPartial, Err: fmt.Errorf(
+				"%w, fd %d can't be put back: %s", err, saved.fd, dupErr)}
+		}
+	}
+	if h.locked {
+		logger.Warn("POSIX locks on %s are dropped by putting it back\n", result.Path)
+	}
+	switch {
+	case result.Deleted:
+		discardCreated(result.Path, logger)
+	case opts.Swap:
+		swapBack(result.Path, result.RolledPath, logger)
+	default:
+		discardCreated(result.Path, logger)
+		rollback(result.Path, result.RolledPath, logger)
+	}
+	result.Fds = nil
+	result.replaced = false
+	// nothing is left half done
+	return &Error{Code: env.ExitErr, Err: fmt.Errorf("%w, every descriptor is put back on the old file", err)}
+}
+
+// release closes copies and detaches process if held by us
+func (h *fdHold) release(result *Result, opts Options) {
+	for _, saved := range h.saved {
+		if _, err := h.tracer.RemoteSyscall(syscall.SYS_CLOSE, uint64(saved.copyFd)); err != nil {
+			opts.logger().Error("close fd %d in process error: %s\n", saved.copyFd, err)
+		}
+	}
+	h.saved = nil
+	if h.own == false {
+		return
+	}
+	tracer := h.tracer.(heldTracer).Tracer
+	if err := tracer.Cleanup(); err != nil {
+		opts.logger().Error("detach process error: %s\n", err)
+	}
+	if result != nil {
+		result.Stopped = tracer.StoppedDuration()
+	}
+	runtime.UnlockOSThread()
+}
+
+func containsFd(fds []int, fd int) bool {
+	for _, f := range fds {
+		if f == fd {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package flip
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// twiceOpenedFile is openedFile also opened by a second description,
+// it returns both fds in order
+func twiceOpenedFile(t *testing.T, content string) (string, []int) {
+	path := openedFile(t, "app.log", content)
+	first, err := getOpenedFds(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err != nil || len(first) != 1 {
+		t.Fatalf("fds %v %v, want one opening %s", first, err, path)
+	}
+	second := ownFd(t, path)
+	return path, []int{first[0], second}
+}
+
+// failSecondDup3 fails the dup3 onto the second fd of a flip
+func failSecondDup3() func(int) error {
+	dups := 0
+	return func(nr int) error {
+		if nr == syscall.SYS_DUP3 {
+			if dups++; dups == 2 {
+				return syscall.EBADF
+			}
+		}
+		return nil
+	}
+}
+
+func TestFlipFdBestEffort(t *testing.T) {
+	path, fds := twiceOpenedFile(t, "before\n")
+	fake := &fakeTracer{fail: failSecondDup3()}
+	useFakeTracer(t, fake)
+
+	result, err := Flip(os.Getpid(), path, Options{FdPolicy: FdBestEffort, Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitPartial {
+		t.Fatalf("exit code %d, want %d (%v)", code, env.ExitPartial, err)
+	}
+	if reflect.DeepEqual(result.Fds, fds[:1]) == false {
+		t.Errorf("flipped fds %v, want %v", result.Fds, fds[:1])
+	}
+	if len(result.FailedFds) != 1 || result.FailedFds[0].Fd != fds[1] {
+		t.Errorf("failed fds %+v, want fd %d", result.FailedFds, fds[1])
+	}
+	// what was flipped stays flipped
+	if content, err := os.ReadFile(result.RolledPath); err != nil || string(content) != "before\n" {
+		t.Errorf("old content not kept at %s: %q %v", result.RolledPath, content, err)
+	}
+}
+
+func TestFlipFdAllOrNothing(t *testing.T) {
+	path, fds := twiceOpenedFile(t, "before\n")
+	fake := &fakeTracer{fail: failSecondDup3()}
+	useFakeTracer(t, fake)
+
+	result, err := Flip(os.Getpid(), path, Options{FdPolicy: FdAllOrNothing, Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitErr {
+		t.Fatalf("exit code %d, want %d (%v)", code, env.ExitErr, err)
+	}
+	if len(result.Fds) != 0 {
+		t.Errorf("fds %v left flipped", result.Fds)
+	}
+	// the old file is put back on the first fd from its copy
+	dups := fake.called(syscall.SYS_DUP3)
+	if len(dups) != 3 || dups[2][1] != uint64(fds[0]) {
+		t.Errorf("dup3s %v, want the old file put back on fd %d last", dups, fds[0])
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "before\n" {
+		t.Errorf("original not put back at %s: %q %v", path, content, err)
+	}
+	if _, err := os.Stat(path + rolledSuffix); os.IsNotExist(err) == false {
+		t.Errorf("%s is left behind", path+rolledSuffix)
+	}
+	// held over both fds, attached once
+	if fake.setups != 1 || fake.cleanups != 1 {
+		t.Errorf("attached %d and detached %d times, want once", fake.setups, fake.cleanups)
+	}
+}
+
+func TestParseFdPolicy(t *testing.T) {
+	for policy, name := range fdPolicyNames {
+		if parsed, err := ParseFdPolicy(name); err != nil || parsed != policy {
+			t.Errorf("%q parsed as %s %v, want %s", name, parsed, err, policy)
+		}
+	}
+	if _, err := ParseFdPolicy("some"); err == nil {
+		t.Error("unknown policy parsed")
+	}
+}
@@ -1,20 +1,78 @@
 package flip
 
 import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"os"
+	"runtime"
 	"syscall"
-	"strconv"
+	"time"
 
 	"github.com/pendulm/fileflip/pkg/env"
 	"github.com/pendulm/fileflip/pkg/log"
 	"github.com/pendulm/fileflip/pkg/ptrace"
 )
 
+// FALLOC_FL_KEEP_SIZE from linux/falloc.h
+const fallocKeepSize = 0x01
+
+// setflFlags are status flags F_SETFL is able to change, O_SYNC and
+// O_DSYNC are silently ignored by F_SETFL and only take effect by open
+const setflFlags = syscall.O_APPEND | syscall.O_ASYNC | syscall.O_DIRECT |
+	syscall.O_NOATIME | syscall.O_NONBLOCK
+
+// openFlags are bits of F_GETFL result open takes back, they are the
+// access mode and status flags. O_CLOEXEC is a descriptor flag which
+// F_GETFL never reports, and O_CREAT, O_EXCL, O_TRUNC are forgotten
+// by kernel after open
+const openFlags = syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_NONBLOCK |
+	syscall.O_SYNC | syscall.O_DSYNC | syscall.O_DIRECT | syscall.O_NOATIME | oLargefile
+
+// reopenFlags turns F_GETFL result of the old descriptor into open flags
+// of the new file, which is close-on-exec until dup3 decides
+func reopenFlags(getfl int64) int64 {
+	return getfl&openFlags | syscall.O_CREAT | syscall.O_CLOEXEC
+}
+
+// pathOpenFlags are reopenFlags of an open by path, which never follows
+// a symlink planted at the path while it was renamed, unless
+// FollowSymlinks asks so, and never takes a terminal as controlling one
+func pathOpenFlags(getfl int64, opts Options) int64 {
+	flag := reopenFlags(getfl) | syscall.O_NOCTTY
+	if opts.FollowSymlinks == false {
+		flag |= syscall.O_NOFOLLOW
+	}
+	return flag
+}
+
 var rolledSuffix string
 var pageSize int = os.Getpagesize()
 
+// minScratch is the least scratch space after the path in child
+// buffer, enough for /proc/self/fd/N and a struct flock
+const minScratch = 64
+
+// childBufSize is how many bytes child buffer needs for a path of
+// pathLen bytes with NUL, the scratch after it holds the directory
+// name for O_TMPFILE which is never longer than the path
+func childBufSize(pathLen int) int {
+	scratch := pathLen
+	if scratch < minScratch {
+		scratch = minScratch
+	}
+	return pathLen + scratch
+}
+
+// childMapSize is childBufSize in whole pages of the actual page size,
+// mmap and munmap both take it
+func childMapSize(pathLen int) int {
+	return (childBufSize(pathLen) + pageSize - 1) / pageSize * pageSize
+}
+
 func init() {
 	suffix := os.Getenv("FILEFLIP_SUFFIX")
 	if suffix != "" {
@@ -24,152 +82,897 @@ func init() {
 	}
 }
 
-// RunForFile rollover a file in process
-func RunForFile(pid int, filePath string) {
-	var tmpFd int64
+// Flip rollover a file in process
+func Flip(pid int, filePath string, opts Options) (*Result, error) {
+	return FlipContext(context.Background(), pid, filePath, opts)
+}
 
-	filePath, origFd := preflightCheck(pid, filePath)
+// FlipContext is Flip that stops at the next step once ctx is done,
+// what has been done is rolled back and the process is detached
+func FlipContext(ctx context.Context, pid int, filePath string, opts Options) (*Result, error) {
+	start := time.Now()
 
-	mode := rollover(filePath)
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	procRoot, err := processRoot(pid, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	opts.procRoot = procRoot
+	filePath, fds, deleted, err := waitPreflight(ctx, pid, filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	// every descriptor on the file is flipped through the first one
+	origFd := fds[0]
+	if len(fds) > 1 {
+		opts.sharedFds, opts.extraFds = groupFds(pid, fds, opts.logger())
+	}
+	if opts.Compress.valid() == false {
+		return nil, newError(env.ExitArgs, "unknown codec %s", opts.Compress)
+	}
+	if opts.Offset.valid() == false {
+		return nil, newError(env.ExitArgs, "unknown offset %s", opts.Offset)
+	}
+	if opts.Swap && (opts.Tmpfile || opts.Numbered) {
+		return nil, newError(env.ExitArgs, "swap can't be used with tmpfile or numbered")
+	}
+	if opts.FdPolicy.valid() == false {
+		return nil, newError(env.ExitArgs, "unknown fd policy %s", opts.FdPolicy)
+	}
+	if opts.RenameOnly && (opts.TruncateOnly || opts.Tmpfile || opts.FollowForks || opts.compressed()) {
+		return nil, newError(env.ExitArgs, "rename only can't be used with truncate only, tmpfile, follow forks or compress")
+	}
+	if len(opts.CompressCmd) > 0 && (opts.Compress != CodecNone || opts.CompressExt == "") {
+		return nil, newError(env.ExitArgs, "compress command needs an extension and can't be used with a codec")
+	}
+	// FlipPlan may already hold process
+	planHeld := opts.held != nil
+	// a sandbox refusing our syscalls looks like a real failure
+	sandboxed := opts.RenameOnly == false && seccompMode(pid, opts.logger()) == seccompFilter
+	if sandboxed {
+		opts.logger().Warn("process %d runs under a seccomp filter, injected syscalls may be refused\n", pid)
+	}
+	if opts.NoLock == false && opts.explain == nil {
+		lock, err := acquireLock(ctx, filePath, opts.LockTimeout, opts.logger())
+		if err != nil {
+			return nil, err
+		}
+		defer lock.release()
+	}
+	result := &Result{
+		Pid:  pid,
+		Path: filePath,
+		Fds:  []int{origFd},
+	}
+	// +i and +a are back once done, whatever happens
+	if deleted == false {
+		lifted, origStat, err := liftAttrs(filePath, opts)
+		if err != nil {
+			return nil, err
+		}
+		if lifted != 0 {
+			defer settleAttrs(result, origStat, lifted, opts)
+		}
+	}
 
-	trace := ptrace.NewChild(pid)
-	trace.Setup()
+	if opts.TruncateOnly {
+		err := truncateInPlace(ctx, result, origFd, opts)
+		if err == nil {
+			result.NewBytes = fileSize(filePath, opts.logger())
+		}
+		result.Duration = time.Since(start)
+		return result, err
+	}
 
-	flag, err := trace.RemoteSyscall(
-		syscall.SYS_FCNTL,
+	// children find the old file by inode, it may be copied away
+	var rolledPath string
+	fInfo, err := os.Stat(fmt.Sprintf("%s/%d/fd/%d", procfs, pid, origFd))
+	if err != nil {
+		return nil, newError(env.ExitNotFound, "%s", err)
+	}
+	if deleted {
+		// nothing to rename, the descriptor is the last reference
+		opts.logger().Warn("%s was deleted while opened, old content is gone after flip\n", filePath)
+		result.Deleted = true
+		result.Mode = fInfo.Mode()
+	} else {
+		rolledPath, err = rolledPathFor(filePath, opts)
+		if err != nil {
+			return nil, err
+		}
+		// the first numbered archive is moved up by rollover
+		for _, path := range []string{rolledPath, rolledPath + opts.archiveExt()} {
+			if _, err := os.Stat(path); err == nil && opts.Numbered == false {
+				if opts.SkipExisting {
+					return nil, newError(env.ExitRotated,
+						"file %s already exsits, %s counts as rotated", path, filePath)
+				}
+				return nil, fmt.Errorf("file %s already exsits", path)
+			}
+		}
+		// rename is done while process is stopped, a copy to
+		// another filesystem waits until process runs again
+		result.RolledPath = rolledPath
+		if sameFilesystem(filePath, rolledPath) == false {
+			result.RolledPath = filePath + rolledSuffix
+			opts.logger().Debug("stage old file at %s before copied to %s\n", result.RolledPath, rolledPath)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RenameOnly {
+		switch {
+		case deleted:
+			return nil, newError(env.ExitIgn, "%s was deleted, nothing to rename", filePath)
+		case result.RolledPath != rolledPath:
+			// a copy would miss what process writes after it
+			return nil, newError(env.ExitArgs, "rename only needs %s on the filesystem of %s", rolledPath, filePath)
+		}
+		if err := renameAside(result, opts); err != nil {
+			return nil, err
+		}
+		if planHeld {
+			result.pending = true
+			return result, nil
+		}
+		return result, finishFlip(ctx, result, start, nil, opts)
+	}
+
+	// with FdAllOrNothing process stays stopped until every
+	// descriptor is flipped or put back
+	heldFds := append([]int{origFd}, opts.sharedFds...)
+	for _, group := range opts.extraFds {
+		heldFds = append(heldFds, group...)
+	}
+	hold, err := holdFds(pid, heldFds, opts)
+	if err != nil {
+		return result, err
+	}
+	if hold != nil {
+		opts.held, opts.heldPid = hold.tracer, pid
+	}
+	err = reopen(ctx, result, origFd, opts)
+	if err == nil && opts.explain == nil {
+		inheritGroup(filePath, opts.logger())
+		// mode is given to open, the ACL has to be copied after,
+		// unless another mode is asked
+		if deleted == false && opts.Mode == 0 {
+			copyACL(result.RolledPath, filePath, opts.logger())
+		}
+	}
+	if err == nil {
+		// before a staged file is moved, nothing may still write to it
+		err = reopenExtraFds(ctx, result, opts)
+	}
+	if hold != nil {
+		err = hold.settle(result, err, opts)
+	}
+	if err != nil {
+		result.Duration = time.Since(start)
+		if sandboxed && errors.Is(err, syscall.EPERM) {
+			err = fmt.Errorf("%w (process runs under a seccomp filter which may refuse the syscall)", err)
+		}
+		return result, err
+	}
+	if deleted == false && result.RolledPath != rolledPath && opts.explain != nil {
+		opts.explain.local("copy %q to %q, then remove it", result.RolledPath, rolledPath)
+		result.RolledPath = rolledPath
+	}
+	if deleted == false && result.RolledPath != rolledPath {
+		if err := moveFile(result.RolledPath, rolledPath, opts.logger()); err != nil {
+			result.Duration = time.Since(start)
+			return result, newError(env.ExitPartial, "move %s to %s error: %s", result.RolledPath, rolledPath, err)
+		}
+		result.RolledPath = rolledPath
+	}
+
+	// process is detached, the live file only holds what it wrote since
+	result.NewBytes = fileSize(filePath, opts.logger())
+	if deleted == false {
+		result.BytesRolled = fileSize(result.RolledPath, opts.logger())
+	}
+	if opts.FollowForks && opts.explain == nil {
+		err = flipChildren(ctx, result, fInfo.Sys().(*syscall.Stat_t), opts)
+	}
+	result.Duration = time.Since(start)
+	// a held process is still stopped, FlipPlan finishes after detach
+	if planHeld {
+		result.pending = true
+		return result, err
+	}
+	return result, finishFlip(ctx, result, start, err, opts)
+}
+
+// finishFlip does what needs no process once it is detached, a failed
+// or rolled back flip never gets here. With Verify the descriptors are
+// checked again, then the rolled file is compressed and with Fsync
+// synced, numbered archives are pruned and, if err of the flip is nil,
+// the post command runs.
+// Duration is counted from start until then
+func finishFlip(ctx context.Context, result *Result, start time.Time, err error, opts Options) error {
+	if opts.Verify && opts.explain == nil && len(result.Fds) > 0 {
+		if verifyErr := verifyDetached(result, opts); verifyErr != nil {
+			result.Duration = time.Since(start)
+			return verifyErr
+		}
+	}
+	// nobody writes the rolled file any more
+	if result.Deleted == false && opts.Compress != CodecNone {
+		compressedPath, size, compressErr := compressFile(result.RolledPath, opts.Compress, opts.logger())
+		if compressErr != nil {
+			result.Duration = time.Since(start)
+			return &Error{Code: env.ExitPartial, Err: compressErr}
+		}
+		result.RolledPath = compressedPath
+		result.CompressedBytes = size
+	}
+	if result.Deleted == false && len(opts.CompressCmd) > 0 {
+		compressedPath, size, compressErr := compressWithCmd(ctx, result.RolledPath, opts)
+		if compressErr != nil {
+			result.Duration = time.Since(start)
+			return &Error{Code: env.ExitPartial, Err: compressErr}
+		}
+		result.RolledPath = compressedPath
+		result.CompressedBytes = size
+	}
+	if opts.Fsync && opts.explain == nil {
+		if syncErr := syncArchive(result, opts); syncErr != nil {
+			result.Duration = time.Since(start)
+			return syncErr
+		}
+	}
+	if result.Deleted == false && opts.Numbered && opts.Keep > 0 {
+		pruneNumbered(result.Path, opts.Keep, opts.CompressExt, opts.logger())
+	}
+	result.Duration = time.Since(start)
+	if err == nil && len(opts.PostCmd) > 0 {
+		err = runPostCmd(ctx, result, opts)
+	}
+	return err
+}
+
+// reopenOnlyOptions turns opts into the ones reopening a file which
+// is already in place
+func reopenOnlyOptions(opts Options) Options {
+	opts.Tmpfile = false
+	opts.Prealloc = 0
+	opts.extraFds = nil
+	opts.sharedFds = nil
+	opts.reopenOnly = true
+	return opts
+}
+
+// reopenExtraFds puts the new file on opts.extraFds of result.Pid,
+// after the first descriptor was flipped. Each group is an open file
+// description of its own, it is opened again with its flags and the
+// rest of the group dup'ed from it. A failed one doesn't stop the
+// others unless FdAllOrNothing puts them all back anyway
+func reopenExtraFds(ctx context.Context, result *Result, opts Options) error {
+	extraOpts := reopenOnlyOptions(opts)
+	var firstErr error
+	for _, group := range opts.extraFds {
+		fd := group[0]
+		extraOpts.sharedFds = group[1:]
+		extra := &Result{
+			Pid:        result.Pid,
+			Path:       result.Path,
+			RolledPath: result.RolledPath,
+			Fds:        []int{fd},
+			Mode:       result.Mode,
+		}
+		err := reopen(ctx, extra, fd, extraOpts)
+		result.Stopped += extra.Stopped
+		if err != nil {
+			err = newError(env.ExitPartial, "reopen fd %d error: %s", fd, err)
+			for _, fd := range group {
+				result.FailedFds = append(result.FailedFds, FdFailure{Fd: fd, Error: err.Error()})
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if opts.FdPolicy == FdAllOrNothing || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		result.Fds = append(result.Fds, extra.Fds...)
+		result.FailedFds = append(result.FailedFds, extra.FailedFds...)
+	}
+	return firstErr
+}
+
+// flipChildren reopens the file in descendants of result.Pid which
+// still hold the old inode, one by one after the parent was flipped
+func flipChildren(ctx context.Context, result *Result, oldStat *syscall.Stat_t, opts Options) error {
+	// file is already in place, children only reopen it
+	childOpts := reopenOnlyOptions(opts)
+
+	failed := 0
+	for _, pid := range descendants(result.Pid, opts.logger()) {
+		fds, err := findFds(pid, func(fdPath string) bool {
+			return sameInode(fdPath, oldStat, opts.logger())
+		}, opts.logger())
+		if err == nil {
+			fds, _ = ioFds(pid, fds, opts.logger())
+		}
+		if err != nil || len(fds) == 0 {
+			// exited or not holding the file
+			continue
+		}
+		child := &Result{
+			Pid:        pid,
+			Path:       result.Path,
+			RolledPath: result.RolledPath,
+			Fds:        fds[:1],
+			Mode:       result.Mode,
+		}
+		start := time.Now()
+		err = reopen(ctx, child, fds[0], childOpts)
+		child.Duration = time.Since(start)
+		if errors.Is(err, ptrace.ErrProcessGone) {
+			opts.logger().Debug("child %d quit before flipped\n", pid)
+			continue
+		}
+		if err != nil {
+			opts.logger().Error("flip child %d error: %s\n", pid, err)
+			failed++
+			continue
+		}
+		result.Children = append(result.Children, child)
+	}
+	if failed > 0 {
+		return newError(env.ExitPartial, "%d child processes failed to flip", failed)
+	}
+	return nil
+}
+
+// reopen makes process open result.Path again and put it on origFd
+func reopen(ctx context.Context, result *Result, origFd int, opts Options) (err error) {
+	filePath, rolledPath, mode := result.Path, result.RolledPath, result.Mode
+	// nothing is renamed until we get hold of process, reopening in a
+	// child never touches the files, and a deleted file has no archive
+	rollover, undoRename := rollover, rollback
+	if opts.Swap && opts.reopenOnly == false {
+		rollover, undoRename = swapOver, swapBack
+	}
+	if opts.Numbered && opts.reopenOnly == false {
+		shift := &cascade{ext: opts.CompressExt}
+		rollover, undoRename = shift.rollover, shift.rollback
+	}
+	if opts.explain != nil {
+		rollover, undoRename = opts.explain.rollover, opts.explain.rollback
+	}
+	rollback := func(string, string, log.Logger) {}
+	discardCreated := discardCreated
+	if opts.reopenOnly {
+		discardCreated = func(string, log.Logger) {}
+	}
+	if opts.NoRollback {
+		undoRename = keepRenamed
+		discardCreated = keepCreated
+	}
+	var tmpFd int64 = -1
+	var flag, fdFlag, childAddr int64
+	var dupFlag int
+	var sharedFdFlags []int64
+	var sharedErr error
+	var flipped, unnamed, onStack, mapped bool
+	var locks []FdLock
+	var pos int64
+	// child buffer holds filePath, the rest is scratch for O_TMPFILE
+	// and locks. It is mapped, at least one page, or below the stack
+	// pointer with StackScratch
+	var bufAddr uintptr
+	var bufSize, mapSize int
+
+	// all ptrace requests must come from the attaching thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	raw := opts.tracerFor(result.Pid)
+	trace, cancel := newInterruptible(ctx, raw, opts)
+	defer cancel()
+	if err = trace.Setup(); err != nil {
+		return explainAttach(result.Pid, err)
+	}
+	// tracee must never be left stopped, whatever happens below
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during flip: %v", r)
+			if flipped == false {
+				if tmpFd >= 0 {
+					if _, closeErr := exitSyscall(raw, syscall.SYS_CLOSE, uint64(tmpFd)); closeErr != nil {
+						opts.logger().Error("close fd %d in process error: %s\n", tmpFd, closeErr)
+					}
+					discardCreated(filePath, opts.logger())
+				}
+				rollback(filePath, rolledPath, opts.logger())
+			}
+		}
+		// the stack is left as it is, process reuses it anyway, and
+		// the map of a process gone is gone with it
+		if mapped && errors.Is(err, ptrace.ErrProcessGone) == false {
+			// raw tracer unmaps even if interrupted
+			if _, unmapErr := exitSyscall(raw, syscall.SYS_MUNMAP, uint64(childAddr), uint64(mapSize), 0, 0, 0, 0); unmapErr != nil {
+				opts.logger().Error("munmap error: %s\n", unmapErr)
+			}
+		}
+		if cleanErr := raw.Cleanup(); cleanErr != nil && err == nil {
+			err = &Error{Code: env.ExitPartial, Err: cleanErr}
+		}
+		result.Stopped = raw.StoppedDuration()
+	}()
+
+	// process is stopped, locks held through origFd can't change
+	if info, infoErr := readFdInfo(result.Pid, origFd); infoErr != nil {
+		opts.logger().Warn("can't check locks on fd %d: %s\n", origFd, infoErr)
+	} else {
+		locks = info.Locks
+		pos = info.Pos
+	}
+
+	flag, err = trace.RemoteSyscall(
+		sysFcntl,
 		uint64(origFd),
 		syscall.F_GETFL, 0)
 	if err != nil {
-		rollback(filePath)
-		log.Die("fcntl F_GETFL error: %s\n", err)
+		return fmt.Errorf("fcntl F_GETFL error: %w", err)
 	}
-
-	childAddr, err := trace.RemoteSyscall(
-		syscall.SYS_MMAP,
-		0,
-		uint64(pageSize),
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_ANONYMOUS|syscall.MAP_PRIVATE,
-		0,
-		0)
+	if opts.Offset == OffsetAppend {
+		flag |= syscall.O_APPEND
+	}
+	// dup3 gives close-on-exec of the old descriptor to the new one
+	fdFlag, err = trace.RemoteSyscall(
+		sysFcntl,
+		uint64(origFd),
+		syscall.F_GETFD, 0)
 	if err != nil {
-		rollback(filePath)
-		log.Die("mmap error: %s\n", err)
+		return fmt.Errorf("fcntl F_GETFD error: %w", err)
+	}
+	for _, fd := range opts.sharedFds {
+		sharedFdFlag, err := trace.RemoteSyscall(
+			sysFcntl,
+			uint64(fd),
+			syscall.F_GETFD, 0)
+		if err != nil {
+			return fmt.Errorf("fcntl F_GETFD of fd %d error: %w", fd, err)
+		}
+		sharedFdFlags = append(sharedFdFlags, sharedFdFlag)
+	}
+
+	if opts.reopenOnly == false && result.Deleted == false {
+		result.Mode, err = rollover(filePath, rolledPath, opts.logger())
+		if err != nil {
+			return err
+		}
+		rollback = undoRename
+	}
+	if opts.Mode != 0 {
+		result.Mode = opts.Mode
 	}
+	mode = result.Mode
 
-	filePathBytes := []byte(filePath)
+	// process may see the file under another root
+	filePathBytes := []byte(opts.procPath(filePath))
 	filePathBytes = append(filePathBytes, 0)
+	mapSize = childMapSize(len(filePathBytes))
+	if opts.StackScratch {
+		// saves the mmap and munmap
+		if addr, ok := stackScratch(trace, result.Pid, childBufSize(len(filePathBytes)), opts.logger()); ok {
+			childAddr, mapSize, onStack = int64(addr), childBufSize(len(filePathBytes)), true
+		} else {
+			opts.logger().Debug("no room on stack of process, map a page instead\n")
+		}
+	}
 
-	if err := trace.RemoteMemcp(
+	if onStack == false {
+		childAddr, err = trace.RemoteSyscall(
+			sysMmap,
+			0,
+			uint64(mapSize),
+			syscall.PROT_READ|syscall.PROT_WRITE,
+			syscall.MAP_ANONYMOUS|syscall.MAP_PRIVATE,
+			0,
+			0)
+		if err != nil {
+			rollback(filePath, rolledPath, opts.logger())
+			return fmt.Errorf("mmap error: %w", err)
+		}
+		mapped = true
+	}
+
+	err = trace.RemoteMemcp(
 		filePathBytes,
 		uintptr(childAddr),
-		len(filePath)+1); err != nil {
-		rollback(filePath)
+		len(filePathBytes))
+	if err != nil {
+		rollback(filePath, rolledPath, opts.logger())
+		err = fmt.Errorf("memcp error: %w", err)
 		goto sweepUp
 	}
+	// a bad copy would make open act on a garbage path, reading
+	// it back costs a syscall per word, so only when debugging
+	if log.IsDebug() {
+		err = verifyRemote(trace, filePathBytes, uintptr(childAddr), opts.logger())
+		if err != nil {
+			rollback(filePath, rolledPath, opts.logger())
+			goto sweepUp
+		}
+	}
+
+	bufAddr = uintptr(childAddr) + uintptr(len(filePathBytes))
+	bufSize = mapSize - len(filePathBytes)
 
-	tmpFd, err = trace.RemoteSyscall(
-		syscall.SYS_OPEN,
-		uint64(childAddr),
-		uint64(flag|syscall.O_CREAT),
-		uint64(mode))
+	if opts.Tmpfile {
+		// file gets its name only when it's ready to be dup3'ed
+		tmpFd, err = openTmpfile(trace, bufAddr, bufSize, opts.procPath(filePath), reopenFlags(flag), mode)
+		if err == errNoTmpfile {
+			opts.logger().Warn("O_TMPFILE not supported, create %s directly\n", filePath)
+			err = nil
+		} else if err != nil {
+			rollback(filePath, rolledPath, opts.logger())
+			goto sweepUp
+		} else {
+			unnamed = true
+		}
+	}
+
+	if unnamed == false {
+		tmpFd, err = trace.RemoteSyscall(
+			syscall.SYS_OPEN,
+			uint64(childAddr),
+			uint64(pathOpenFlags(flag, opts)),
+			uint64(mode))
+		if errors.Is(err, syscall.ELOOP) {
+			rollback(filePath, rolledPath, opts.logger())
+			err = &Error{Code: env.ExitRefused, Err: fmt.Errorf(
+				"open error: %w, %s became a symlink during flip, refuse to follow it (use --follow-symlinks if it is intended)",
+				err, filePath)}
+			goto sweepUp
+		}
+		if err != nil {
+			rollback(filePath, rolledPath, opts.logger())
+			err = fmt.Errorf("open error: %w", err)
+			goto sweepUp
+		}
+	}
+
+	if (opts.ExactMode || opts.Mode != 0) && opts.reopenOnly == false {
+		// mode given to open is masked by umask of process
+		_, err = trace.RemoteSyscall(
+			syscall.SYS_FCHMOD,
+			uint64(tmpFd),
+			uint64(mode.Perm()))
+		if err != nil {
+			err = fmt.Errorf("fchmod error: %w", err)
+			goto sweepUp
+		}
+	}
+
+	if opts.Prealloc > 0 {
+		// keep size so appending writer starts at offset 0
+		_, err = trace.RemoteSyscall(
+			syscall.SYS_FALLOCATE,
+			fallocateArgs(tmpFd, fallocKeepSize, opts.Prealloc)...)
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			opts.logger().Warn("fallocate not supported by filesystem, continue without preallocation\n")
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("fallocate error: %w", err)
+			goto sweepUp
+		}
+	}
+
+	err = placeOffset(trace, tmpFd, opts.Offset, pos, flag, opts.logger())
+	if err != nil {
+		goto sweepUp
+	}
+
+	// open ignores O_ASYNC, set status flags again to make
+	// the new description behave the same
+	_, err = trace.RemoteSyscall(
+		sysFcntl,
+		uint64(tmpFd),
+		syscall.F_SETFL,
+		uint64(flag&setflFlags))
 	if err != nil {
-		rollback(filePath)
-		log.Error("open error: %s\n", err)
+		err = fmt.Errorf("fcntl F_SETFL error: %w", err)
 		goto sweepUp
 	}
 
-	_, err = trace.RemoteSyscall(syscall.SYS_DUP2, uint64(tmpFd), uint64(origFd))
+	if unnamed {
+		err = linkTmpfile(trace, bufAddr, bufSize, uintptr(childAddr), tmpFd)
+		if err != nil {
+			goto sweepUp
+		}
+	}
+
+	dupFlag = dup3Flags(fdFlag)
+	_, err = trace.RemoteSyscall(syscall.SYS_DUP3, uint64(tmpFd), uint64(origFd), uint64(dupFlag))
 	if err != nil {
-		log.Error("dup2 error: %s\n", err)
+		err = fmt.Errorf("dup3 error: %w", err)
 		goto sweepUp
 	}
+	flipped = true
+	result.replaced = true
+	// descriptors dup'ed from origFd keep sharing offset with it
+	for i, fd := range opts.sharedFds {
+		dupFlag = dup3Flags(sharedFdFlags[i])
+		_, err = trace.RemoteSyscall(syscall.SYS_DUP3, uint64(tmpFd), uint64(fd), uint64(dupFlag))
+		if errors.Is(err, ptrace.ErrProcessGone) {
+			goto sweepUp
+		}
+		if err != nil {
+			opts.logger().Error("dup3 to fd %d error: %s\n", fd, err)
+			sharedErr = fmt.Errorf("fd %d is not flipped: dup3 error: %w", fd, err)
+			result.FailedFds = append(result.FailedFds, FdFailure{Fd: fd, Error: sharedErr.Error()})
+			err = nil
+			// the rest would be put back anyway
+			if opts.FdPolicy == FdAllOrNothing {
+				break
+			}
+			continue
+		}
+		result.Fds = append(result.Fds, fd)
+	}
+
 	_, err = trace.RemoteSyscall(syscall.SYS_CLOSE, uint64(tmpFd))
 	if err != nil {
-		log.Error("close error: %s\n", err)
+		// descriptor is already replaced
+		err = &Error{Code: env.ExitPartial, Err: fmt.Errorf("close error: %w", err)}
 		goto sweepUp
 	}
 
+	// closing any descriptor of the file drops POSIX locks on it,
+	// so locks are taken again only after tmpFd is closed
+	if len(locks) > 0 {
+		err = restoreLocks(trace, bufAddr, bufSize, int64(origFd), locks, opts.logger())
+		if err != nil {
+			err = &Error{Code: env.ExitPartial, Err: err}
+			goto sweepUp
+		}
+	}
+	if sharedErr != nil {
+		err = &Error{Code: env.ExitPartial, Err: sharedErr}
+	}
+
 sweepUp:
-	_, err = trace.RemoteSyscall(
-		syscall.SYS_MUNMAP,
-		uint64(childAddr),
-		uint64(pageSize),
-		0, 0, 0, 0)
+	if errors.Is(err, ptrace.ErrProcessGone) {
+		// nobody holds the old file any more, put it back
+		if tmpFd >= 0 {
+			discardCreated(filePath, opts.logger())
+		}
+		rollback(filePath, rolledPath, opts.logger())
+		return err
+	}
+	// tmpFd never took over origFd, e.g. dup3 failed, left open it
+	// leaks in process and the file created by it blocks rollback
+	if err != nil && flipped == false && tmpFd >= 0 {
+		if _, closeErr := raw.RemoteSyscall(syscall.SYS_CLOSE, uint64(tmpFd)); closeErr != nil {
+			opts.logger().Error("close fd %d in process error: %s\n", tmpFd, closeErr)
+		}
+		discardCreated(filePath, opts.logger())
+		rollback(filePath, rolledPath, opts.logger())
+	}
+	return err
+}
+
+// exitSyscall injects a syscall on the way out of a flip, a panic of
+// trace becomes an error so the rest of the cleanup and the detach
+// still run
+func exitSyscall(trace Tracer, nr int, args ...uint64) (ret int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return trace.RemoteSyscall(nr, args...)
+}
+
+// verifyRemote reads back src copied to addr of child
+func verifyRemote(trace Tracer, src []byte, addr uintptr, logger log.Logger) error {
+	got, err := trace.RemotePeek(addr, len(src))
 	if err != nil {
-		log.Error("munmap error: %s\n", err)
+		return fmt.Errorf("read back child memory error: %w", err)
+	}
+	if bytes.Equal(got, src) == false {
+		return fmt.Errorf("child memory at %#x is %q after copying %q", addr, got, src)
 	}
-	trace.Cleanup()
+	logger.Debug("verified %d bytes copied to %#x\n", len(src), addr)
+	return nil
 }
 
-func getOpenedFds(pid int, filePath string) []int {
-	procPath := fmt.Sprintf("/proc/%d/fd", pid)
-	matchedFds := []int{}
+// dup3Flags gives close-on-exec of a descriptor to the one
+// replacing it
+func dup3Flags(fdFlag int64) int {
+	if fdFlag&syscall.FD_CLOEXEC != 0 {
+		return syscall.O_CLOEXEC
+	}
+	return 0
+}
 
-	dirFile, err := os.Open(procPath)
+// keepRenamed replaces rollback with NoRollback, so the failed state
+// stays for inspection
+func keepRenamed(filePath string, rolledPath string, logger log.Logger) {
+	logger.Warn("NO ROLLBACK: %s stays renamed to %s, process may still write to it\n", filePath, rolledPath)
+}
+
+// keepCreated replaces discardCreated with NoRollback
+func keepCreated(filePath string, logger log.Logger) {
+	logger.Warn("NO ROLLBACK: %s created by process is kept\n", filePath)
+}
+
+// discardCreated removes the file created by our open if it's still empty,
+// otherwise rollback refuses to overwrite it
+func discardCreated(filePath string, logger log.Logger) {
+	fInfo, err := os.Stat(filePath)
 	if err != nil {
-		log.Die("%s\n", err)
+		return
+	}
+	if fInfo.Size() != 0 {
+		logger.Warn("file %s is not empty, keep it\n", filePath)
+		return
+	}
+	if err := os.Remove(filePath); err != nil {
+		logger.Error("%s\n", err)
+	}
+}
+
+// truncateInPlace empty the file through the opened fd, process keeps
+// writing to the same inode and old content is dropped
+func truncateInPlace(ctx context.Context, result *Result, origFd int, opts Options) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	trace, cancel := newInterruptible(ctx, opts.tracerFor(result.Pid), opts)
+	defer cancel()
+	if err := trace.Setup(); err != nil {
+		return explainAttach(result.Pid, err)
 	}
+	defer func() {
+		trace.Cleanup()
+		result.Stopped = trace.StoppedDuration()
+	}()
 
-	names, err := dirFile.Readdirnames(0)
+	flag, err := trace.RemoteSyscall(
+		sysFcntl,
+		uint64(origFd),
+		syscall.F_GETFL, 0)
 	if err != nil {
-		log.Die("%s\n", err)
+		return fmt.Errorf("fcntl F_GETFL error: %w", err)
 	}
 
-	for _, name := range names {
-		fdPath := fmt.Sprintf("/proc/%d/fd/%s", pid, name)
-		openFilePath, err := os.Readlink(fdPath)
+	// writer without O_APPEND would leave a hole before its next write
+	if flag&syscall.O_APPEND == 0 {
+		_, err = trace.RemoteSyscall(
+			syscall.SYS_LSEEK,
+			uint64(origFd),
+			0,
+			uint64(os.SEEK_SET))
 		if err != nil {
-			log.Die("%s\n", err)
+			return fmt.Errorf("lseek error: %w", err)
 		}
+	}
+
+	_, err = trace.RemoteSyscall(syscall.SYS_FTRUNCATE, uint64(origFd), 0)
+	if err != nil {
+		return fmt.Errorf("ftruncate error: %w", err)
+	}
+	return nil
+}
 
-		if openFilePath == filePath {
-			fd, err := strconv.Atoi(name)
-			if err != nil {
-				log.Error("can't get fd number from %s\n", fdPath)
-				continue
+// rolledPathFor decide where the original file goes, it is called
+// once per flip and the result is used until rollback
+func rolledPathFor(filePath string, opts Options) (string, error) {
+	if opts.Numbered {
+		if opts.Dest != "" || opts.NameFunc != nil {
+			return "", newError(env.ExitArgs, "numbered archives can't be named otherwise")
+		}
+		return numberedPath(filePath, 1, ""), nil
+	}
+	dest := opts.Dest
+	if dest == "" && opts.NameFunc != nil {
+		var err error
+		dest, err = opts.NameFunc(filePath)
+		if err != nil {
+			return "", fmt.Errorf("name rolled file of %s error: %w", filePath, err)
+		}
+	}
+	if dest != "" {
+		rolledPath, err := localPath(dest, opts.procRoot)
+		if err != nil {
+			return "", err
+		}
+		if opts.Mkdir {
+			if err := makeDestDir(filePath, filepath.Dir(rolledPath), opts); err != nil {
+				return "", err
 			}
-			matchedFds = append(matchedFds, fd)
 		}
+		// Explain makes no directory, the rename would go into one made
+		if opts.Mkdir && opts.explain != nil {
+			return rolledPath, nil
+		}
+		if err := checkDest(filePath, rolledPath, opts.logger()); err != nil {
+			return "", err
+		}
+		return rolledPath, nil
 	}
-	dirFile.Close()
-	return matchedFds
+	return fmt.Sprintf("%s%s", filePath, rolledSuffix), nil
 }
 
-func rollover(filePath string) os.FileMode {
-	var fInfo os.FileInfo
+// checkDest make sure rename to rolledPath can succeed, that is
+// its directory exists, a different filesystem means copying
+func checkDest(filePath string, rolledPath string, logger log.Logger) error {
+	destDir := filepath.Dir(rolledPath)
+	dInfo, err := os.Stat(destDir)
+	if err != nil {
+		return newError(env.ExitArgs, "%s", err)
+	}
+	if dInfo.IsDir() == false {
+		return newError(env.ExitArgs, "%s is not a directory", destDir)
+	}
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return newError(env.ExitNotFound, "%s", err)
+	}
+	if dInfo.Sys().(*syscall.Stat_t).Dev != fInfo.Sys().(*syscall.Stat_t).Dev {
+		logger.Debug("%s is not on the same filesystem with %s, content will be copied\n", destDir, filePath)
+	}
+	return nil
+}
+
+// sameFilesystem tells if filePath can be renamed to rolledPath
+// without copying, a missing directory would be on the filesystem of
+// its nearest parent
+func sameFilesystem(filePath string, rolledPath string) bool {
+	dInfo, err := os.Stat(existingDir(rolledPath))
+	if err != nil {
+		return false
+	}
 	fInfo, err := os.Stat(filePath)
 	if err != nil {
-		log.Die("%s\n", err)
+		return false
 	}
+	return dInfo.Sys().(*syscall.Stat_t).Dev == fInfo.Sys().(*syscall.Stat_t).Dev
+}
 
-	rolledPath := fmt.Sprintf("%s%s", filePath, rolledSuffix)
-	if _, err := os.Stat(rolledPath); err == nil {
-		log.Die("file %s already exsits\n", rolledPath)
+func rollover(filePath string, rolledPath string, logger log.Logger) (os.FileMode, error) {
+	var fInfo os.FileInfo
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0, newError(env.ExitNotFound, "%s", err)
 	}
 
-	if err := os.Rename(filePath, rolledPath); err != nil {
-		log.Die("%s\n", err)
+	// another flip may take rolledPath after it was checked, moveFile
+	// never replaces it
+	if err := moveFile(filePath, rolledPath, logger); err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return 0, fmt.Errorf("file %s already exsits", rolledPath)
+		}
+		return 0, err
 	}
-	return fInfo.Mode()
+	return fInfo.Mode(), nil
 }
 
-func rollback(filePath string) {
-	rolledPath := fmt.Sprintf("%s%s", filePath, rolledSuffix)
+func rollback(filePath string, rolledPath string, logger log.Logger) {
 	if _, err := os.Stat(rolledPath); err != nil {
-		log.Error("file %s not exsits\n", rolledPath)
+		logger.Error("file %s not exsits\n", rolledPath)
 		return
 	}
 	if _, err := os.Stat(filePath); err == nil {
-		log.Error("file %s already exsits\n", filePath)
+		logger.Error("file %s already exsits\n", filePath)
 		return
 	}
-	if err := os.Rename(filePath, rolledPath); err != nil {
-		log.Error("%s\n", err)
+	if err := moveFile(rolledPath, filePath, logger); err != nil {
+		logger.Error("%s\n", err)
 	}
 }
 
-func detectAmd64Linux() bool {
+func detectSupportedLinux() bool {
 	arch := []byte{}
 	sys := []byte{}
 
@@ -188,36 +991,267 @@ func detectAmd64Linux() bool {
 		sys = append(sys, byte(c))
 	}
 
-	if string(arch) == "x86_64" && string(sys) == "Linux" {
-		return true
+	if string(sys) != "Linux" {
+		return false
+	}
+	for _, machine := range supportedMachines {
+		if string(arch) == machine {
+			return true
+		}
 	}
 	return false
 }
 
-func preflightCheck(pid int, filePath string) (string, int) {
-	if detectAmd64Linux() == false {
-		log.DieWithCode(env.ExitArgs, "%s only works in amd64 Linux\n", os.Args[0])
+// detectTraceeClass checks the word size of target process matches ours,
+// registers and syscall numbers differ between 32-bit and 64-bit tracee
+func detectTraceeClass(pid int, logger log.Logger) bool {
+	exePath := fmt.Sprintf("%s/%d/exe", procfs, pid)
+	f, err := elf.Open(exePath)
+	if err != nil {
+		logger.Debug("can't read elf header of %s: %s\n", exePath, err)
+		// let the later steps report a more precise error
+		return true
+	}
+	defer f.Close()
+	return f.Class == traceeClass
+}
+
+// preflightCheck finds the descriptors of pid opening filePath, the
+// first is the one flipped through, or only opts.Fd if given
+func preflightCheck(pid int, filePath string, opts Options) (string, []int, bool, error) {
+	if detectSupportedLinux() == false {
+		return "", nil, false, newError(env.ExitArgs, "%s only works in amd64 or 386 Linux", os.Args[0])
 	}
-	absPath, err := filepath.Abs(filePath)
+	absPath, err := localPath(filePath, opts.procRoot)
 	if err != nil {
-		log.DieWithCode(env.ExitArgs, "%s\n", err)
+		return "", nil, false, err
 	}
-	if _, err := os.Stat(absPath); err != nil {
-		log.DieWithCode(env.ExitArgs, "%s\n", err)
+	// a missing file may still be opened by process after unlinked
+	deleted := false
+	fInfo, statErr := os.Stat(absPath)
+	if os.IsNotExist(statErr) {
+		deleted = true
+	} else if statErr != nil {
+		return "", nil, false, newError(env.ExitNotFound, "%s", statErr)
+	}
+	// a directory held for openat can't be reopened for writing
+	if deleted == false && fInfo.IsDir() {
+		return "", nil, false, newError(env.ExitIsDir, "target %s is a directory, not a file", absPath)
+	}
+	// other links keep pointing at the old inode after rename,
+	// archived content stays reachable and shared through them
+	if deleted == false {
+		if nlink := fInfo.Sys().(*syscall.Stat_t).Nlink; nlink > 1 {
+			if opts.AllowLinks == false {
+				if err := opts.refuse(newError(env.ExitRefused,
+					"file %s has %d hard links, other links will keep the old content (use --allow-links to flip anyway)",
+					absPath, nlink)); err != nil {
+					return "", nil, false, err
+				}
+			} else {
+				opts.logger().Warn("file %s has %d hard links, other links keep the old content\n", absPath, nlink)
+			}
+		}
 	}
 	if pid <= 1 {
-		log.DieWithCode(env.ExitArgs, "error pid %d\n", pid)
+		return "", nil, false, newError(env.ExitArgs, "error pid %d", pid)
+	}
+	if detectTraceeClass(pid, opts.logger()) == false {
+		return "", nil, false, newError(env.ExitArgs, "process %d is not a %s process", pid, traceeClass)
+	}
+	if err := checkIdentity(pid, opts.ExpectComm, opts.ExpectExe); err != nil {
+		return "", nil, false, err
 	}
-	if len(absPath) >= pageSize {
-		log.DieWithCode(env.ExitArgs, "file name too long: %s\n", absPath)
+	// a job control stop is kept over the flip, but a process held by
+	// a debugger can't be attached again, unless it is FlipPlan holding
+	// the process over several flips
+	held := opts.held != nil && opts.heldPid == pid
+	if tracer, err := statusField(pid, "TracerPid"); err == nil && tracer != "0" && held == false {
+		return "", nil, false, newError(env.ExitRefused,
+			"process %d is traced by process %s, e.g. a debugger, detach it first", pid, tracer)
+	}
+	if cgroup, frozen := frozenCgroup(pid, opts.logger()); frozen {
+		if err := opts.refuse(newError(env.ExitRefused,
+			"process %d is in frozen cgroup %s, attach would hang until it is thawed", pid, cgroup)); err != nil {
+			return "", nil, false, err
+		}
+	}
+	// PATH_MAX counts the terminating NUL
+	if len(opts.procPath(absPath)) >= syscall.PathMax {
+		return "", nil, false, newError(env.ExitArgs, "file name too long: %s", absPath)
+	}
+
+	if opts.Fd > 0 {
+		// trust the given fd, only check process really has it
+		fdPath := fmt.Sprintf("%s/%d/fd/%d", procfs, pid, opts.Fd)
+		if _, err := os.Lstat(fdPath); err != nil {
+			if os.IsPermission(err) {
+				return "", nil, false, newError(env.ExitPerm, "%s", err)
+			}
+			return "", nil, false, newError(env.ExitNotFound, "fd %d not opened in process %d", opts.Fd, pid)
+		}
+		if deleted && isDeletedLink(fdPath, opts.procPath(absPath), opts.logger()) == false {
+			return "", nil, false, newError(env.ExitNotFound, "%s", statErr)
+		}
+		if _, pathFds := ioFds(pid, []int{opts.Fd}, opts.logger()); len(pathFds) > 0 {
+			return "", nil, false, newError(env.ExitRefused, "fd %d of process %d is O_PATH, nothing is written through it", opts.Fd, pid)
+		}
+		if err := checkOpenedFile(pid, opts.Fd, absPath, opts); err != nil {
+			return "", nil, false, err
+		}
+		return absPath, []int{opts.Fd}, deleted, nil
 	}
 
-	fds := getOpenedFds(pid, filePath)
+	var fds []int
+	if deleted {
+		fds, err = getDeletedFds(pid, absPath, opts)
+	} else {
+		fds, err = getOpenedFds(pid, absPath, opts)
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	fds, pathFds := ioFds(pid, fds, opts.logger())
+	if len(fds) == 0 && len(pathFds) > 0 {
+		return "", nil, false, newError(env.ExitNotOpen,
+			"file %s is only held by O_PATH fd %v in process %d, no writable descriptor found", absPath, pathFds, pid)
+	}
 	if len(fds) == 0 {
-		log.DieWithCode(env.ExitArgs, "can't find file %s opened in process\n", absPath)
+		if deleted {
+			return "", nil, false, newError(env.ExitNotFound,
+				"file %s does not exist, and process %d holds no deleted file of that name", absPath, pid)
+		}
+		if opts.Lenient {
+			return "", nil, false, newError(env.ExitIgn, "file %s not opened in process, nothing to do", absPath)
+		}
+		return "", nil, false, newError(env.ExitNotOpen, "file %s exists but process %d does not have it open", absPath, pid)
 	}
 
-	// we only handle the first match
-	fd := fds[0]
-	return absPath, fd
+	// the others open the same file
+	if err := checkOpenedFile(pid, fds[0], absPath, opts); err != nil {
+		return "", nil, false, err
+	}
+	return absPath, fds, deleted, nil
+}
+
+// fileSize is the size of path, zero if it can't be stat'ed
+func fileSize(path string, logger log.Logger) int64 {
+	fInfo, err := os.Stat(path)
+	if err != nil {
+		logger.Debug("%s\n", err)
+		return 0
+	}
+	return fInfo.Size()
+}
+
+// waitPoll bounds the backoff between checks of waitPreflight
+const (
+	minWaitPoll = 50 * time.Millisecond
+	maxWaitPoll = time.Second
+)
+
+// waitPreflight runs preflightCheck until the file exists and is
+// opened by process, for up to opts.WaitWritable, e.g. while a service
+// is starting. Other failures are returned at once
+func waitPreflight(ctx context.Context, pid int, filePath string, opts Options) (string, []int, bool, error) {
+	absPath, fds, deleted, err := preflightCheck(pid, filePath, opts)
+	if err == nil || opts.WaitWritable <= 0 {
+		return absPath, fds, deleted, err
+	}
+	deadline := time.Now().Add(opts.WaitWritable)
+	poll := minWaitPoll
+	for {
+		if code := ExitCode(err); code != env.ExitNotFound && code != env.ExitNotOpen && code != env.ExitIgn {
+			return "", nil, false, err
+		}
+		if time.Now().After(deadline) {
+			return "", nil, false, &Error{Code: ExitCode(err),
+				Err: fmt.Errorf("gave up after waiting %s: %w", opts.WaitWritable, err)}
+		}
+		opts.logger().Debug("%s, check again in %s\n", err, poll)
+		select {
+		case <-ctx.Done():
+			return "", nil, false, ctx.Err()
+		case <-time.After(poll):
+		}
+		if poll *= 2; poll > maxWaitPoll {
+			poll = maxWaitPoll
+		}
+		absPath, fds, deleted, err = preflightCheck(pid, filePath, opts)
+		if err == nil {
+			return absPath, fds, deleted, nil
+		}
+	}
+}
+
+// checkOpenedFile refuses a descriptor which is not a regular file or
+// lives on a pseudo filesystem, reopening a pipe or socket by path
+// breaks IO of process, and skips a
+// file smaller than minSize. The descriptor is checked rather than the
+// path, so a deleted file is measured too
+func checkOpenedFile(pid int, fd int, filePath string, opts Options) error {
+	fdPath := fmt.Sprintf("%s/%d/fd/%d", procfs, pid, fd)
+	fInfo, err := os.Stat(fdPath)
+	if err != nil {
+		return newError(env.ExitNotFound, "%s", err)
+	}
+	// files of kernel interfaces look regular but can't be renamed
+	// or recreated, a flip fails or writes into the kernel
+	if fsName, pseudo := pseudoFilesystem(fdPath, opts.logger()); pseudo {
+		return newError(env.ExitRefused, "file %s is on %s, not a real filesystem", filePath, fsName)
+	}
+	if fInfo.IsDir() {
+		return newError(env.ExitIsDir, "target fd %d of process %d is a directory, not a file", fd, pid)
+	}
+	// even forced, the path would take the place of the device,
+	// pipe or socket and process lose what it talks to
+	if fInfo.Mode().IsRegular() == false {
+		return newError(env.ExitRefused, "fd %d of process %d is %s, not a regular file",
+			fd, pid, fileType(fInfo.Mode()))
+	}
+	if opts.MinSize > 0 && fInfo.Size() < opts.MinSize {
+		return newError(env.ExitSmall,
+			"file %s has %d bytes, below threshold %d, nothing to do", filePath, fInfo.Size(), opts.MinSize)
+	}
+	return nil
+}
+
+// List shows descriptors of process opening filePath without
+// attaching to it
+func List(pid int, filePath string, opts Options) ([]*FdInfo, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	procRoot, err := processRoot(pid, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	opts.procRoot = procRoot
+	absPath, err := localPath(filePath, opts.procRoot)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		return nil, newError(env.ExitNotFound, "%s", err)
+	}
+
+	fds, err := getOpenedFds(pid, absPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) == 0 {
+		return nil, newError(env.ExitNotOpen, "file %s exists but process %d does not have it open", absPath, pid)
+	}
+
+	infos := []*FdInfo{}
+	for _, fd := range fds {
+		info, err := InspectFd(pid, fd)
+		if err != nil {
+			// fd closed after we found it
+			opts.logger().Debug("%s\n", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
 }
@@ -0,0 +1,299 @@
+package flip
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+func TestFlipNotOpen(t *testing.T) {
+	dir := t.TempDir()
+	closed := filepath.Join(dir, "closed.log")
+	if err := os.WriteFile(closed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// held by O_PATH only, which can't be written
+	pathOnly := filepath.Join(dir, "path.log")
+	if err := os.WriteFile(pathOnly, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(pathOnly, oPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	cases := []struct {
+		name string
+		path string
+		opts Options
+		code int
+	}{
+		{"exists but not open", closed, Options{}, env.ExitNotOpen},
+		{"not open, lenient", closed, Options{Lenient: true}, env.ExitIgn},
+		{"only O_PATH", pathOnly, Options{}, env.ExitNotOpen},
+		{"missing", filepath.Join(dir, "missing.log"), Options{}, env.ExitNotFound},
+	}
+	for _, c := range cases {
+		c.opts.Logger = testLogger{t}
+		_, err := FlipContext(context.Background(), os.Getpid(), c.path, c.opts)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+	}
+	if fake.setups != 0 {
+		t.Errorf("attached %d times without a file to flip", fake.setups)
+	}
+
+	_, err = List(os.Getpid(), closed, Options{Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitNotOpen {
+		t.Errorf("list: exit code %d, want %d (%v)", code, env.ExitNotOpen, err)
+	}
+	_, err = List(os.Getpid(), filepath.Join(dir, "missing.log"), Options{Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitNotFound {
+		t.Errorf("list missing: exit code %d, want %d (%v)", code, env.ExitNotFound, err)
+	}
+}
+
+func TestFlipLongPath(t *testing.T) {
+	// nest directories until the path is as long as the lock file
+	// next to it allows under PATH_MAX, which counts the NUL
+	dir := t.TempDir()
+	for len(dir) < syscall.PathMax-255 {
+		dir = filepath.Join(dir, strings.Repeat("d", 200))
+	}
+	name := strings.Repeat("f", syscall.PathMax-1-len(lockSuffix)-len(dir)-1)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	if _, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}}); err != nil {
+		t.Fatalf("flip of %d bytes long path: %s", len(path), err)
+	}
+	mmaps, munmaps := fake.called(sysMmap), fake.called(syscall.SYS_MUNMAP)
+	if len(mmaps) != 1 || len(munmaps) != 1 {
+		t.Fatalf("%d mmap and %d munmap, want one each", len(mmaps), len(munmaps))
+	}
+	mapSize := mmaps[0][1]
+	if munmaps[0][1] != mapSize {
+		t.Errorf("munmap of %d bytes after mmap of %d", munmaps[0][1], mapSize)
+	}
+	if len(fake.copies) == 0 {
+		t.Fatal("path not copied to process")
+	}
+	copied := fake.copies[0]
+	if string(copied.data) != path+"\x00" || copied.size != len(path)+1 {
+		t.Errorf("copied %d bytes %.20q..., want the %d bytes of path and NUL", copied.size, copied.data, len(path)+1)
+	}
+	if uint64(copied.size) > mapSize {
+		t.Errorf("copied %d bytes into a mapping of %d", copied.size, mapSize)
+	}
+}
+
+func TestFlipAttachFailsLeavesFile(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{syscall.EPERM, env.ExitPerm},
+		{ptrace.ErrProcessGone, env.ExitGone},
+	} {
+		path := openedFile(t, "app.log", "before\n")
+		before, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := &fakeTracer{setupErr: c.err}
+		useFakeTracer(t, fake)
+
+		_, err = Flip(os.Getpid(), path, Options{Logger: testLogger{t}})
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%v: exit code %d, want %d (%v)", c.err, code, c.code, err)
+		}
+		after, statErr := os.Stat(path)
+		if statErr != nil || os.SameFile(before, after) == false {
+			t.Errorf("%v: %s was moved although attach failed", c.err, path)
+		}
+		if _, statErr := os.Stat(path + rolledSuffix); os.IsNotExist(statErr) == false {
+			t.Errorf("%v: %s created although attach failed", c.err, path+rolledSuffix)
+		}
+		if len(fake.calls) != 0 {
+			t.Errorf("%v: %d syscalls injected although attach failed", c.err, len(fake.calls))
+		}
+	}
+}
+
+func TestReopenFlags(t *testing.T) {
+	created := int64(syscall.O_CREAT | syscall.O_CLOEXEC)
+	cases := []struct {
+		name  string
+		getfl int64
+		want  int64
+	}{
+		{"write only", syscall.O_WRONLY, syscall.O_WRONLY | created},
+		{"read write", syscall.O_RDWR, syscall.O_RDWR | created},
+		{"appending", syscall.O_WRONLY | syscall.O_APPEND, syscall.O_WRONLY | syscall.O_APPEND | created},
+		{"large file", syscall.O_WRONLY | oLargefile, syscall.O_WRONLY | oLargefile | created},
+		{"sync", syscall.O_WRONLY | syscall.O_SYNC, syscall.O_WRONLY | syscall.O_SYNC | created},
+		// never given by F_GETFL, but they must not reach open if they were
+		{"truncate", syscall.O_WRONLY | syscall.O_TRUNC, syscall.O_WRONLY | created},
+		{"exclusive", syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL, syscall.O_WRONLY | created},
+		{"no ctty", syscall.O_WRONLY | syscall.O_NOCTTY, syscall.O_WRONLY | created},
+		// restored by F_SETFL after open
+		{"async", syscall.O_WRONLY | syscall.O_ASYNC, syscall.O_WRONLY | created},
+	}
+	for _, c := range cases {
+		if got := reopenFlags(c.getfl); got != c.want {
+			t.Errorf("%s: open flags %#o (%s), want %#o (%s)", c.name, got, decodeFlags(int(got)), c.want, decodeFlags(int(c.want)))
+		}
+	}
+
+	getfl := int64(syscall.O_WRONLY | syscall.O_TRUNC)
+	if got, want := pathOpenFlags(getfl, Options{}), int64(syscall.O_WRONLY|created|syscall.O_NOCTTY|syscall.O_NOFOLLOW); got != want {
+		t.Errorf("open by path: flags %#o, want %#o", got, want)
+	}
+	if got, want := pathOpenFlags(getfl, Options{FollowSymlinks: true}), int64(syscall.O_WRONLY|created|syscall.O_NOCTTY); got != want {
+		t.Errorf("open by path following symlinks: flags %#o, want %#o", got, want)
+	}
+}
+
+func TestFlipMapSize(t *testing.T) {
+	defer func(saved int) {
+		pageSize = saved
+	}(pageSize)
+	for _, size := range []int{4096, 16384, 65536} {
+		pageSize = size
+		for _, name := range []string{"a.log", strings.Repeat("a", 240)} {
+			path := openedFile(t, name, "")
+			fake := &fakeTracer{}
+			useFakeTracer(t, fake)
+			if _, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}}); err != nil {
+				t.Fatal(err)
+			}
+			mmaps, munmaps := fake.called(sysMmap), fake.called(syscall.SYS_MUNMAP)
+			if len(mmaps) != 1 || len(munmaps) != 1 {
+				t.Fatalf("%d mmap and %d munmap, want one each", len(mmaps), len(munmaps))
+			}
+			mapSize := mmaps[0][1]
+			if mapSize%uint64(size) != 0 || mapSize > uint64(size) {
+				t.Errorf("page size %d: mapped %d bytes for a %d bytes path, want one page", size, mapSize, len(path))
+			}
+			if mapSize < uint64(childBufSize(len(path)+1)) {
+				t.Errorf("page size %d: mapped %d bytes, child buffer needs %d", size, mapSize, childBufSize(len(path)+1))
+			}
+			if munmaps[0][0] != 0x10000 || munmaps[0][1] != mapSize {
+				t.Errorf("page size %d: munmap(%#x, %d) after mmap of %d bytes at %#x", size, munmaps[0][0], munmaps[0][1], mapSize, 0x10000)
+			}
+		}
+	}
+}
+
+func TestFlipNoRollbackKeepsRenamed(t *testing.T) {
+	for _, noRollback := range []bool{false, true} {
+		path := openedFile(t, "app.log", "before\n")
+		rolledPath := path + rolledSuffix
+		fake := &fakeTracer{fail: func(nr int) error {
+			if nr == syscall.SYS_OPEN {
+				return syscall.ENOSPC
+			}
+			return nil
+		}}
+		useFakeTracer(t, fake)
+
+		_, err := Flip(os.Getpid(), path, Options{NoRollback: noRollback, Logger: testLogger{t}})
+		if errors.Is(err, syscall.ENOSPC) == false {
+			t.Fatalf("no rollback %t: flip returned %v, want the open failure", noRollback, err)
+		}
+		if fake.cleanups != 1 {
+			t.Errorf("no rollback %t: tracer cleaned up %d times, want 1", noRollback, fake.cleanups)
+		}
+		content, readErr := os.ReadFile(rolledPath)
+		_, statErr := os.Stat(path)
+		if noRollback {
+			if readErr != nil || string(content) != "before\n" || os.IsNotExist(statErr) == false {
+				t.Errorf("file not left at %s: %q %v, %s exists %t", rolledPath, content, readErr, path, statErr == nil)
+			}
+			continue
+		}
+		if os.IsNotExist(readErr) == false || statErr != nil {
+			t.Errorf("rollback left %s: %v, %s missing: %v", rolledPath, readErr, path, statErr)
+		}
+	}
+}
+
+func TestWaitPreflightFileAppears(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	// the service creates the file, then opens it a while later
+	opened := make(chan *os.File, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(path, nil, 0644)
+		time.Sleep(100 * time.Millisecond)
+		f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		opened <- f
+	}()
+	defer func() {
+		if f := <-opened; f != nil {
+			f.Close()
+		}
+	}()
+
+	start := time.Now()
+	opts := Options{WaitWritable: 5 * time.Second, Logger: testLogger{t}}
+	_, fds, _, err := waitPreflight(context.Background(), os.Getpid(), path, opts)
+	if err != nil {
+		t.Fatalf("file never seen opened: %s", err)
+	}
+	if len(fds) != 1 {
+		t.Errorf("fds %v, want the one opening %s", fds, path)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("ready after %s, before the file was opened", waited)
+	}
+}
+
+func TestWaitPreflightGivesUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	start := time.Now()
+	opts := Options{WaitWritable: 300 * time.Millisecond, Logger: testLogger{t}}
+	_, _, _, err := waitPreflight(context.Background(), os.Getpid(), path, opts)
+	if code := ExitCode(err); code != env.ExitNotFound {
+		t.Errorf("exit code %d, want %d (%v)", code, env.ExitNotFound, err)
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("gave up after %s, before the timeout", waited)
+	}
+
+	// a refusal is not waited for
+	dir := t.TempDir()
+	start = time.Now()
+	_, _, _, err = waitPreflight(context.Background(), os.Getpid(), dir, opts)
+	if code := ExitCode(err); code != env.ExitIsDir {
+		t.Errorf("directory: exit code %d, want %d (%v)", code, env.ExitIsDir, err)
+	}
+	if waited := time.Since(start); waited >= 300*time.Millisecond {
+		t.Errorf("waited %s on a directory", waited)
+	}
+}
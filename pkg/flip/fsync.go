@@ -0,0 +1,42 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// syncArchive flushes the rolled file and the directories holding it
+// and the new file, so a crash right after the flip loses neither the
+// archived lines nor the rename. Process no longer writes the rolled
+// file but with RenameOnly, where only what it has so far is synced.
+// A deleted file has no archive, only the new entry is synced then
+func syncArchive(result *Result, opts Options) error {
+	var paths []string
+	if result.Deleted == false {
+		paths = append(paths, result.RolledPath, filepath.Dir(result.RolledPath))
+	}
+	if dir := filepath.Dir(result.Path); len(paths) == 0 || dir != paths[1] {
+		paths = append(paths, dir)
+	}
+	for _, path := range paths {
+		if err := syncPath(path); err != nil {
+			return newError(env.ExitPartial, "fsync %s error: %s", path, err)
+		}
+	}
+	opts.logger().Debug("synced %s to disk\n", strings.Join(paths, " "))
+	return nil
+}
+
+// syncPath fsyncs the file or directory at path, it can be replaced
+// to see what a flip syncs
+var syncPath = func(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,99 @@
+package flip
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// recordSyncs makes syncPath record the paths it is given before
+// syncing them
+func recordSyncs(t *testing.T) *[]string {
+	saved := syncPath
+	var synced []string
+	syncPath = func(path string) error {
+		synced = append(synced, path)
+		return saved(path)
+	}
+	t.Cleanup(func() {
+		syncPath = saved
+	})
+	return &synced
+}
+
+func TestSyncArchive(t *testing.T) {
+	dir := t.TempDir()
+	destDir := filepath.Join(dir, "archive")
+	if err := os.Mkdir(destDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "app.log.flipped"), filepath.Join(destDir, "app.log")} {
+		if err := os.WriteFile(path, []byte("line\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "app.log")
+	cases := []struct {
+		name   string
+		result *Result
+		want   []string
+		code   int
+	}{
+		{"same directory", &Result{Path: path, RolledPath: path + rolledSuffix},
+			[]string{path + rolledSuffix, dir}, env.ExitOk},
+		{"archive elsewhere", &Result{Path: path, RolledPath: filepath.Join(destDir, "app.log")},
+			[]string{filepath.Join(destDir, "app.log"), destDir, dir}, env.ExitOk},
+		{"deleted", &Result{Path: path, Deleted: true},
+			[]string{dir}, env.ExitOk},
+		{"archive missing", &Result{Path: path, RolledPath: filepath.Join(dir, "gone.log")},
+			[]string{filepath.Join(dir, "gone.log")}, env.ExitPartial},
+	}
+	for _, c := range cases {
+		synced := recordSyncs(t)
+		err := syncArchive(c.result, Options{Logger: testLogger{t}})
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+		if reflect.DeepEqual(*synced, c.want) == false {
+			t.Errorf("%s: synced %v, want %v", c.name, *synced, c.want)
+		}
+	}
+}
+
+func TestFlipFsync(t *testing.T) {
+	useFakeTracer(t, &fakeTracer{})
+	synced := recordSyncs(t)
+
+	path := openedFile(t, "app.log", "before\n")
+	if _, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*synced) != 0 {
+		t.Errorf("synced %v without Fsync", *synced)
+	}
+
+	path = openedFile(t, "app.log", "before\n")
+	if _, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}, Fsync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path + rolledSuffix, filepath.Dir(path)}; reflect.DeepEqual(*synced, want) == false {
+		t.Errorf("synced %v, want %v", *synced, want)
+	}
+
+	// a failed sync is reported once the flip is done
+	syncPath = func(string) error {
+		return errors.New("disk gone")
+	}
+	path = openedFile(t, "app.log", "before\n")
+	result, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}, Fsync: true})
+	if code := ExitCode(err); code != env.ExitPartial {
+		t.Errorf("exit code %d, want %d (%v)", code, env.ExitPartial, err)
+	}
+	if result == nil || result.RolledPath != path+rolledSuffix {
+		t.Errorf("result %+v, want the one of the flip done before the sync failed", result)
+	}
+}
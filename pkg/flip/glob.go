@@ -0,0 +1,55 @@
+package flip
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// FlipGlob flips every file matching pattern which pid holds open,
+// files matching but not opened are skipped. Process is attached once
+// for all of them as a plan, a failed one doesn't stop the rest
+func FlipGlob(ctx context.Context, pid int, pattern string, opts Options) ([]*Result, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	procRoot, err := processRoot(pid, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	opts.procRoot = procRoot
+	absPattern, err := localPath(pattern, procRoot)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(absPattern)
+	if err != nil {
+		return nil, newError(env.ExitArgs, "bad pattern %s: %s", pattern, err)
+	}
+
+	var opened []string
+	for _, match := range matches {
+		fds, err := getOpenedFds(pid, match, opts)
+		if err != nil {
+			return nil, err
+		}
+		fds, _ = ioFds(pid, fds, opts.logger())
+		if len(fds) == 0 {
+			opts.logger().Debug("%s not opened in process %d, skipped\n", match, pid)
+			continue
+		}
+		opened = append(opened, match)
+	}
+	if len(opened) == 0 {
+		if opts.Lenient {
+			return nil, newError(env.ExitIgn, "no file matching %s opened in process, nothing to do", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, newError(env.ExitNotFound, "no file matches %s", pattern)
+		}
+		return nil, newError(env.ExitNotOpen, "files match %s but process %d has none of them open", pattern, pid)
+	}
+	opts.logger().Debug("%d of %d files matching %s opened in process %d\n", len(opened), len(matches), pattern, pid)
+	return FlipPlan(ctx, []PlanEntry{{Pid: pid, Files: opened}}, opts)
+}
@@ -0,0 +1,85 @@
+package flip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+func TestFlipGlob(t *testing.T) {
+	dir := t.TempDir()
+	// a.log and b.log match and are open, c.log matches but is
+	// closed, d.txt is open but doesn't match
+	for _, name := range []string{"a.log", "b.log", "c.log", "d.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "c.log" {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+	}
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	results, err := FlipGlob(context.Background(), os.Getpid(), filepath.Join(dir, "*.log"), Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flipped []string
+	for _, result := range results {
+		flipped = append(flipped, filepath.Base(result.Path))
+	}
+	sort.Strings(flipped)
+	if len(flipped) != 2 || flipped[0] != "a.log" || flipped[1] != "b.log" {
+		t.Errorf("flipped %v, want [a.log b.log]", flipped)
+	}
+	if fake.setups != 1 || fake.cleanups != 1 {
+		t.Errorf("attached %d and detached %d times, want once for all files", fake.setups, fake.cleanups)
+	}
+	for _, name := range []string{"a.log", "b.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name+rolledSuffix)); err != nil {
+			t.Errorf("%s not rolled: %s", name, err)
+		}
+	}
+	for _, name := range []string{"c.log", "d.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name+rolledSuffix)); os.IsNotExist(err) == false {
+			t.Errorf("%s rolled although not an opened match", name)
+		}
+	}
+}
+
+func TestFlipGlobNoMatch(t *testing.T) {
+	dir := t.TempDir()
+	closed := filepath.Join(dir, "closed.log")
+	if err := os.WriteFile(closed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	useFakeTracer(t, &fakeTracer{})
+	cases := []struct {
+		name    string
+		pattern string
+		opts    Options
+		code    int
+	}{
+		{"nothing matches", "*.txt", Options{}, env.ExitNotFound},
+		{"matches not open", "*.log", Options{}, env.ExitNotOpen},
+		{"lenient", "*.log", Options{Lenient: true}, env.ExitIgn},
+	}
+	for _, c := range cases {
+		c.opts.Logger = testLogger{t}
+		_, err := FlipGlob(context.Background(), os.Getpid(), filepath.Join(dir, c.pattern), c.opts)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// inheritGroup gives filePath the group of its directory when the
+// directory is setgid, as a file created there by anyone gets. A new
+// file prepared by us, e.g. with Swap, or one created in a directory
+// made setgid after the original, would otherwise stand out from its
+// siblings. Failure is only warned
+func inheritGroup(filePath string, logger log.Logger) {
+	dirInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil || dirInfo.Mode()&os.ModeSetgid == 0 {
+		return
+	}
+	fInfo, err := os.Lstat(filePath)
+	if err != nil || fInfo.Mode().IsRegular() == false {
+		return
+	}
+	dirGid := dirInfo.Sys().(*syscall.Stat_t).Gid
+	gid := fInfo.Sys().(*syscall.Stat_t).Gid
+	if gid == dirGid {
+		return
+	}
+	if err := os.Lchown(filePath, -1, int(dirGid)); err != nil {
+		logger.Warn("give %s group %d of setgid directory error: %s\n", filePath, dirGid, err)
+		return
+	}
+	logger.Debug("group of %s changed from %d to %d of setgid directory\n", filePath, gid, dirGid)
+}
@@ -0,0 +1,45 @@
+package flip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// runPostCmd runs opts.PostCmd after a successful flip, it learns
+// what was flipped from FILEFLIP_* environment variables. Output goes
+// to stderr, stdout is kept for the result
+func runPostCmd(ctx context.Context, result *Result, opts Options) error {
+	cmd := exec.CommandContext(ctx, opts.PostCmd[0], opts.PostCmd[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FILEFLIP_PID="+strconv.Itoa(result.Pid),
+		"FILEFLIP_PATH="+result.Path,
+		"FILEFLIP_ROLLED="+result.RolledPath,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	opts.logger().Debug("run post command %q\n", opts.PostCmd)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.PostCmdExit = exitErr.ExitCode()
+		err = fmt.Errorf("post command %q exited with %d", opts.PostCmd, result.PostCmdExit)
+	} else if err != nil {
+		result.PostCmdExit = -1
+		err = fmt.Errorf("post command %q error: %s", opts.PostCmd, err)
+	}
+	if err == nil {
+		return nil
+	}
+	if opts.PostCmdFatal {
+		return newError(env.ExitPartial, "%s", err)
+	}
+	opts.logger().Warn("%s\n", err)
+	return nil
+}
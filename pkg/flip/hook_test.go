@@ -0,0 +1,88 @@
+package flip
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// envRecorder is a post command appending FILEFLIP_* variables it gets
+// to out, one run after another
+func envRecorder(out string) []string {
+	return []string{"sh", "-c", `env | grep ^FILEFLIP_ | sort >> "$0"; echo >> "$0"`, out}
+}
+
+func TestFlipRunsPostCmd(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	out := filepath.Join(t.TempDir(), "env")
+	useFakeTracer(t, &fakeTracer{})
+
+	result, err := Flip(os.Getpid(), path, Options{PostCmd: envRecorder(out), Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("post command didn't run: %s", err)
+	}
+	want := "FILEFLIP_PATH=" + path + "\n" +
+		"FILEFLIP_PID=" + strconv.Itoa(os.Getpid()) + "\n" +
+		"FILEFLIP_ROLLED=" + result.RolledPath + "\n\n"
+	if string(recorded) != want {
+		t.Errorf("post command ran with\n%s\nwant once with\n%s", recorded, want)
+	}
+}
+
+func TestFlipFailedSkipsPostCmd(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	out := filepath.Join(t.TempDir(), "env")
+	useFakeTracer(t, &fakeTracer{fail: func(nr int) error {
+		if nr == syscall.SYS_OPEN {
+			return syscall.ENOSPC
+		}
+		return nil
+	}})
+
+	if _, err := Flip(os.Getpid(), path, Options{PostCmd: envRecorder(out), Logger: testLogger{t}}); err == nil {
+		t.Fatal("flip succeeded although open failed")
+	}
+	if _, err := os.Stat(out); os.IsNotExist(err) == false {
+		t.Errorf("post command ran after a rolled back flip")
+	}
+}
+
+func TestPostCmdExitStatus(t *testing.T) {
+	cases := []struct {
+		cmd   []string
+		fatal bool
+		code  int
+		exit  int
+	}{
+		{[]string{"true"}, true, env.ExitOk, 0},
+		{[]string{"sh", "-c", "exit 3"}, false, env.ExitOk, 3},
+		{[]string{"sh", "-c", "exit 3"}, true, env.ExitPartial, 3},
+		{[]string{filepath.Join(t.TempDir(), "missing")}, true, env.ExitPartial, -1},
+	}
+	for _, c := range cases {
+		result := &Result{Pid: os.Getpid(), Path: "/var/log/app.log"}
+		opts := Options{PostCmd: c.cmd, PostCmdFatal: c.fatal, Logger: testLogger{t}}
+		err := runPostCmd(context.Background(), result, opts)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s fatal %t: exit code %d, want %d (%v)", strings.Join(c.cmd, " "), c.fatal, code, c.code, err)
+		}
+		if result.PostCmdExit != c.exit {
+			t.Errorf("%s: post command exit %d, want %d", strings.Join(c.cmd, " "), result.PostCmdExit, c.exit)
+		}
+		var flipErr *Error
+		if c.code != env.ExitOk && errors.As(err, &flipErr) == false {
+			t.Errorf("%s: error %v is not an *Error", strings.Join(c.cmd, " "), err)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+//go:build integration
+
+package flip
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// Flips of live writer processes, the same as scripts/integration.sh
+// but through the package. Run with go test -tags integration, they are
+// skipped without the privilege to attach.
+
+// writerEnv makes the test binary a writer appending a counter line
+// to the file it names every 10ms, see runWriter
+const writerEnv = "FLIP_TEST_WRITER"
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(writerEnv); path != "" {
+		if err := runWriter(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// runWriter writes to path until killed. WRITER_APPEND=1 opens it
+// O_APPEND, WRITER_FLAGS adds more open flags, WRITER_SECOND holds
+// another fd of it open with its flags added to O_WRONLY, WRITER_UMASK
+// sets the umask (octal), WRITER_IDLE=1 only holds it open
+func runWriter(path string) error {
+	if mask := os.Getenv("WRITER_UMASK"); mask != "" {
+		n, err := strconv.ParseInt(mask, 8, 32)
+		if err != nil {
+			return err
+		}
+		syscall.Umask(int(n))
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if os.Getenv("WRITER_APPEND") != "" {
+		flags |= os.O_APPEND
+	}
+	if extra := os.Getenv("WRITER_FLAGS"); extra != "" {
+		n, err := strconv.Atoi(extra)
+		if err != nil {
+			return err
+		}
+		flags |= n
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if second := os.Getenv("WRITER_SECOND"); second != "" {
+		n, err := strconv.Atoi(second)
+		if err != nil {
+			return err
+		}
+		// a raw fd, an *os.File would be closed once collected
+		if _, err := syscall.Open(path, syscall.O_WRONLY|n, 0); err != nil {
+			return err
+		}
+	}
+	if os.Getenv("WRITER_IDLE") != "" {
+		time.Sleep(time.Hour)
+	}
+	for i := 0; ; i++ {
+		fmt.Fprintf(f, "%d\n", i)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// skipUnlessAttachable skips when this system or our privileges don't
+// allow attaching a process which is not our descendant
+func skipUnlessAttachable(t *testing.T) {
+	checks := SelfCheck()
+	if CheckPassed(checks) == false {
+		for _, check := range checks {
+			if check.Passed == false && check.Optional == false {
+				t.Skipf("%s: %s", check.Name, check.Detail)
+			}
+		}
+	}
+	capable, err := hasCapability(capSysPtrace)
+	if err != nil {
+		t.Skip(err)
+	}
+	scope, err := ptraceScope()
+	if err == nil && capable == false && scope != scopeClassic {
+		t.Skipf("needs CAP_SYS_PTRACE under ptrace_scope %d", scope)
+	}
+}
+
+// startWriter forks a writer of path with the extra environment
+// settings of runWriter, killed when the test ends
+func startWriter(t *testing.T, path string, appending bool, settings ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), writerEnv+"="+path)
+	cmd.Env = append(cmd.Env, settings...)
+	if appending {
+		cmd.Env = append(cmd.Env, "WRITER_APPEND=1")
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// readCounters reads the numbered lines of path
+func readCounters(t *testing.T, path string) []int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var counters []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			t.Fatalf("%s: bad line %q", path, scanner.Text())
+		}
+		counters = append(counters, n)
+	}
+	return counters
+}
+
+// flipWriter flips path of a writer started on it with opts once it
+// wrote for a while, and lets it write on after. It skips when the
+// attach is refused
+func flipWriter(t *testing.T, path string, appending bool, opts Options, settings ...string) *Result {
+	writer := startWriter(t, path, appending, settings...)
+	time.Sleep(300 * time.Millisecond)
+	return flipRunning(t, writer, path, opts)
+}
+
+// flipRunning flips path of writer which is already running
+func flipRunning(t *testing.T, writer *exec.Cmd, path string, opts Options) *Result {
+	opts.Logger = testLogger{t}
+	result, err := Flip(writer.Process.Pid, path, opts)
+	if code := ExitCode(err); code == env.ExitPerm || code == env.ExitScope {
+		t.Skipf("attach refused: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := writer.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("writer died after flip: %s", err)
+	}
+	return result
+}
+
+// checkCounting fails unless counters count up by one from first
+func checkCounting(t *testing.T, counters []int, first int) {
+	t.Helper()
+	for i, n := range counters {
+		if n != first+i {
+			t.Fatalf("line %d is %d, want %d", i, n, first+i)
+		}
+	}
+}
+
+func TestFlipLiveWriter(t *testing.T) {
+	skipUnlessAttachable(t)
+	for _, c := range []struct {
+		name      string
+		appending bool
+	}{
+		{"append", true},
+		{"offset", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			result := flipWriter(t, path, c.appending, Options{})
+
+			before := readCounters(t, result.RolledPath)
+			after := readCounters(t, path)
+			if len(before) == 0 || len(after) == 0 {
+				t.Fatalf("%d lines archived and %d written after, want both", len(before), len(after))
+			}
+			// no line lost or repeated across the flip
+			checkCounting(t, append(before, after...), 0)
+		})
+	}
+}
+
+func TestTruncateOnlyLiveWriter(t *testing.T) {
+	skipUnlessAttachable(t)
+	for _, c := range []struct {
+		name      string
+		appending bool
+	}{
+		{"append", true},
+		// the offset is moved back, or the next write leaves a hole
+		{"offset", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			result := flipWriter(t, path, c.appending, Options{TruncateOnly: true})
+			if result.RolledPath != "" {
+				t.Errorf("archive %s made by truncate only", result.RolledPath)
+			}
+			entries, err := os.ReadDir(filepath.Dir(path))
+			if err != nil || len(entries) != 1 {
+				t.Errorf("directory holds %d files, want only %s: %v", len(entries), path, err)
+			}
+			// what was written before is gone, the rest follows on
+			after := readCounters(t, path)
+			if len(after) == 0 || after[0] == 0 {
+				t.Fatalf("file starts with %v, want lines written after the truncate", after)
+			}
+			checkCounting(t, after, after[0])
+		})
+	}
+}
+
+func TestFlipCopyKeepsTimes(t *testing.T) {
+	skipUnlessAttachable(t)
+	// the archive goes to another filesystem, so it is copied
+	destDir, err := os.MkdirTemp("/dev/shm", "fileflip")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(destDir)
+	path := filepath.Join(t.TempDir(), "app.log")
+	if sameFilesystem(filepath.Dir(path), destDir) {
+		t.Skipf("%s and %s are on the same filesystem", path, destDir)
+	}
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	atime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(path, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(destDir, "app.log.1")
+	result := flipWriter(t, path, true, Options{Dest: dest}, "WRITER_IDLE=1")
+	if result.RolledPath != dest {
+		t.Fatalf("archived to %s, want %s", result.RolledPath, dest)
+	}
+	fInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotAtime, gotMtime := fileTimes(fInfo)
+	if gotAtime.Equal(atime) == false || gotMtime.Equal(mtime) == false {
+		t.Errorf("copy has times %s %s, want %s %s", gotAtime, gotMtime, atime, mtime)
+	}
+	if _, err := os.Stat(path + rolledSuffix); os.IsNotExist(err) == false {
+		t.Errorf("staged %s left behind", path+rolledSuffix)
+	}
+}
+
+// keptFlags are the flags of a descriptor a flip keeps, O_NOFOLLOW and
+// O_TMPFILE of the open done by the flip show in fdinfo as well
+const keptFlags = openFlags | syscall.O_ASYNC | syscall.O_CLOEXEC
+
+// fdFlags reads keptFlags of each fd of pid opening path
+func fdFlags(t *testing.T, pid int, path string) map[int]int {
+	fds, err := getOpenedFds(pid, path, Options{MatchInode: true, Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := map[int]int{}
+	for _, fd := range fds {
+		info, err := readFdInfo(pid, fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags[fd] = info.Flags & keptFlags
+	}
+	return flags
+}
+
+func TestFlipKeepsStatusFlags(t *testing.T) {
+	skipUnlessAttachable(t)
+	// O_SYNC only takes effect by open, the others by F_SETFL
+	extra := syscall.O_SYNC | syscall.O_NONBLOCK | syscall.O_NOATIME
+	for _, opts := range []Options{{}, {Tmpfile: true}} {
+		path := filepath.Join(t.TempDir(), "app.log")
+		writer := startWriter(t, path, true, "WRITER_FLAGS="+strconv.Itoa(extra))
+		time.Sleep(300 * time.Millisecond)
+		before := fdFlags(t, writer.Process.Pid, path)
+		if len(before) != 1 {
+			t.Fatalf("writer opens %s by fds %v, want one", path, before)
+		}
+		flipRunning(t, writer, path, opts)
+		after := fdFlags(t, writer.Process.Pid, path)
+		if reflect.DeepEqual(after, before) == false {
+			t.Errorf("tmpfile %t: flags %s after flip, want %s", opts.Tmpfile, flagsString(after), flagsString(before))
+		}
+	}
+}
+
+func TestFlipKeepsFlagsPerFd(t *testing.T) {
+	skipUnlessAttachable(t)
+	second := syscall.O_SYNC | syscall.O_NONBLOCK
+	for _, opts := range []Options{{}, {Tmpfile: true}} {
+		path := filepath.Join(t.TempDir(), "app.log")
+		writer := startWriter(t, path, true, "WRITER_SECOND="+strconv.Itoa(second))
+		time.Sleep(300 * time.Millisecond)
+		before := fdFlags(t, writer.Process.Pid, path)
+		if len(before) != 2 {
+			t.Fatalf("writer opens %s by fds %v, want two", path, before)
+		}
+		flipRunning(t, writer, path, opts)
+		after := fdFlags(t, writer.Process.Pid, path)
+		if reflect.DeepEqual(after, before) == false {
+			t.Errorf("tmpfile %t: flags %s after flip, want %s", opts.Tmpfile, flagsString(after), flagsString(before))
+		}
+		// one shared description would move the idle fd along with
+		// the appending one
+		for fd, flag := range after {
+			info, err := readFdInfo(writer.Process.Pid, fd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if appending := flag&syscall.O_APPEND != 0; appending == (info.Pos == 0) {
+				t.Errorf("tmpfile %t: fd %d appending %t at %d after flip", opts.Tmpfile, fd, appending, info.Pos)
+			}
+		}
+	}
+}
+
+func flagsString(flags map[int]int) string {
+	s := ""
+	for fd, flag := range flags {
+		s += fmt.Sprintf("fd %d %#o %s ", fd, flag, decodeFlags(flag))
+	}
+	return s
+}
+
+func TestFlipModeUnderUmask(t *testing.T) {
+	skipUnlessAttachable(t)
+	for _, c := range []struct {
+		opts Options
+		want os.FileMode
+	}{
+		{Options{}, 0640},
+		{Options{ExactMode: true}, 0644},
+		{Options{Mode: 0600}, 0600},
+		{Options{Tmpfile: true, ExactMode: true}, 0644},
+	} {
+		path := filepath.Join(t.TempDir(), "app.log")
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		flipWriter(t, path, true, c.opts, "WRITER_UMASK=027")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != c.want {
+			t.Errorf("%+v: new file mode %#o under umask 027, want %#o", c.opts, info.Mode().Perm(), c.want)
+		}
+	}
+}
+
+// hookTracer is a live tracer which runs before ahead of each
+// injected syscall, e.g. to race the flip
+type hookTracer struct {
+	Tracer
+	before func(nr int, args []uint64)
+}
+
+func (h hookTracer) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	h.before(nr, args)
+	return h.Tracer.RemoteSyscall(nr, args...)
+}
+
+// hookSyscalls makes flips of the test run before ahead of each
+// injected syscall
+func hookSyscalls(t *testing.T, before func(nr int, args []uint64)) {
+	saved := newTracer
+	newTracer = func(pid int, opts Options) Tracer {
+		return hookTracer{saved(pid, opts), before}
+	}
+	t.Cleanup(func() {
+		newTracer = saved
+	})
+}
+
+func TestFlipRefusesPlantedSymlink(t *testing.T) {
+	skipUnlessAttachable(t)
+	for _, follow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("follow %t", follow), func(t *testing.T) {
+			flipPlantedSymlink(t, follow)
+		})
+	}
+}
+
+func flipPlantedSymlink(t *testing.T, follow bool) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// planted between the rename and the open of the new file
+	hookSyscalls(t, func(nr int, args []uint64) {
+		if nr == syscall.SYS_OPEN {
+			if err := os.Symlink(target, path); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	writer := startWriter(t, path, true)
+	time.Sleep(300 * time.Millisecond)
+
+	_, err := Flip(writer.Process.Pid, path, Options{FollowSymlinks: follow, Logger: testLogger{t}})
+	if code := ExitCode(err); code == env.ExitPerm || code == env.ExitScope {
+		t.Skipf("attach refused: %s", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	written, statErr := os.Stat(target)
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if follow {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written.Size() == 0 {
+			t.Errorf("writer doesn't write to %s", target)
+		}
+		return
+	}
+	if code := ExitCode(err); code != env.ExitRefused || errors.Is(err, syscall.ELOOP) == false {
+		t.Errorf("exit code %d, want %d for ELOOP (%v)", code, env.ExitRefused, err)
+	}
+	if written.Size() != 0 {
+		t.Errorf("writer wrote %d bytes through the planted symlink", written.Size())
+	}
+	// the old file is kept aside, the symlink is not replaced
+	if link, err := os.Readlink(path); err != nil || link != target {
+		t.Errorf("symlink at %s is %q %v, want it left alone", path, link, err)
+	}
+	checkCounting(t, readCounters(t, path+rolledSuffix), 0)
+}
+
+// peekTracer is a live tracer which reads back the path each injected
+// open acts on
+type peekTracer struct {
+	Tracer
+	size   int
+	opened *[]string
+	mapped *bool
+}
+
+func (p peekTracer) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	switch nr {
+	case syscall.SYS_OPEN:
+		data, err := p.RemotePeek(uintptr(args[0]), p.size)
+		if err != nil {
+			return 0, err
+		}
+		*p.opened = append(*p.opened, string(data))
+	case sysMmap:
+		*p.mapped = true
+	}
+	return p.Tracer.RemoteSyscall(nr, args...)
+}
+
+func TestFlipStackScratch(t *testing.T) {
+	skipUnlessAttachable(t)
+	path := filepath.Join(t.TempDir(), "app.log")
+	var opened []string
+	var mapped bool
+	saved := newTracer
+	newTracer = func(pid int, opts Options) Tracer {
+		return peekTracer{saved(pid, opts), len(path) + 1, &opened, &mapped}
+	}
+	t.Cleanup(func() {
+		newTracer = saved
+	})
+
+	flipWriter(t, path, true, Options{StackScratch: true})
+	if mapped {
+		t.Errorf("a page is mapped with stack scratch")
+	}
+	if len(opened) != 1 || opened[0] != path+"\x00" {
+		t.Fatalf("open of %q, want %q", opened, path+"\x00")
+	}
+	// the path open read is the path the writer goes on writing
+	counters := readCounters(t, path)
+	if len(counters) == 0 {
+		t.Fatalf("nothing written to new %s", path)
+	}
+	checkCounting(t, counters, counters[0])
+}
+
+// chattrOrSkip sets flags on path, skipping where the filesystem or our
+// privileges don't allow it. They are lifted again when the test ends,
+// else the directory can't be removed
+func chattrOrSkip(t *testing.T, path string, flags int32) {
+	if err := setInodeFlags(path, flags); err != nil {
+		t.Skipf("chattr %s of %s: %s", attrNames(flags), path, err)
+	}
+	t.Cleanup(func() {
+		matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+		for _, match := range matches {
+			setInodeFlags(match, 0)
+		}
+	})
+}
+
+func TestFlipKeepsAttrs(t *testing.T) {
+	skipUnlessAttachable(t)
+	for _, c := range []struct {
+		flags               int32
+		wantNew, wantRolled int32
+	}{
+		{fsAppendFl, fsAppendFl, fsAppendFl},
+		// process could not write to an immutable new file
+		{fsImmutableFl, 0, fsImmutableFl},
+	} {
+		t.Run(attrNames(c.flags), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			writer := startWriter(t, path, true)
+			time.Sleep(300 * time.Millisecond)
+			chattrOrSkip(t, path, c.flags)
+
+			_, err := Flip(writer.Process.Pid, path, Options{Logger: testLogger{t}})
+			if ExitCode(err) != env.ExitRefused {
+				t.Fatalf("flip of %s file without KeepAttrs: %v, want refused", attrNames(c.flags), err)
+			}
+
+			result := flipRunning(t, writer, path, Options{KeepAttrs: true})
+			for p, want := range map[string]int32{path: c.wantNew, result.RolledPath: c.wantRolled} {
+				flags, err := inodeFlags(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := flags & (fsImmutableFl | fsAppendFl); got != want {
+					t.Errorf("%s has %q after flip, want %q", p, attrNames(got), attrNames(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package flip
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// lockSuffix is appended to the flipped file for its lock file
+const lockSuffix = ".flip-lock"
+
+// lockPollInterval is how often a busy lock is tried again
+const lockPollInterval = 50 * time.Millisecond
+
+// flipLock is an flock held on the lock file of a flipped file
+type flipLock struct {
+	path   string
+	file   *os.File
+	logger log.Logger
+}
+
+// acquireLock takes the lock of filePath, waiting up to timeout for
+// another flip to finish, zero timeout waits until ctx is done
+func acquireLock(ctx context.Context, filePath string, timeout time.Duration, logger log.Logger) (*flipLock, error) {
+	lockPath := filePath + lockSuffix
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			if os.IsPermission(err) {
+				return nil, newError(env.ExitPerm, "%s", err)
+			}
+			return nil, err
+		}
+
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			// holder before us may have removed the file after we
+			// opened it, then the lock is on an orphan inode
+			if sameFile(file, lockPath) {
+				logger.Debug("lock %s acquired\n", lockPath)
+				return &flipLock{path: lockPath, file: file, logger: logger}, nil
+			}
+			file.Close()
+			continue
+		}
+		file.Close()
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return nil, err
+		}
+
+		if deadline.IsZero() == false && time.Now().After(deadline) {
+			return nil, newError(env.ExitErr,
+				"%s is being flipped by another process, gave up after %s", filePath, timeout)
+		}
+		logger.Debug("lock %s is busy, wait\n", lockPath)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// sameFile tells if opened file is still the one at path
+func sameFile(file *os.File, path string) bool {
+	fInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fInfo, pathInfo)
+}
+
+// release removes the lock file and unlocks, removing comes first
+// so a waiter never locks a file which is about to vanish
+func (l *flipLock) release() {
+	if err := os.Remove(l.path); err != nil {
+		l.logger.Error("remove lock file %s error: %s\n", l.path, err)
+	}
+	l.file.Close()
+	l.logger.Debug("lock %s released\n", l.path)
+}
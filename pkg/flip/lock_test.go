@@ -0,0 +1,90 @@
+package flip
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockContended(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "app.log")
+	var holders, maxHolders, acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				lock, err := acquireLock(context.Background(), filePath, 0, testLogger{t})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := atomic.AddInt32(&holders, 1)
+				for {
+					max := atomic.LoadInt32(&maxHolders)
+					if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				atomic.AddInt32(&acquired, 1)
+				lock.release()
+			}
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("lock held by %d at once, want 1", maxHolders)
+	}
+	if acquired != 10 {
+		t.Errorf("lock acquired %d times, want 10", acquired)
+	}
+}
+
+func TestAcquireLockBusy(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "app.log")
+	lock, err := acquireLock(context.Background(), filePath, 0, testLogger{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a timeout gives up while the lock is held
+	start := time.Now()
+	if _, err := acquireLock(context.Background(), filePath, 100*time.Millisecond, testLogger{t}); err == nil {
+		t.Error("lock acquired twice")
+	} else if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("gave up after %s, before the timeout", time.Since(start))
+	}
+
+	// so does a done context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := acquireLock(ctx, filePath, 0, testLogger{t}); err != context.DeadlineExceeded {
+		t.Errorf("waiting on a done context returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// a waiter gets the lock once it is released
+	done := make(chan error)
+	go func() {
+		waiter, err := acquireLock(context.Background(), filePath, 0, testLogger{t})
+		if err == nil {
+			waiter.release()
+		}
+		done <- err
+	}()
+	time.Sleep(2 * lockPollInterval)
+	lock.release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("waiter failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("waiter didn't get the released lock")
+	}
+}
@@ -0,0 +1,98 @@
+package flip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// metricsLockTimeout bounds waiting for other runs writing the same
+// metrics file
+const metricsLockTimeout = 5 * time.Second
+
+// Metric is a record of one run for monitoring
+type Metric struct {
+	// Time is when the run finished
+	Time time.Time `json:"time"`
+	// Pid is the target process
+	Pid int `json:"pid"`
+	// Path is the file to flip
+	Path string `json:"path"`
+	// Success is true if flip finished without error
+	Success bool `json:"success"`
+	// Skipped is true if there was nothing to do
+	Skipped bool `json:"skipped"`
+	// ExitCode is what fileflip exits with
+	ExitCode int `json:"exit_code"`
+	// Error is the failure message
+	Error string `json:"error,omitempty"`
+	// Fds are descriptors replaced in process
+	Fds []int `json:"fds"`
+	// BytesRolled is the size of archived file
+	BytesRolled int64 `json:"bytes_rolled"`
+	// NewBytes is the size of the live file right after the flip
+	NewBytes int64 `json:"new_bytes"`
+	// Duration is the wall time spent on the flip
+	Duration time.Duration `json:"duration"`
+}
+
+// NewMetric builds record of a run from what Flip returned, result
+// may be nil if flip failed early
+func NewMetric(pid int, filePath string, result *Result, err error) *Metric {
+	m := &Metric{
+		Time:     time.Now(),
+		Pid:      pid,
+		Path:     filePath,
+		Success:  err == nil,
+		Skipped:  Skipped(err),
+		ExitCode: env.Resolve(ExitCode(err)),
+		Fds:      []int{},
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	if result != nil {
+		m.Path = result.Path
+		m.Fds = result.Fds
+		m.BytesRolled = result.BytesRolled
+		m.NewBytes = result.NewBytes
+		m.Duration = result.Duration
+	}
+	return m
+}
+
+// AppendMetric adds m as a JSON line to metricsPath with a single
+// O_APPEND write, so a reader never sees a partial record. Runs
+// sharing the file are serialized by its lock
+func AppendMetric(metricsPath string, m *Metric, opts Options) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	absPath, err := filepath.Abs(metricsPath)
+	if err != nil {
+		return err
+	}
+	// other runs append to the same file
+	lock, err := acquireLock(context.Background(), absPath, metricsLockTimeout, opts.logger())
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	file, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("append to %s error: %w", absPath, err)
+	}
+	return file.Close()
+}
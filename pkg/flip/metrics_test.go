@@ -0,0 +1,40 @@
+package flip
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendMetric(t *testing.T) {
+	metricsPath := filepath.Join(t.TempDir(), "metrics.jsonl")
+	if err := os.WriteFile(metricsPath, []byte("{\"pid\":1}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Logger: testLogger{t}}
+	for _, pid := range []int{100, 200} {
+		m := NewMetric(pid, "/var/log/app.log", nil, nil)
+		if err := AppendMetric(metricsPath, m, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("metrics file has %d lines, want 3:\n%s", len(lines), content)
+	}
+	for i, pid := range []int{1, 100, 200} {
+		var m Metric
+		if err := json.Unmarshal([]byte(lines[i]), &m); err != nil {
+			t.Fatalf("line %d: %s", i+1, err)
+		}
+		if m.Pid != pid {
+			t.Errorf("line %d has pid %d, want %d", i+1, m.Pid, pid)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package flip
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// makeDestDir creates dir and its missing parents for the rolled file
+// of filePath, each with the mode and owner of the directory filePath
+// is in, so archives are as accessible as the file was. A directory
+// made meanwhile by another flip is fine
+func makeDestDir(filePath string, dir string, opts Options) error {
+	logger := opts.logger()
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	srcInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil {
+		return newError(env.ExitNotFound, "%s", err)
+	}
+	perm := srcInfo.Mode().Perm()
+	stat := srcInfo.Sys().(*syscall.Stat_t)
+	for i := len(missing) - 1; i >= 0; i-- {
+		d := missing[i]
+		if opts.explain != nil {
+			opts.explain.local("mkdir(%q, %#o)", d, perm)
+			continue
+		}
+		if err := os.Mkdir(d, perm); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return fmt.Errorf("create directory for rolled file error: %w", err)
+		}
+		// chmod after chown, mode given to mkdir is masked by umask
+		if err := os.Lchown(d, int(stat.Uid), int(stat.Gid)); err != nil {
+			logger.Debug("give %s owner of %s error: %s\n", d, filepath.Dir(filePath), err)
+		}
+		if err := os.Chmod(d, perm); err != nil {
+			logger.Warn("set mode %#o of %s error: %s\n", perm, d, err)
+		}
+		logger.Debug("created %s with mode %#o for rolled file\n", d, perm)
+	}
+	return nil
+}
+
+// existingDir is the nearest directory of path which exists, the one a
+// missing directory would be made in
+func existingDir(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
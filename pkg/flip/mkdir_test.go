@@ -0,0 +1,49 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlipMkdirNested(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	dir := filepath.Dir(path)
+	if err := os.Chmod(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "archive", "2026", "10", "app.log.1")
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	// without Mkdir a missing directory fails the flip before the attach
+	if _, err := Flip(os.Getpid(), path, Options{Dest: dest, Logger: testLogger{t}}); err == nil {
+		t.Fatal("flip into a missing directory succeeded")
+	}
+	if fake.setups != 0 {
+		t.Errorf("attached %d times to flip into a missing directory", fake.setups)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "archive")); os.IsNotExist(err) == false {
+		t.Errorf("directory created without mkdir: %v", err)
+	}
+
+	result, err := Flip(os.Getpid(), path, Options{Dest: dest, Mkdir: true, Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RolledPath != dest {
+		t.Errorf("rolled to %s, want %s", result.RolledPath, dest)
+	}
+	if content, err := os.ReadFile(dest); err != nil || string(content) != "before\n" {
+		t.Errorf("archive %s holds %q %v", dest, content, err)
+	}
+	for d := filepath.Dir(dest); d != dir; d = filepath.Dir(d) {
+		info, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("%s created with mode %#o, want %#o of %s", d, info.Mode().Perm(), 0750, dir)
+		}
+	}
+}
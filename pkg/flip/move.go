@@ -0,0 +1,137 @@
+package flip
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// renameNoReplace is RENAME_NOREPLACE flag of renameat2
+const renameNoReplace = 1
+
+// noRenameat2 is set when kernel or filesystem lacks RENAME_NOREPLACE
+var noRenameat2 bool
+
+// renameExclusive renames src to dst only if dst doesn't exist, it is
+// one atomic renameat2 so two flips can't both pass an exists check.
+// Without RENAME_NOREPLACE it falls back to a check and a rename
+func renameExclusive(src string, dst string, logger log.Logger) error {
+	if noRenameat2 == false {
+		err := renameat2(src, dst, renameNoReplace)
+		if err != syscall.ENOSYS && err != syscall.EINVAL {
+			return err
+		}
+		logger.Debug("renameat2 RENAME_NOREPLACE not supported, check and rename instead\n")
+		noRenameat2 = true
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EEXIST}
+	}
+	return os.Rename(src, dst)
+}
+
+func renameat2(src string, dst string, flags int) error {
+	srcPtr, err := syscall.BytePtrFromString(src)
+	if err != nil {
+		return err
+	}
+	dstPtr, err := syscall.BytePtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFdcwd
+	_, _, errno := syscall.Syscall6(sysRenameat2,
+		uintptr(fdcwd), uintptr(unsafe.Pointer(srcPtr)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(dstPtr)),
+		uintptr(flags), 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EINVAL {
+			return errno
+		}
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: errno}
+	}
+	return nil
+}
+
+// moveFile renames src to dst, never replacing an existing dst, if
+// they live on different filesystems the content is copied and src
+// removed, mode and times are kept
+func moveFile(src string, dst string, logger log.Logger) error {
+	err := renameExclusive(src, dst, logger)
+	if errors.Is(err, syscall.EXDEV) == false {
+		return err
+	}
+	logger.Debug("%s and %s on different filesystems, copy instead\n", src, dst)
+
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies content of src into a new file dst, then takes
+// over access and modify time of src
+func copyFile(src string, dst string) error {
+	return streamFile(src, dst, nil)
+}
+
+// streamFile writes content of src into a new file dst through the
+// writer wrap builds, or as is if wrap is nil, then takes over access
+// and modify time of src
+func streamFile(src string, dst string, wrap func(io.Writer) (io.WriteCloser, error)) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fInfo, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	var w io.Writer = out
+	var enc io.WriteCloser
+	if wrap != nil {
+		enc, err = wrap(out)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		w = enc
+	}
+	_, err = io.Copy(w, in)
+	if enc != nil {
+		// flush what encoder buffers before the file is closed
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	atime, mtime := fileTimes(fInfo)
+	return os.Chtimes(dst, atime, mtime)
+}
+
+// fileTimes returns access and modify time in file info
+func fileTimes(fInfo os.FileInfo) (time.Time, time.Time) {
+	st := fInfo.Sys().(*syscall.Stat_t)
+	atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	return atime, fInfo.ModTime()
+}
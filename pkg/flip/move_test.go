@@ -0,0 +1,67 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestRenameExclusiveRace(t *testing.T) {
+	if noRenameat2 {
+		t.Skip("renameat2 RENAME_NOREPLACE not supported, the fallback is not atomic")
+	}
+	const racers = 8
+	for round := 0; round < 20; round++ {
+		dir := t.TempDir()
+		dst := filepath.Join(dir, "app.log"+rolledSuffix)
+		srcs := make([]string, racers)
+		for i := range srcs {
+			srcs[i] = filepath.Join(dir, fmt.Sprintf("app.log.%d", i))
+			if err := os.WriteFile(srcs[i], []byte(srcs[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		errs := make([]error, racers)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range srcs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = renameExclusive(srcs[i], dst, testLogger{t})
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			switch {
+			case err == nil && winner >= 0:
+				t.Fatalf("round %d: both %s and %s renamed onto %s", round, srcs[winner], srcs[i], dst)
+			case err == nil:
+				winner = i
+			case errors.Is(err, syscall.EEXIST) == false:
+				t.Fatalf("round %d: rename of %s: %s, want EEXIST", round, srcs[i], err)
+			}
+		}
+		if winner < 0 {
+			t.Fatalf("round %d: no rename onto %s won", round, dst)
+		}
+		content, err := os.ReadFile(dst)
+		if err != nil || string(content) != srcs[winner] {
+			t.Errorf("round %d: %s holds %q, want the winner %s", round, dst, content, srcs[winner])
+		}
+		for i, src := range srcs {
+			if _, err := os.Stat(src); (i == winner) != os.IsNotExist(err) {
+				t.Errorf("round %d: %s exists %t after rename", round, src, err == nil)
+			}
+		}
+	}
+}
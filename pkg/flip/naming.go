@@ -0,0 +1,195 @@
+package flip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// maxNumbered bounds the search of NumberedName
+const maxNumbered = 10000
+
+// NumberedName is a NameFunc picking the first free origPath.N with N
+// counting from 1, so older archives keep their names
+func NumberedName(origPath string) (string, error) {
+	for n := 1; n <= maxNumbered; n++ {
+		rolledPath := fmt.Sprintf("%s.%d", origPath, n)
+		if _, err := os.Lstat(rolledPath); os.IsNotExist(err) {
+			return rolledPath, nil
+		}
+	}
+	return "", fmt.Errorf("%s.1 to %s.%d all exist", origPath, origPath, maxNumbered)
+}
+
+// numberedPath is the n-th archive of filePath with extension ext
+func numberedPath(filePath string, n int, ext string) string {
+	return fmt.Sprintf("%s.%d%s", filePath, n, ext)
+}
+
+// cascade renames filePath to filePath.1 the way logrotate does,
+// older archives move one number up first. An archive may carry the
+// extension of any codec or ext, as it was compressed or not
+type cascade struct {
+	// ext is the one of archives compressed by Options.CompressCmd
+	ext string
+	// archives top-shifted+1 to top were moved up by shift
+	top, shifted int
+}
+
+// archiveExts are extensions an archive may have, none and extra
+// included
+func archiveExts(extra string) []string {
+	exts := []string{}
+	for _, ext := range codecExts {
+		exts = append(exts, ext)
+	}
+	if extra != "" && containsExt(exts, extra) == false {
+		exts = append(exts, extra)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// variants are the names the n-th archive may have
+func (c *cascade) variants(filePath string, n int) []string {
+	paths := []string{}
+	for _, ext := range archiveExts(c.ext) {
+		paths = append(paths, numberedPath(filePath, n, ext))
+	}
+	return paths
+}
+
+// exists tells if the n-th archive is there under any name
+func (c *cascade) exists(filePath string, n int) bool {
+	for _, path := range c.variants(filePath, n) {
+		if _, err := os.Lstat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// move renames every name of the from-th archive to the to-th one,
+// an existing one is never replaced
+func (c *cascade) move(filePath string, from int, to int, logger log.Logger) error {
+	for _, src := range c.variants(filePath, from) {
+		if _, err := os.Lstat(src); err != nil {
+			continue
+		}
+		dst := strings.TrimPrefix(src, numberedPath(filePath, from, ""))
+		dst = numberedPath(filePath, to, dst)
+		if err := renameExclusive(src, dst, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shift moves archives 1 to N up by one, highest first, where N+1 is
+// the first missing one. Each rename fills the gap the previous one
+// left, so a crash in between loses nothing and the next run carries on
+func (c *cascade) shift(filePath string, logger log.Logger) error {
+	last := 0
+	for c.exists(filePath, last+1) {
+		last++
+		if last == maxNumbered {
+			return fmt.Errorf("%s.1 to %s.%d all exist", filePath, filePath, maxNumbered)
+		}
+	}
+	c.top = last
+	for n := last; n >= 1; n-- {
+		if err := c.move(filePath, n, n+1, logger); err != nil {
+			return err
+		}
+		c.shifted++
+	}
+	if last > 0 {
+		logger.Debug("shifted %s.1 to %s.%d up by one\n", filePath, filePath, last)
+	}
+	return nil
+}
+
+// unshift moves what shift moved back down, lowest first
+func (c *cascade) unshift(filePath string, logger log.Logger) {
+	for n := c.top - c.shifted + 2; n <= c.top+1; n++ {
+		if err := c.move(filePath, n, n-1, logger); err != nil {
+			logger.Error("%s\n", err)
+			return
+		}
+	}
+	c.shifted = 0
+}
+
+// rollover shifts older archives, then renames filePath to the
+// first one, rolledPath
+func (c *cascade) rollover(filePath string, rolledPath string, logger log.Logger) (os.FileMode, error) {
+	if err := c.shift(filePath, logger); err != nil {
+		c.unshift(filePath, logger)
+		return 0, fmt.Errorf("shift archives of %s error: %w", filePath, err)
+	}
+	mode, err := rollover(filePath, rolledPath, logger)
+	if err != nil {
+		c.unshift(filePath, logger)
+		return 0, err
+	}
+	return mode, nil
+}
+
+// rollback is the inverse of rollover, archives move back only once
+// the first one is free again
+func (c *cascade) rollback(filePath string, rolledPath string, logger log.Logger) {
+	rollback(filePath, rolledPath, logger)
+	if c.exists(filePath, 1) {
+		logger.Error("%s still exists, archives are left shifted\n", rolledPath)
+		return
+	}
+	c.unshift(filePath, logger)
+}
+
+// pruneNumbered removes archives of filePath numbered above keep, ext
+// is an extension they may have besides the ones of codecs
+func pruneNumbered(filePath string, keep int, ext string, logger log.Logger) {
+	names, err := ioutil.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		logger.Warn("list archives of %s error: %s\n", filePath, err)
+		return
+	}
+	prefix := filepath.Base(filePath) + "."
+	for _, fInfo := range names {
+		number := strings.TrimPrefix(fInfo.Name(), prefix)
+		if number == fInfo.Name() {
+			continue
+		}
+		for _, archiveExt := range archiveExts(ext) {
+			if archiveExt != "" && strings.HasSuffix(number, archiveExt) {
+				number = strings.TrimSuffix(number, archiveExt)
+				break
+			}
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil || n <= keep || strconv.Itoa(n) != number {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(filePath), fInfo.Name())
+		if err := os.Remove(path); err != nil {
+			logger.Warn("remove old archive %s error: %s\n", path, err)
+			continue
+		}
+		logger.Debug("removed old archive %s\n", path)
+	}
+}
+
+func containsExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
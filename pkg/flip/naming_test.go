@@ -0,0 +1,177 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// archiveDir creates files in a temp directory, each holding its own
+// name, and returns the path of app.log in it
+func archiveDir(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "app.log")
+}
+
+// dirContent maps each file in dir to what it holds
+func dirContent(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]string{}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content[entry.Name()] = string(data)
+	}
+	return content
+}
+
+func TestNumberedName(t *testing.T) {
+	filePath := archiveDir(t, "app.log", "app.log.1", "app.log.2", "app.log.4")
+	rolledPath, err := NumberedName(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filePath + ".3"; rolledPath != want {
+		t.Errorf("picked %s, want %s", rolledPath, want)
+	}
+}
+
+func TestPruneNumbered(t *testing.T) {
+	filePath := archiveDir(t, "app.log", "app.log.1", "app.log.2.gz", "app.log.3",
+		"app.log.4.zst", "app.log.5.xz", "app.log.6.bak", "app.log.07", "app.log.x",
+		"other.log.9")
+	pruneNumbered(filePath, 2, ".xz", testLogger{t})
+
+	var left []string
+	for name := range dirContent(t, filepath.Dir(filePath)) {
+		left = append(left, name)
+	}
+	sort.Strings(left)
+	// an unknown extension or a number not as written is no archive
+	want := []string{"app.log", "app.log.07", "app.log.1", "app.log.2.gz",
+		"app.log.6.bak", "app.log.x", "other.log.9"}
+	if reflect.DeepEqual(left, want) == false {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+func TestCascadeRollover(t *testing.T) {
+	filePath := archiveDir(t, "app.log", "app.log.1", "app.log.2.gz", "app.log.3.xz", "app.log.5")
+	shift := &cascade{ext: ".xz"}
+	if _, err := shift.rollover(filePath, filePath+".1", testLogger{t}); err != nil {
+		t.Fatal(err)
+	}
+	// app.log.5 is past the gap at 4 and stays
+	want := map[string]string{
+		"app.log.1":    "app.log",
+		"app.log.2":    "app.log.1",
+		"app.log.3.gz": "app.log.2.gz",
+		"app.log.4.xz": "app.log.3.xz",
+		"app.log.5":    "app.log.5",
+	}
+	if got := dirContent(t, filepath.Dir(filePath)); reflect.DeepEqual(got, want) == false {
+		t.Errorf("after rollover %v, want %v", got, want)
+	}
+
+	shift.rollback(filePath, filePath+".1", testLogger{t})
+	want = map[string]string{
+		"app.log":      "app.log",
+		"app.log.1":    "app.log.1",
+		"app.log.2.gz": "app.log.2.gz",
+		"app.log.3.xz": "app.log.3.xz",
+		"app.log.5":    "app.log.5",
+	}
+	if got := dirContent(t, filepath.Dir(filePath)); reflect.DeepEqual(got, want) == false {
+		t.Errorf("after rollback %v, want %v", got, want)
+	}
+}
+
+func TestCascadeRolloverFailUnshifts(t *testing.T) {
+	// a missing file can't be rolled, archives moved for it go back
+	filePath := archiveDir(t, "app.log.1", "app.log.2")
+	shift := &cascade{}
+	if _, err := shift.rollover(filePath, filePath+".1", testLogger{t}); err == nil {
+		t.Fatal("rolled over a missing file")
+	}
+	want := map[string]string{"app.log.1": "app.log.1", "app.log.2": "app.log.2"}
+	if got := dirContent(t, filepath.Dir(filePath)); reflect.DeepEqual(got, want) == false {
+		t.Errorf("after failed rollover %v, want %v", got, want)
+	}
+}
+
+// countedNumberedName is NumberedName counting its calls, a flip must
+// ask once and keep the answer
+func countedNumberedName(calls *int) func(string) (string, error) {
+	return func(origPath string) (string, error) {
+		*calls++
+		return NumberedName(origPath)
+	}
+}
+
+func TestFlipNameFunc(t *testing.T) {
+	filePath := archiveDir(t, "app.log", "app.log.1")
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	useFakeTracer(t, &fakeTracer{})
+
+	calls := 0
+	result, err := Flip(os.Getpid(), filePath, Options{NameFunc: countedNumberedName(&calls), Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filePath + ".2"; result.RolledPath != want {
+		t.Errorf("rolled to %s, want %s", result.RolledPath, want)
+	}
+	if calls != 1 {
+		t.Errorf("NameFunc called %d times, want 1", calls)
+	}
+	want := map[string]string{"app.log.1": "app.log.1", "app.log.2": "app.log"}
+	if content := dirContent(t, filepath.Dir(filePath)); reflect.DeepEqual(content, want) == false {
+		t.Errorf("archives %v, want %v", content, want)
+	}
+}
+
+func TestFlipNameFuncRollback(t *testing.T) {
+	filePath := archiveDir(t, "app.log", "app.log.1")
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	useFakeTracer(t, &fakeTracer{fail: func(nr int) error {
+		if nr == syscall.SYS_OPEN {
+			return syscall.ENOSPC
+		}
+		return nil
+	}})
+
+	calls := 0
+	if _, err := Flip(os.Getpid(), filePath, Options{NameFunc: countedNumberedName(&calls), Logger: testLogger{t}}); err == nil {
+		t.Fatal("flip succeeded although open failed")
+	}
+	// rollback moves back what NameFunc picked, not what it would
+	// pick now that app.log.2 exists
+	if calls != 1 {
+		t.Errorf("NameFunc called %d times, want 1", calls)
+	}
+	want := map[string]string{"app.log": "app.log", "app.log.1": "app.log.1"}
+	if content := dirContent(t, filepath.Dir(filePath)); reflect.DeepEqual(content, want) == false {
+		t.Errorf("after rollback %v, want %v", content, want)
+	}
+}
@@ -0,0 +1,110 @@
+package flip
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// Offset is where a writer goes on in the new file
+type Offset int
+
+const (
+	// OffsetEnd seeks the new file to its end, which matters when it
+	// already has content, e.g. in children flipped after the parent.
+	// An O_APPEND writer is left alone
+	OffsetEnd Offset = iota
+	// OffsetAppend gives the new description O_APPEND, so every
+	// write lands at the end whatever the writer did before
+	OffsetAppend
+	// OffsetZero leaves the new file at offset 0, a writer which
+	// isn't O_APPEND overwrites what is there
+	OffsetZero
+	// OffsetKeep seeks the new file to the offset of the old
+	// descriptor, so a writer which isn't O_APPEND goes on at the
+	// same byte position, e.g. into a preallocated file, the gap
+	// before is a hole
+	OffsetKeep
+)
+
+var offsetNames = map[Offset]string{
+	OffsetEnd:    "end",
+	OffsetAppend: "append",
+	OffsetZero:   "zero",
+	OffsetKeep:   "keep",
+}
+
+// ParseOffset looks up offset by name, empty name means OffsetEnd
+func ParseOffset(name string) (Offset, error) {
+	if name == "" {
+		return OffsetEnd, nil
+	}
+	for offset, offsetName := range offsetNames {
+		if offsetName == name {
+			return offset, nil
+		}
+	}
+	return OffsetEnd, fmt.Errorf("unknown offset %q", name)
+}
+
+func (o Offset) String() string {
+	if name, ok := offsetNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("Offset(%d)", int(o))
+}
+
+// Set parses offset name, it makes Offset a flag.Value
+func (o *Offset) Set(name string) error {
+	offset, err := ParseOffset(name)
+	if err != nil {
+		return err
+	}
+	*o = offset
+	return nil
+}
+
+func (o Offset) valid() bool {
+	_, ok := offsetNames[o]
+	return ok
+}
+
+// placeOffset moves tmpFd where offset asks, pos is the offset of the
+// old description and getfl its status flags. An appending writer
+// ignores offset and is left alone
+func placeOffset(trace Tracer, tmpFd int64, offset Offset, pos int64, getfl int64, logger log.Logger) error {
+	if getfl&syscall.O_APPEND != 0 {
+		if offset == OffsetKeep {
+			logger.Debug("fd is O_APPEND, offset %d not kept\n", pos)
+		}
+		return nil
+	}
+	switch offset {
+	case OffsetKeep:
+		return seekTo(trace, tmpFd, pos, logger)
+	case OffsetEnd:
+		if _, err := trace.RemoteSyscall(syscall.SYS_LSEEK, uint64(tmpFd), 0, io.SeekEnd); err != nil {
+			return fmt.Errorf("lseek to end error: %w", err)
+		}
+	}
+	return nil
+}
+
+// seekTo moves tmpFd to pos, the offset of the old description, so
+// writes continue at the same place of the new file
+func seekTo(trace Tracer, tmpFd int64, pos int64, logger log.Logger) error {
+	switch {
+	case pos <= 0:
+		return nil
+	case pos > maxSeek:
+		logger.Warn("offset %d is too large to seek to, new file starts at 0\n", pos)
+		return nil
+	}
+	_, err := trace.RemoteSyscall(syscall.SYS_LSEEK, uint64(tmpFd), uint64(pos), io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("lseek to %d error: %w", pos, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package flip
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestPlaceOffset(t *testing.T) {
+	const appending = syscall.O_WRONLY | syscall.O_APPEND
+	cases := []struct {
+		name   string
+		offset Offset
+		getfl  int64
+		pos    int64
+		// lseeks are the args of each lseek of fd 100
+		lseeks [][]uint64
+	}{
+		{"end", OffsetEnd, syscall.O_WRONLY, 42, [][]uint64{{100, 0, io.SeekEnd}}},
+		{"end appending", OffsetEnd, appending, 42, nil},
+		{"append", OffsetAppend, appending, 42, nil},
+		{"zero", OffsetZero, syscall.O_WRONLY, 42, nil},
+		{"keep", OffsetKeep, syscall.O_WRONLY, 42, [][]uint64{{100, 42, io.SeekStart}}},
+		{"keep at start", OffsetKeep, syscall.O_WRONLY, 0, nil},
+		{"keep appending", OffsetKeep, appending, 42, nil},
+	}
+	for _, c := range cases {
+		fake := &fakeTracer{}
+		if err := placeOffset(fake, 100, c.offset, c.pos, c.getfl, testLogger{t}); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		if lseeks := fake.called(syscall.SYS_LSEEK); reflect.DeepEqual(lseeks, c.lseeks) == false {
+			t.Errorf("%s: lseeks %v, want %v", c.name, lseeks, c.lseeks)
+		}
+		if len(fake.calls) != len(c.lseeks) {
+			t.Errorf("%s: syscalls %v, want only lseeks", c.name, fake.calls)
+		}
+	}
+
+	fake := &fakeTracer{fail: failOn(syscall.SYS_LSEEK, syscall.EINVAL)}
+	if err := placeOffset(fake, 100, OffsetEnd, 0, syscall.O_WRONLY, testLogger{t}); err == nil {
+		t.Error("lseek failure not returned")
+	}
+}
+
+func TestFlipOffsetAppend(t *testing.T) {
+	for _, offset := range []Offset{OffsetEnd, OffsetAppend} {
+		path := openedFile(t, "app.log", "before\n")
+		fake := &fakeTracer{getfl: syscall.O_WRONLY}
+		useFakeTracer(t, fake)
+		if _, err := Flip(os.Getpid(), path, Options{Offset: offset, Logger: testLogger{t}}); err != nil {
+			t.Fatal(err)
+		}
+		opens := fake.called(syscall.SYS_OPEN)
+		if len(opens) != 1 {
+			t.Fatalf("%s: %d opens, want 1", offset, len(opens))
+		}
+		// only append turns a writer at an offset into an appending one
+		if appended := opens[0][1]&syscall.O_APPEND != 0; appended != (offset == OffsetAppend) {
+			t.Errorf("%s: new file opened with O_APPEND %t", offset, appended)
+		}
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	for offset, name := range offsetNames {
+		if parsed, err := ParseOffset(name); err != nil || parsed != offset {
+			t.Errorf("%q parsed as %s %v, want %s", name, parsed, err, offset)
+		}
+	}
+	if offset, err := ParseOffset(""); err != nil || offset != OffsetEnd {
+		t.Errorf("empty name parsed as %s %v, want %s", offset, err, OffsetEnd)
+	}
+	if _, err := ParseOffset("middle"); err == nil {
+		t.Error("unknown offset parsed")
+	}
+}
@@ -0,0 +1,239 @@
+package flip
+
+import (
+	"os"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// Options tweak how a file is flipped, the zero value
+// keeps the default behavior
+type Options struct {
+	// Dest is the exact path the original file is renamed to,
+	// empty means appending rolled suffix to the original path
+	Dest string
+	// Mkdir creates the directory of Dest or of the NameFunc path and
+	// its missing parents, with the mode and owner of the directory of
+	// the original file
+	Mkdir bool
+	// NameFunc gives the path the original file is renamed to when
+	// Dest is empty, e.g. NumberedName. It takes the absolute path we
+	// reach the file at, under /proc/<pid>/root if process has its
+	// own root
+	NameFunc func(origPath string) (rolledPath string, err error)
+	// Numbered renames the file to origPath.1 the way logrotate does,
+	// older archives move one number up first, it can't be used with
+	// Dest or NameFunc
+	Numbered bool
+	// Keep removes numbered archives above Keep after a flip, zero
+	// keeps them all
+	Keep int
+	// TruncateOnly empties the file in place without renaming,
+	// old content is dropped and no archive is produced
+	TruncateOnly bool
+	// RenameOnly renames the file aside and leaves process alone, it
+	// writes to the renamed file until it opens the path again, e.g.
+	// when restarted. It can't be used with TruncateOnly, Tmpfile,
+	// FollowForks or Compress, and the rolled path must be on the same
+	// filesystem
+	RenameOnly bool
+	// Prealloc reserves bytes for the new file with fallocate,
+	// file size stays zero
+	Prealloc int64
+	// Fd is the descriptor to replace when non-zero, it skips
+	// matching opened files against the path
+	Fd int
+	// MatchInode finds descriptors by device and inode number of
+	// the file rather than comparing paths
+	MatchInode bool
+	// AllowLinks flips a file with more than one hard link, the
+	// other links keep referring to the archived content
+	AllowLinks bool
+	// Force goes on past the safety refusals which a flip survives,
+	// a file with other hard links, or a process in a frozen cgroup
+	// whose attach waits until it is thawed. What can't work is still
+	// refused, e.g. a directory, a char device, pipe or socket, a file
+	// on a pseudo filesystem, a process traced by another or a
+	// mismatched one
+	Force bool
+	// Tmpfile creates the new file with O_TMPFILE and links it to the
+	// path right before dup3, so a half prepared file is never visible.
+	// Files are created directly if O_TMPFILE is not supported. The
+	// descriptor keeps showing the unnamed file in /proc, so a later
+	// flip of the same file needs MatchInode
+	Tmpfile bool
+	// FdPolicy decides if descriptors already flipped are put back
+	// when another one of the same file fails, FdBestEffort by default
+	FdPolicy FdPolicy
+	// Swap prepares the new file aside and exchanges it with the
+	// original by renameat2 RENAME_EXCHANGE, so the path never goes
+	// missing for those watching it. Without RENAME_EXCHANGE the file
+	// is renamed as usual. It can't be used with Tmpfile or Numbered
+	Swap bool
+	// Offset is where a writer goes on in the new file, the zero
+	// value OffsetEnd
+	Offset Offset
+	// FollowSymlinks lets the new file be opened through a symlink at
+	// the path, by default the open fails so process never writes to
+	// where a symlink planted during the flip points
+	FollowSymlinks bool
+	// ExactMode applies the mode with fchmod after the new file is
+	// created, mode given to open is masked by umask of process, so a
+	// 0644 file comes back as 0640 if process runs with umask 027
+	ExactMode bool
+	// Mode is the permission of the new file instead of the one of
+	// original file when non-zero, it implies ExactMode
+	Mode os.FileMode
+	// Compress compresses the rolled file after the flip, the codec
+	// extension is appended to the rolled path
+	Compress Codec
+	// CompressCmd compresses the rolled file with an external command
+	// instead, it reads the file on stdin and writes the archive on
+	// stdout. Not to be used with Compress
+	CompressCmd []string
+	// CompressExt is appended to the rolled path of the archive
+	// written by CompressCmd, e.g. .gz
+	CompressExt string
+	// FollowForks also flips the file in descendants of process
+	// which inherited the descriptor, e.g. workers of a daemon
+	FollowForks bool
+	// Retries is attempts on transient ptrace failures,
+	// zero means ptrace.DefaultRetries
+	Retries int
+	// OpTimeout bounds how long process is held for one flip, once
+	// passed the next step fails, what has been done is rolled back and
+	// process is detached. Zero means no bound
+	OpTimeout time.Duration
+	// MaxStopped bounds how long process is stopped in total. The next
+	// step fails if taking as long as the slowest syscall so far would
+	// pass it, and what has been done is rolled back. Zero means no bound
+	MaxStopped time.Duration
+	// KeepAttrs lifts chattr +i and +a of the file, which forbid the
+	// rename, for the flip and puts them back after. The archive gets
+	// both, the new file only +a. Such a file is refused otherwise
+	KeepAttrs bool
+	// StackScratch puts the path and scratch space of a flip below
+	// the stack pointer of process instead of a page mapped for it,
+	// two syscalls fewer. It falls back to the page if the stack has no
+	// room. Not for runtimes keeping stacks of their own threads on the
+	// heap, e.g. goroutines of Go, where the space below may be in use
+	StackScratch bool
+	// ExitKill has kernel kill process if fileflip dies while
+	// attached, process is detached as is otherwise, possibly with a
+	// syscall of ours half done
+	ExitKill bool
+	// NoRollback leaves a failed flip as it is for debugging, the
+	// renamed file is not put back and a created file is kept.
+	// Process is detached all the same
+	NoRollback bool
+	// WaitWritable waits up to this long for the file to exist and be
+	// opened by process before giving up, zero fails at once
+	WaitWritable time.Duration
+	// Lenient treats a file not opened by process as nothing to do
+	// instead of an error
+	Lenient bool
+	// MinSize leaves the file alone if it holds fewer bytes
+	MinSize int64
+	// SkipExisting treats an existing rolled file as rotated already
+	// and does nothing instead of failing
+	SkipExisting bool
+	// Verify checks from /proc once process runs again that every
+	// flipped descriptor opens the new file, or fails with
+	// env.ExitUnverified
+	Verify bool
+	// Fsync flushes the archive and the directories of the rename to
+	// disk before the flip returns, a failure gives env.ExitPartial
+	Fsync bool
+	// PostCmd is a command run after a successful flip with
+	// FILEFLIP_PID, FILEFLIP_PATH and FILEFLIP_ROLLED set
+	PostCmd []string
+	// PostCmdFatal makes a failed PostCmd fail the flip, it is
+	// only warned otherwise
+	PostCmdFatal bool
+	// ExpectComm refuses a process whose comm differs, a guard
+	// against a pid reused since it was read
+	ExpectComm string
+	// ExpectExe refuses a process running another executable, the
+	// path is the one seen by process
+	ExpectExe string
+	// OnResult is called as each file of FlipGlob, FlipStdio or FlipPlan is
+	// done, result may be nil if the flip failed early
+	OnResult func(pid int, filePath string, result *Result, err error)
+	// NoLock skips the lock file which serializes flips of the
+	// same file, see LockTimeout
+	NoLock bool
+	// LockTimeout is how long to wait for another flip of the same
+	// file to finish, zero means waiting until cancelled
+	LockTimeout time.Duration
+	// Logger receives diagnostics of the flip and its ptrace calls,
+	// nil means log.Std printing to stderr
+	Logger log.Logger
+
+	// reopenOnly means the file is already rotated by a previous
+	// flip, only the descriptor is replaced and nothing rolls back
+	reopenOnly bool
+	// sharedFds are descriptors of process sharing the open file
+	// description of Fd, e.g. after 2>&1, they get the new one too
+	sharedFds []int
+	// extraFds are more descriptors of process on the same file
+	// grouped by open file description other than the one of Fd, each
+	// description is opened again after Fd, keeping its own flags
+	extraFds [][]int
+	// procRoot is prefix turning a path seen by process into a
+	// local one, empty if process shares our root
+	procRoot string
+	// held is the tracer FlipPlan keeps heldPid attached with over
+	// several flips, nil if each flip attaches on its own
+	held    Tracer
+	heldPid int
+	// explain is set by Explain, it is also held, syscalls are only
+	// recorded and nothing is renamed or created
+	explain *explainer
+}
+
+// report passes the outcome of a file to OnResult if set
+func (opts Options) report(pid int, filePath string, result *Result, err error) {
+	if opts.OnResult != nil {
+		opts.OnResult(pid, filePath, result, err)
+	}
+}
+
+// logger gives Logger or log.Std if unset
+func (opts Options) logger() log.Logger {
+	if opts.Logger == nil {
+		return log.Std
+	}
+	return opts.Logger
+}
+
+// refuse returns err of a safety guard, unless Force turns it into a
+// warning and nil
+func (opts Options) refuse(err error) error {
+	if opts.Force == false {
+		return err
+	}
+	opts.logger().Warn("FORCE: going on although %s\n", err)
+	return nil
+}
+
+// tracerFor gives the tracer a flip of pid goes through
+func (opts Options) tracerFor(pid int) Tracer {
+	if opts.held != nil && opts.heldPid == pid {
+		return opts.held
+	}
+	return newTracer(pid, opts)
+}
+
+// compressed tells if the rolled file is compressed after the flip
+func (opts Options) compressed() bool {
+	return opts.Compress != CodecNone || len(opts.CompressCmd) > 0
+}
+
+// archiveExt is the extension the rolled file gets once compressed
+func (opts Options) archiveExt() string {
+	if len(opts.CompressCmd) > 0 {
+		return opts.CompressExt
+	}
+	return opts.Compress.Ext()
+}
@@ -0,0 +1,153 @@
+package flip
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// PlanEntry lists files of a process flipped in one attach
+type PlanEntry struct {
+	Pid   int
+	Files []string
+}
+
+// ParsePlan reads a plan of "PID FILE..." lines, blank lines and those
+// starting with # are skipped. Files of a pid given on several lines
+// are merged in order. File names are split by spaces
+func ParsePlan(r io.Reader) ([]PlanEntry, error) {
+	var plan []PlanEntry
+	index := map[int]int{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil || pid <= 1 {
+			return nil, fmt.Errorf("line %d: invalid pid %q", lineNo, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: no file given for pid %d", lineNo, pid)
+		}
+		i, ok := index[pid]
+		if ok == false {
+			i = len(plan)
+			index[pid] = i
+			plan = append(plan, PlanEntry{Pid: pid})
+		}
+		plan[i].Files = append(plan[i].Files, fields[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// FlipPlan flips the files of each process in plan. A process is
+// attached once and held stopped until all its files are flipped, what
+// needs no process, e.g. compressing, is done after it is detached.
+// Each file is passed to OnResult, a failure doesn't stop the others,
+// exit code is ExitPartial then
+func FlipPlan(ctx context.Context, plan []PlanEntry, opts Options) ([]*Result, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	var results []*Result
+	var firstErr error
+	total, failed := 0, 0
+	for _, entry := range plan {
+		entryResults, errs := flipHeld(ctx, entry, opts)
+		for i, filePath := range entry.Files {
+			total++
+			if entryResults[i] != nil {
+				results = append(results, entryResults[i])
+			}
+			opts.report(entry.Pid, filePath, entryResults[i], errs[i])
+			if Skipped(errs[i]) {
+				opts.logger().Info("%s\n", errs[i])
+				continue
+			}
+			if errs[i] != nil {
+				opts.logger().Error("flip %s of pid %d error: %s\n", filePath, entry.Pid, errs[i])
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+				failed++
+			}
+		}
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+	if failed > 0 && failed == total {
+		return results, firstErr
+	}
+	if failed > 0 {
+		return results, newError(env.ExitPartial, "%d of %d files failed to flip", failed, total)
+	}
+	return results, nil
+}
+
+// flipHeld flips files of entry while holding its process, results
+// and errors are in the order of files
+func flipHeld(ctx context.Context, entry PlanEntry, opts Options) ([]*Result, []error) {
+	results := make([]*Result, len(entry.Files))
+	errs := make([]error, len(entry.Files))
+
+	// nothing to hold if process is never attached
+	if opts.RenameOnly {
+		for i, filePath := range entry.Files {
+			results[i], errs[i] = FlipContext(ctx, entry.Pid, filePath, opts)
+		}
+		return results, errs
+	}
+
+	// all ptrace requests must come from the attaching thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	tracer := newTracer(entry.Pid, opts)
+	if err := tracer.Setup(); err != nil {
+		err = explainAttach(entry.Pid, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs
+	}
+	heldOpts := opts
+	heldOpts.held, heldOpts.heldPid = heldTracer{tracer}, entry.Pid
+	starts := make([]time.Time, len(entry.Files))
+	for i, filePath := range entry.Files {
+		starts[i] = time.Now()
+		results[i], errs[i] = FlipContext(ctx, entry.Pid, filePath, heldOpts)
+	}
+	cleanErr := tracer.Cleanup()
+	stopped := tracer.StoppedDuration()
+	opts.logger().Debug("process %d held for %d files, stopped %s\n", entry.Pid, len(entry.Files), stopped)
+
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		result.Stopped = stopped
+		if result.pending == false {
+			continue
+		}
+		result.pending = false
+		if cleanErr != nil && errs[i] == nil {
+			errs[i] = &Error{Code: env.ExitPartial, Err: cleanErr}
+		}
+		errs[i] = finishFlip(ctx, result, starts[i], errs[i], opts)
+	}
+	return results, errs
+}
@@ -0,0 +1,73 @@
+package flip
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePlan(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    []PlanEntry
+		err     bool
+	}{
+		{
+			name:    "one per line",
+			content: "100 /var/log/a.log\n200 /var/log/b.log\n",
+			want:    []PlanEntry{{100, []string{"/var/log/a.log"}}, {200, []string{"/var/log/b.log"}}},
+		},
+		{
+			name:    "several files",
+			content: "100 /var/log/a.log   /var/log/b.log\n",
+			want:    []PlanEntry{{100, []string{"/var/log/a.log", "/var/log/b.log"}}},
+		},
+		{
+			name:    "pid merged in order",
+			content: "100 a.log\n200 b.log\n100 c.log\n",
+			want:    []PlanEntry{{100, []string{"a.log", "c.log"}}, {200, []string{"b.log"}}},
+		},
+		{
+			name:    "comments and blanks",
+			content: "# nginx\n\n  \n\t100 a.log\n  # end\n",
+			want:    []PlanEntry{{100, []string{"a.log"}}},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    nil,
+		},
+		{
+			name:    "bad pid",
+			content: "nginx a.log\n",
+			err:     true,
+		},
+		{
+			name:    "init refused",
+			content: "1 a.log\n",
+			err:     true,
+		},
+		{
+			name:    "no file",
+			content: "100 a.log\n200\n",
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		plan, err := ParsePlan(strings.NewReader(c.content))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: parsed %+v, want an error", c.name, plan)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if reflect.DeepEqual(plan, c.want) == false {
+			t.Errorf("%s: parsed %+v, want %+v", c.name, plan, c.want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package flip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// procfs is where procfs is mounted, every process lookup goes
+// through it
+var procfs = "/proc"
+
+// procSuperMagic is f_type of procfs in statfs
+const procSuperMagic = 0x9fa0
+
+// checkProcfs makes sure procfs is there before a process is looked
+// up, minimal containers and chroots may go without it, then every
+// process would look missing
+func checkProcfs() error {
+	var fsStat syscall.Statfs_t
+	err := syscall.Statfs(procfs, &fsStat)
+	if err == nil && fsStat.Type != procSuperMagic {
+		err = fmt.Errorf("%s is not procfs", procfs)
+	}
+	if err == nil {
+		_, err = os.Stat(procfs + "/self/fd")
+	}
+	if err != nil {
+		return newError(env.ExitNoProcfs, "%s not mounted or unusable, fileflip requires procfs: %s", procfs, err)
+	}
+	return nil
+}
+
+// pseudoFilesystems are f_type of filesystems serving kernel
+// interfaces rather than stored files
+var pseudoFilesystems = map[uint32]string{
+	procSuperMagic: "proc",
+	0x62656572:     "sysfs",
+	0x27e0eb:       "cgroup",
+	0x63677270:     "cgroup2",
+	0x64626720:     "debugfs",
+	0x74726163:     "tracefs",
+	0x73636673:     "securityfs",
+	0x62656570:     "configfs",
+	0x6165676c:     "pstore",
+	0xcafe4a11:     "bpf",
+	0xde5e81e4:     "efivarfs",
+	0x1cd1:         "devpts",
+}
+
+// pseudoFilesystem names the filesystem of path if it is a pseudo one
+func pseudoFilesystem(path string, logger log.Logger) (string, bool) {
+	var fsStat syscall.Statfs_t
+	if err := syscall.Statfs(path, &fsStat); err != nil {
+		logger.Debug("statfs %s error: %s\n", path, err)
+		return "", false
+	}
+	name, ok := pseudoFilesystems[uint32(fsStat.Type)]
+	return name, ok
+}
+
+// processRoot returns /proc/<pid>/root if process has a root other
+// than ours, e.g. it runs in a container with its own mount namespace,
+// or empty if paths mean the same to both of us
+func processRoot(pid int, logger log.Logger) (string, error) {
+	root := fmt.Sprintf("%s/%d/root", procfs, pid)
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", newError(env.ExitNotFound, "process %d not found", pid)
+		}
+		if os.IsPermission(err) {
+			return "", explainAttach(pid, &Error{Code: env.ExitPerm,
+				Err: fmt.Errorf("can't access process %d: %w", pid, err)})
+		}
+		return "", err
+	}
+	ourInfo, err := os.Stat("/")
+	if err != nil {
+		return "", err
+	}
+	// same root directory still shows other mounts in another namespace
+	nsInfo, err := os.Stat(fmt.Sprintf("%s/%d/ns/mnt", procfs, pid))
+	if err != nil {
+		return "", newError(env.ExitPerm, "can't access mount namespace of process %d: %s", pid, err)
+	}
+	ourNsInfo, err := os.Stat(procfs + "/self/ns/mnt")
+	if err != nil {
+		return "", err
+	}
+	if os.SameFile(rootInfo, ourInfo) && os.SameFile(nsInfo, ourNsInfo) {
+		return "", nil
+	}
+	logger.Debug("process %d has its own root, resolve paths under %s\n", pid, root)
+	return root, nil
+}
+
+// localPath makes filePath absolute and reachable by us, a process with
+// its own root takes filePath as path in that root, it can also be
+// given with the /proc/<pid>/root prefix
+func localPath(filePath string, procRoot string) (string, error) {
+	if procRoot == "" {
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			return "", newError(env.ExitArgs, "%s", err)
+		}
+		return absPath, nil
+	}
+	if strings.HasPrefix(filePath, procRoot+"/") {
+		filePath = strings.TrimPrefix(filePath, procRoot)
+	}
+	if filepath.IsAbs(filePath) == false {
+		return "", newError(env.ExitArgs,
+			"path %s must be absolute for a process with its own root", filePath)
+	}
+	return procRoot + filepath.Clean(filePath), nil
+}
+
+// procPath is path of a local file as seen by process
+func (opts Options) procPath(filePath string) string {
+	return strings.TrimPrefix(filePath, opts.procRoot)
+}
+
+// getOpenedFds finds fds of process point to filePath, with MatchInode
+// fds are matched by device and inode number instead of the link text,
+// that works across renames, hard links and bind mounts
+func getOpenedFds(pid int, filePath string, opts Options) ([]int, error) {
+	if opts.MatchInode == false {
+		// links show paths in root of process
+		procPath := opts.procPath(filePath)
+		return findFds(pid, func(fdPath string) bool {
+			openFilePath, err := os.Readlink(fdPath)
+			if err != nil {
+				// fd closed after we list the directory
+				opts.logger().Debug("%s\n", err)
+				return false
+			}
+			return openFilePath == procPath
+		}, opts.logger())
+	}
+
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, newError(env.ExitNotFound, "%s", err)
+	}
+	fileStat := fInfo.Sys().(*syscall.Stat_t)
+	return findFds(pid, func(fdPath string) bool {
+		return sameInode(fdPath, fileStat, opts.logger())
+	}, opts.logger())
+}
+
+// deletedSuffix is appended by kernel to fd link of an unlinked file
+const deletedSuffix = " (deleted)"
+
+// getDeletedFds finds fds of process still opening filePath after
+// it was unlinked
+func getDeletedFds(pid int, filePath string, opts Options) ([]int, error) {
+	procPath := opts.procPath(filePath)
+	return findFds(pid, func(fdPath string) bool {
+		return isDeletedLink(fdPath, procPath, opts.logger())
+	}, opts.logger())
+}
+
+// isDeletedLink tells if fd link points to procPath which is unlinked
+func isDeletedLink(fdPath string, procPath string, logger log.Logger) bool {
+	openFilePath, err := os.Readlink(fdPath)
+	if err != nil {
+		// fd closed after we list the directory
+		logger.Debug("%s\n", err)
+		return false
+	}
+	return openFilePath == procPath+deletedSuffix
+}
+
+// sameInode checks if fd link points to the file of fileStat, stat
+// follows the magic link even if target is unlinked and shown with
+// a " (deleted)" suffix
+func sameInode(fdPath string, fileStat *syscall.Stat_t, logger log.Logger) bool {
+	fdInfo, err := os.Stat(fdPath)
+	if err != nil {
+		// fd closed after we list the directory
+		logger.Debug("%s\n", err)
+		return false
+	}
+	fdStat := fdInfo.Sys().(*syscall.Stat_t)
+	return fdStat.Dev == fileStat.Dev && fdStat.Ino == fileStat.Ino
+}
+
+// findFds returns fds of process whose /proc/<pid>/fd/<n> path
+// is accepted by match
+func findFds(pid int, match func(fdPath string) bool, logger log.Logger) ([]int, error) {
+	procPath := fmt.Sprintf("%s/%d/fd", procfs, pid)
+	matchedFds := []int{}
+
+	dirFile, err := os.Open(procPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newError(env.ExitNotFound, "process %d not found", pid)
+		}
+		if os.IsPermission(err) {
+			return nil, newError(env.ExitPerm, "%s", err)
+		}
+		return nil, err
+	}
+	defer dirFile.Close()
+
+	names, err := dirFile.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		fdPath := fmt.Sprintf("%s/%d/fd/%s", procfs, pid, name)
+		if match(fdPath) {
+			fd, err := strconv.Atoi(name)
+			if err != nil {
+				logger.Error("can't get fd number from %s\n", fdPath)
+				continue
+			}
+			matchedFds = append(matchedFds, fd)
+		}
+	}
+	return matchedFds, nil
+}
+
+// parentPid reads PPid line of /proc/<pid>/status
+func parentPid(pid int) (int, error) {
+	value, err := statusField(pid, "PPid")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// seccompFilter is Seccomp of status when a filter is installed
+const seccompFilter = 2
+
+// seccompMode is Seccomp of process status, 0 means disabled, 1
+// strict and 2 filtered, a kernel without seccomp shows nothing
+func seccompMode(pid int, logger log.Logger) int {
+	value, err := statusField(pid, "Seccomp")
+	if err != nil {
+		logger.Debug("%s\n", err)
+		return 0
+	}
+	mode, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Debug("bad Seccomp %q in status of %d\n", value, pid)
+		return 0
+	}
+	return mode
+}
+
+// statusField reads value of key in /proc/<pid>/status
+func statusField(pid int, key string) (string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/status", procfs, pid))
+	if err != nil {
+		return "", err
+	}
+	value, ok := parseStatusField(string(content), key)
+	if ok == false {
+		return "", fmt.Errorf("no %s in status of %d", key, pid)
+	}
+	return value, nil
+}
+
+// parseStatusField finds "key:\tvalue" line in status content
+func parseStatusField(content string, key string) (string, bool) {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, key+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, key+":")), true
+		}
+	}
+	return "", false
+}
+
+// commLen is the longest comm kernel keeps, longer names are cut
+const commLen = 15
+
+// checkIdentity makes sure pid still runs the expected program, comm
+// is matched as cut by kernel and exe as seen by process, empty ones
+// are not checked
+func checkIdentity(pid int, comm string, exe string) error {
+	if comm != "" {
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/comm", procfs, pid))
+		if err != nil {
+			return newError(env.ExitNotFound, "%s", err)
+		}
+		actual := strings.TrimSuffix(string(content), "\n")
+		if len(comm) > commLen {
+			comm = comm[:commLen]
+		}
+		if actual != comm {
+			return newError(env.ExitMismatch, "process %d is %q, not %q", pid, actual, comm)
+		}
+	}
+	if exe != "" {
+		actual, err := os.Readlink(fmt.Sprintf("%s/%d/exe", procfs, pid))
+		if err != nil {
+			if os.IsPermission(err) {
+				return newError(env.ExitPerm, "%s", err)
+			}
+			return newError(env.ExitNotFound, "%s", err)
+		}
+		// an upgraded binary is still the program asked for
+		actual = strings.TrimSuffix(actual, deletedSuffix)
+		if actual != filepath.Clean(exe) {
+			return newError(env.ExitMismatch, "process %d runs %s, not %s", pid, actual, exe)
+		}
+	}
+	return nil
+}
+
+// descendants lists all processes forked from pid, parents first
+func descendants(pid int, logger log.Logger) []int {
+	names, err := ioutil.ReadDir(procfs)
+	if err != nil {
+		logger.Error("%s\n", err)
+		return nil
+	}
+
+	children := map[int][]int{}
+	for _, fInfo := range names {
+		child, err := strconv.Atoi(fInfo.Name())
+		if err != nil {
+			continue
+		}
+		parent, err := parentPid(child)
+		if err != nil {
+			// exited while we scan
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+
+	result := []int{}
+	queue := children[pid]
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		result = append(result, current)
+		queue = append(queue, children[current]...)
+	}
+	return result
+}
+
+// fileType names the kind of a non-regular file
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return "a character device"
+	case mode&os.ModeNamedPipe != 0:
+		return "a pipe"
+	case mode&os.ModeSocket != 0:
+		return "a socket"
+	case mode.IsDir():
+		return "a directory"
+	}
+	return "a special file"
+}
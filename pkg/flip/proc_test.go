@@ -0,0 +1,399 @@
+package flip
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+func TestFileType(t *testing.T) {
+	cases := []struct {
+		mode os.FileMode
+		want string
+	}{
+		{os.ModeDevice | os.ModeCharDevice | 0666, "a character device"},
+		{os.ModeNamedPipe | 0600, "a pipe"},
+		{os.ModeSocket | 0777, "a socket"},
+		{os.ModeDir | 0755, "a directory"},
+		{os.ModeDevice | 0660, "a special file"},
+	}
+	for _, c := range cases {
+		if got := fileType(c.mode); got != c.want {
+			t.Errorf("mode %s is %q, want %q", c.mode, got, c.want)
+		}
+	}
+}
+
+// checkOwnFd runs checkOpenedFile on fd of the test process
+func checkOwnFd(t *testing.T, f *os.File, opts Options) error {
+	t.Helper()
+	opts.Logger = testLogger{t}
+	return checkOpenedFile(os.Getpid(), int(f.Fd()), f.Name(), opts)
+}
+
+func TestCheckOpenedFileNotRegular(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	defer writer.Close()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	for _, f := range []*os.File{writer, devNull} {
+		err := checkOwnFd(t, f, Options{})
+		if code := ExitCode(err); code != env.ExitRefused {
+			t.Errorf("%s: exit code %d, want %d (%v)", f.Name(), code, env.ExitRefused, err)
+		}
+		// force can't make a regular file of them
+		err = checkOwnFd(t, f, Options{Force: true})
+		if code := ExitCode(err); code != env.ExitRefused {
+			t.Errorf("%s: forced exit code %d, want %d (%v)", f.Name(), code, env.ExitRefused, err)
+		}
+	}
+
+	regular := openedFile(t, "app.log", "")
+	f, err := os.Open(regular)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := checkOwnFd(t, f, Options{}); err != nil {
+		t.Errorf("regular file refused: %s", err)
+	}
+}
+
+func TestParseStatusField(t *testing.T) {
+	content := "Name:\tapp\nState:\tS (sleeping)\nTracerPid:\t0\nCapEff:\t0000000000080000\n"
+	cases := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"Name", "app", true},
+		{"State", "S (sleeping)", true},
+		{"TracerPid", "0", true},
+		{"CapEff", "0000000000080000", true},
+		// a key is matched whole, not as a prefix of another
+		{"Tracer", "", false},
+		{"CapPrm", "", false},
+	}
+	for _, c := range cases {
+		value, ok := parseStatusField(content, c.key)
+		if value != c.value || ok != c.ok {
+			t.Errorf("%s: %q %t, want %q %t", c.key, value, ok, c.value, c.ok)
+		}
+	}
+}
+
+func TestSeccompMode(t *testing.T) {
+	status := "Name:\tapp\nTracerPid:\t0\n"
+	cases := []struct {
+		name   string
+		status string
+		mode   int
+	}{
+		{"disabled", status + "Seccomp:\t0\n", 0},
+		{"strict", status + "Seccomp:\t1\n", 1},
+		{"filter", status + "Seccomp:\t2\nSeccomp_filters:\t3\n", seccompFilter},
+		// a kernel without seccomp
+		{"missing", status, 0},
+		// only Seccomp_filters, which is not Seccomp
+		{"other field", status + "Seccomp_filters:\t2\n", 0},
+		{"bad value", status + "Seccomp:\tfiltered\n", 0},
+		{"empty value", status + "Seccomp:\t\n", 0},
+	}
+	for _, c := range cases {
+		fakeSysfs(t, map[string]string{"proc/42/status": c.status})
+		if mode := seccompMode(42, testLogger{t}); mode != c.mode {
+			t.Errorf("%s: seccomp mode %d, want %d", c.name, mode, c.mode)
+		}
+	}
+	// no status at all
+	fakeSysfs(t, nil)
+	if mode := seccompMode(42, testLogger{t}); mode != 0 {
+		t.Errorf("gone process: seccomp mode %d, want 0", mode)
+	}
+}
+
+func TestCheckIdentity(t *testing.T) {
+	fakeSysfs(t, map[string]string{"proc/100/comm": "a-rather-long-n\n"})
+	if err := os.Symlink("/usr/bin/app (deleted)", filepath.Join(procfs, "100", "exe")); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		comm string
+		exe  string
+		code int
+	}{
+		{"nothing expected", "", "", env.ExitOk},
+		{"comm cut by kernel", "a-rather-long-name", "", env.ExitOk},
+		{"comm as shown", "a-rather-long-n", "", env.ExitOk},
+		{"other comm", "app", "", env.ExitMismatch},
+		{"exe replaced on upgrade", "", "/usr/bin/app", env.ExitOk},
+		{"exe not clean", "", "/usr/bin/../bin/app", env.ExitOk},
+		{"other exe", "", "/usr/bin/other", env.ExitMismatch},
+		{"both", "a-rather-long-name", "/usr/bin/app", env.ExitOk},
+	}
+	for _, c := range cases {
+		err := checkIdentity(100, c.comm, c.exe)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+	}
+	if code := ExitCode(checkIdentity(101, "app", "")); code != env.ExitNotFound {
+		t.Errorf("missing process: exit code %d, want %d", code, env.ExitNotFound)
+	}
+}
+
+func TestPseudoFilesystem(t *testing.T) {
+	cases := []struct {
+		path   string
+		name   string
+		pseudo bool
+	}{
+		{"/proc/self/status", "proc", true},
+		{"/sys/kernel", "sysfs", true},
+		{t.TempDir(), "", false},
+		{"/nonexistent/app.log", "", false},
+	}
+	for _, c := range cases {
+		if _, err := os.Stat(c.path); err != nil && c.pseudo {
+			t.Logf("%s: %s, skipped", c.path, err)
+			continue
+		}
+		name, pseudo := pseudoFilesystem(c.path, testLogger{t})
+		if name != c.name || pseudo != c.pseudo {
+			t.Errorf("%s: %q %t, want %q %t", c.path, name, pseudo, c.name, c.pseudo)
+		}
+	}
+}
+
+func TestCheckOpenedFilePseudo(t *testing.T) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	// force doesn't help, the file can't be flipped at all
+	for _, opts := range []Options{{}, {Force: true}} {
+		err := checkOwnFd(t, f, opts)
+		if code := ExitCode(err); code != env.ExitRefused {
+			t.Errorf("force %t: exit code %d, want %d (%v)", opts.Force, code, env.ExitRefused, err)
+		}
+	}
+}
+
+func TestCheckOpenedFileDirectory(t *testing.T) {
+	dir, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	for _, opts := range []Options{{}, {Force: true}} {
+		err := checkOwnFd(t, dir, opts)
+		if code := ExitCode(err); code != env.ExitIsDir {
+			t.Errorf("force %t: exit code %d, want %d (%v)", opts.Force, code, env.ExitIsDir, err)
+		}
+	}
+}
+
+func TestFlipDirectory(t *testing.T) {
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+	_, err := Flip(os.Getpid(), t.TempDir(), Options{Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitIsDir {
+		t.Errorf("exit code %d, want %d (%v)", code, env.ExitIsDir, err)
+	}
+	if fake.setups != 0 {
+		t.Errorf("attached %d times to flip a directory", fake.setups)
+	}
+}
+
+func TestGetOpenedFdsByInode(t *testing.T) {
+	dir := t.TempDir()
+	opened := filepath.Join(dir, "a.log")
+	fd := ownFd(t, opened)
+	// another name of the inode, the link of fd never shows it
+	alias := filepath.Join(dir, "alias.log")
+	if err := os.Link(opened, alias); err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(dir, "b.log")
+	if err := os.Rename(opened, renamed); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		path    string
+		byInode bool
+		want    []int
+	}{
+		{"old name by path", opened, false, []int{}},
+		{"new name by path", renamed, false, []int{fd}},
+		{"other link by path", alias, false, []int{}},
+		{"new name by inode", renamed, true, []int{fd}},
+		{"other link by inode", alias, true, []int{fd}},
+	}
+	for _, c := range cases {
+		fds, err := getOpenedFds(os.Getpid(), c.path, Options{MatchInode: c.byInode, Logger: testLogger{t}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(fds, c.want) == false {
+			t.Errorf("%s: fds %v, want %v", c.name, fds, c.want)
+		}
+	}
+	if _, err := getOpenedFds(os.Getpid(), opened, Options{MatchInode: true}); ExitCode(err) != env.ExitNotFound {
+		t.Errorf("inode of a missing file: %v, want exit code %d", err, env.ExitNotFound)
+	}
+}
+
+func TestPreflightHardLinks(t *testing.T) {
+	path := openedFile(t, "app.log", "")
+	if err := os.Link(path, path+".link"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		opts Options
+		code int
+	}{
+		{"refused", Options{}, env.ExitRefused},
+		{"allowed", Options{AllowLinks: true}, env.ExitOk},
+		{"forced", Options{Force: true}, env.ExitOk},
+	}
+	for _, c := range cases {
+		c.opts.Logger = testLogger{t}
+		_, fds, _, err := preflightCheck(os.Getpid(), path, c.opts)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+		if err == nil && len(fds) != 1 {
+			t.Errorf("%s: fds %v, want the one opening %s", c.name, fds, path)
+		}
+	}
+}
+
+func TestFlipHardLinkKeepsOldContent(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	link := path + ".link"
+	if err := os.Link(path, link); err != nil {
+		t.Fatal(err)
+	}
+	useFakeTracer(t, &fakeTracer{})
+	result, err := Flip(os.Getpid(), path, Options{AllowLinks: true, Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkInfo, err := os.Stat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolledInfo, err := os.Stat(result.RolledPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(linkInfo, rolledInfo) == false {
+		t.Errorf("%s no longer shares the archived inode of %s", link, result.RolledPath)
+	}
+}
+
+func TestFlipDeletedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	fd := ownFd(t, path)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// the same name unlinked but never opened
+	gone := filepath.Join(dir, "gone.log")
+	if err := os.WriteFile(gone, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	_, fds, deleted, err := preflightCheck(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == false || reflect.DeepEqual(fds, []int{fd}) == false {
+		t.Errorf("deleted %t, fds %v, want deleted fd %d", deleted, fds, fd)
+	}
+	_, _, _, err = preflightCheck(os.Getpid(), gone, Options{Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitNotFound {
+		t.Errorf("unlinked and closed: exit code %d, want %d (%v)", code, env.ExitNotFound, err)
+	}
+
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+	result, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted == false || result.RolledPath != "" {
+		t.Errorf("deleted %t, rolled path %q, want a recreated file and no archive", result.Deleted, result.RolledPath)
+	}
+	if opens := fake.called(syscall.SYS_OPEN); len(opens) != 1 || opens[0][1]&syscall.O_CREAT == 0 {
+		t.Errorf("opens %v, want one creating the file again", opens)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left in %s, nothing to archive", len(entries), dir)
+	}
+}
+
+func TestCheckOpenedFileMinSize(t *testing.T) {
+	path := openedFile(t, "app.log", "0123456789")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		minSize int64
+		code    int
+	}{
+		{0, env.ExitOk},
+		{5, env.ExitOk},
+		{10, env.ExitOk},
+		{11, env.ExitSmall},
+		{1 << 20, env.ExitSmall},
+	}
+	for _, c := range cases {
+		err := checkOwnFd(t, f, Options{MinSize: c.minSize})
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("10 bytes, min size %d: exit code %d, want %d (%v)", c.minSize, code, c.code, err)
+		}
+	}
+	// a flip attaches once for each descriptor
+	f.Close()
+
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+	_, err = Flip(os.Getpid(), path, Options{MinSize: 11, Logger: testLogger{t}})
+	if code := ExitCode(err); code != env.ExitSmall {
+		t.Errorf("flip below threshold: exit code %d, want %d (%v)", code, env.ExitSmall, err)
+	}
+	if fake.setups != 0 {
+		t.Errorf("attached %d times to flip a file below threshold", fake.setups)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "0123456789" {
+		t.Errorf("file below threshold changed: %q %v", content, err)
+	}
+	if _, err := Flip(os.Getpid(), path, Options{MinSize: 10, Logger: testLogger{t}}); err != nil {
+		t.Errorf("flip at threshold: %s", err)
+	}
+	if fake.setups != 1 {
+		t.Errorf("attached %d times to flip a file at threshold, want 1", fake.setups)
+	}
+}
@@ -0,0 +1,98 @@
+package flip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// FlipRegex flips every regular file opened for writing by pid whose
+// fd link, a path in root of process, matches pattern. A file opened by
+// several fds is flipped once. Process is attached once for all of them
+// as a plan, a failed one doesn't stop the rest
+func FlipRegex(ctx context.Context, pid int, pattern string, opts Options) ([]*Result, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newError(env.ExitArgs, "bad regular expression %s: %s", pattern, err)
+	}
+	files, err := regexFiles(pid, re, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		if opts.Lenient {
+			return nil, newError(env.ExitIgn, "no file matching %s opened in process, nothing to do", pattern)
+		}
+		return nil, newError(env.ExitNotOpen, "process %d has no file matching %s open for writing", pid, pattern)
+	}
+	opts.logger().Debug("%d files matching %s opened in process %d: %s\n",
+		len(files), pattern, pid, strings.Join(files, " "))
+	return FlipPlan(ctx, []PlanEntry{{Pid: pid, Files: files}}, opts)
+}
+
+// regexFiles returns fd links of pid matching re. Only
+// regular files opened for writing are taken, a file is listed once
+// however many fds or names it has
+func regexFiles(pid int, re *regexp.Regexp, opts Options) ([]string, error) {
+	logger := opts.logger()
+	type fileID struct {
+		dev uint64
+		ino uint64
+	}
+	seen := map[fileID]bool{}
+	var files []string
+	_, err := findFds(pid, func(fdPath string) bool {
+		target, err := os.Readlink(fdPath)
+		if err != nil {
+			// fd closed after we list the directory
+			logger.Debug("%s\n", err)
+			return false
+		}
+		if strings.HasPrefix(target, "/") == false || re.MatchString(target) == false {
+			return false
+		}
+		if strings.HasSuffix(target, deletedSuffix) {
+			logger.Debug("%s of %s is deleted, skipped\n", target, fdPath)
+			return false
+		}
+		var fdStat syscall.Stat_t
+		if err := syscall.Stat(fdPath, &fdStat); err != nil {
+			logger.Debug("%s\n", err)
+			return false
+		}
+		if fdStat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			logger.Debug("%s of %s is not a regular file, skipped\n", target, fdPath)
+			return false
+		}
+		fd, _ := strconv.Atoi(filepath.Base(fdPath))
+		info, err := readFdInfo(pid, fd)
+		if err != nil {
+			logger.Debug("%s\n", err)
+			return false
+		}
+		if info.Flags&oPath != 0 || info.Flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+			logger.Debug("%s of %s is not opened for writing, skipped\n", target, fdPath)
+			return false
+		}
+		id := fileID{uint64(fdStat.Dev), uint64(fdStat.Ino)}
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+		files = append(files, target)
+		return true
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
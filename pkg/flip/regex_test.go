@@ -0,0 +1,116 @@
+package flip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// regexDir opens files of a temp directory the ways a process holds
+// them, see regexFiles, and returns the directory
+func regexDir(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.log", "d.txt", "e.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(name string, flags int) {
+		fd, err := syscall.Open(filepath.Join(dir, name), flags|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			syscall.Close(fd)
+		})
+	}
+	// a.log is written through two fds and listed once
+	open("a.log", syscall.O_WRONLY|syscall.O_APPEND)
+	open("a.log", syscall.O_WRONLY|syscall.O_APPEND)
+	open("b.log", syscall.O_RDONLY)
+	open("c.log", syscall.O_RDWR)
+	open("d.txt", syscall.O_WRONLY)
+	open("e.log", oPath)
+	if err := os.Mkdir(filepath.Join(dir, "f.log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	open("f.log", syscall.O_RDONLY)
+	return dir
+}
+
+func TestRegexFiles(t *testing.T) {
+	dir := regexDir(t)
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{`\.log$`, []string{"a.log", "c.log"}},
+		{`/[a-c]\.`, []string{"a.log", "c.log"}},
+		{`\.txt$`, []string{"d.txt"}},
+		{`/b\.log$`, nil},
+		{`\.gz$`, nil},
+	}
+	for _, c := range cases {
+		re := regexp.MustCompile(regexp.QuoteMeta(dir) + ".*" + c.pattern)
+		files, err := regexFiles(os.Getpid(), re, Options{Logger: testLogger{t}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file))
+		}
+		sort.Strings(names)
+		if reflect.DeepEqual(names, c.want) == false {
+			t.Errorf("%s: files %v, want %v", c.pattern, names, c.want)
+		}
+	}
+}
+
+func TestFlipRegex(t *testing.T) {
+	dir := regexDir(t)
+	fake := &fakeTracer{}
+	useFakeTracer(t, fake)
+
+	pattern := regexp.QuoteMeta(dir) + `/.*\.log$`
+	results, err := FlipRegex(context.Background(), os.Getpid(), pattern, Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flipped []string
+	for _, result := range results {
+		flipped = append(flipped, filepath.Base(result.Path))
+	}
+	sort.Strings(flipped)
+	if want := []string{"a.log", "c.log"}; reflect.DeepEqual(flipped, want) == false {
+		t.Errorf("flipped %v, want %v", flipped, want)
+	}
+	if fake.setups != 1 || fake.cleanups != 1 {
+		t.Errorf("attached %d and detached %d times, want once for all files", fake.setups, fake.cleanups)
+	}
+
+	cases := []struct {
+		name    string
+		pattern string
+		opts    Options
+		code    int
+	}{
+		{"bad pattern", `(`, Options{}, env.ExitArgs},
+		{"no match", regexp.QuoteMeta(dir) + `/.*\.gz$`, Options{}, env.ExitNotOpen},
+		{"no match, lenient", regexp.QuoteMeta(dir) + `/.*\.gz$`, Options{Lenient: true}, env.ExitIgn},
+	}
+	for _, c := range cases {
+		c.opts.Logger = testLogger{t}
+		_, err := FlipRegex(context.Background(), os.Getpid(), c.pattern, c.opts)
+		if code := ExitCode(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package flip
+
+// renameAside only moves result.Path aside to result.RolledPath, the
+// process is never attached. It keeps writing to the renamed file
+// until it opens the path again, e.g. once restarted or on SIGHUP
+func renameAside(result *Result, opts Options) error {
+	rename := rollover
+	if opts.Swap {
+		rename = swapOver
+	}
+	if opts.Numbered {
+		rename = (&cascade{}).rollover
+	}
+	if opts.explain != nil {
+		rename = opts.explain.rollover
+	}
+	mode, err := rename(result.Path, result.RolledPath, opts.logger())
+	if err != nil {
+		return err
+	}
+	result.Mode = mode
+	// nothing is replaced in process
+	result.Fds = nil
+	result.RenameOnly = true
+	result.BytesRolled = fileSize(result.RolledPath, opts.logger())
+	return nil
+}
@@ -0,0 +1,32 @@
+package flip
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestFlipRenameOnlyNeverAttaches(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	// an attach would fail the flip
+	fake := &fakeTracer{setupErr: fmt.Errorf("attached in rename only mode")}
+	useFakeTracer(t, fake)
+
+	result, err := Flip(os.Getpid(), path, Options{RenameOnly: true, Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.setups != 0 || len(fake.calls) != 0 {
+		t.Errorf("attached %d times and injected %d syscalls", fake.setups, len(fake.calls))
+	}
+	if result.RenameOnly == false || len(result.Fds) != 0 {
+		t.Errorf("rename only %t, fds %v, want no descriptor replaced", result.RenameOnly, result.Fds)
+	}
+	if content, err := os.ReadFile(result.RolledPath); err != nil || string(content) != "before\n" {
+		t.Errorf("file not renamed to %s: %q %v", result.RolledPath, content, err)
+	}
+	// process creates the file again itself
+	if _, err := os.Stat(path); os.IsNotExist(err) == false {
+		t.Errorf("%s created in rename only mode", path)
+	}
+}
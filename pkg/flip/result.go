@@ -0,0 +1,93 @@
+package flip
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Result describes what a flip has done
+type Result struct {
+	// Pid is the target process
+	Pid int `json:"pid"`
+	// Path is the absolute path of the flipped file
+	Path string `json:"path"`
+	// RolledPath is where the old content goes, empty when
+	// the file is truncated in place or was deleted
+	RolledPath string `json:"rolled_path"`
+	// Fds are descriptors replaced in process
+	Fds []int `json:"fds"`
+	// Mode is the permission of the new file
+	Mode os.FileMode `json:"mode"`
+	// BytesRolled is the size of archived file
+	BytesRolled int64 `json:"bytes_rolled"`
+	// CompressedBytes is the size of archived file after compressed
+	CompressedBytes int64 `json:"compressed_bytes,omitempty"`
+	// NewBytes is the size of the live file right after the flip,
+	// what process wrote since then, it is near zero
+	NewBytes int64 `json:"new_bytes"`
+	// Duration is the wall time spent on the flip
+	Duration time.Duration `json:"duration"`
+	// Stopped is how long the process was held stopped
+	Stopped time.Duration `json:"stopped"`
+	// Deleted means the file was unlinked while opened, it is
+	// created again and the old content is gone with the descriptor
+	Deleted bool `json:"deleted,omitempty"`
+	// PostCmdExit is exit status of Options.PostCmd, -1 if it
+	// couldn't run
+	PostCmdExit int `json:"post_cmd_exit,omitempty"`
+	// Children are descendants flipped with FollowForks
+	Children []*Result `json:"children,omitempty"`
+	// RenameOnly means the file was only renamed, process still
+	// writes to RolledPath until it opens Path again
+	RenameOnly bool `json:"rename_only,omitempty"`
+	// FailedFds are descriptors of the file which failed to flip,
+	// they are left on the old file
+	FailedFds []FdFailure `json:"failed_fds,omitempty"`
+
+	// pending means FlipPlan finishes the flip after detach
+	pending bool
+	// replaced means the first descriptor is on the new file
+	replaced bool
+}
+
+// String gives a one-line human summary, and one more line
+// for each child flipped
+func (r *Result) String() string {
+	lines := []string{r.summary()}
+	for _, child := range r.Children {
+		lines = append(lines, fmt.Sprintf("  reopened in child pid %d (fd %s), took %s, stopped %s",
+			child.Pid, child.fdList(), child.Duration, child.Stopped))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *Result) fdList() string {
+	fds := make([]string, len(r.Fds))
+	for i, fd := range r.Fds {
+		fds[i] = fmt.Sprintf("%d", fd)
+	}
+	return strings.Join(fds, ",")
+}
+
+func (r *Result) summary() string {
+	if r.Deleted {
+		return fmt.Sprintf("recreated deleted %s (fd %s) of pid %d, old content is gone, took %s, stopped %s",
+			r.Path, r.fdList(), r.Pid, r.Duration, r.Stopped)
+	}
+	if r.RenameOnly {
+		return fmt.Sprintf("renamed %s of pid %d to %s, %d bytes so far, pid %d still writes to %s until it reopens %s, took %s",
+			r.Path, r.Pid, r.RolledPath, r.BytesRolled, r.Pid, r.RolledPath, r.Path, r.Duration)
+	}
+	if r.RolledPath == "" {
+		return fmt.Sprintf("truncated %s (fd %s) of pid %d in place, no archive produced, took %s, stopped %s",
+			r.Path, r.fdList(), r.Pid, r.Duration, r.Stopped)
+	}
+	if r.CompressedBytes > 0 {
+		return fmt.Sprintf("flipped %s (fd %s) of pid %d, %d bytes rolled to %s compressed to %d bytes, took %s, stopped %s",
+			r.Path, r.fdList(), r.Pid, r.BytesRolled, r.RolledPath, r.CompressedBytes, r.Duration, r.Stopped)
+	}
+	return fmt.Sprintf("flipped %s (fd %s) of pid %d, %d bytes rolled to %s, took %s, stopped %s",
+		r.Path, r.fdList(), r.Pid, r.BytesRolled, r.RolledPath, r.Duration, r.Stopped)
+}
@@ -0,0 +1,72 @@
+package flip
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// stackAlign is the alignment of the scratch space taken on the stack
+const stackAlign = 16
+
+// stackScratch finds size bytes on the stack of process below its
+// stack pointer and red zone. Process is stopped in a syscall, so
+// nothing of it lives there and no page has to be mapped for the path.
+// False if the bytes are not all in the mapping of the stack pointer,
+// e.g. close to the end of a thread stack
+func stackScratch(trace Tracer, pid int, size int, logger log.Logger) (uintptr, bool) {
+	sp, err := trace.StackPointer()
+	if err != nil {
+		logger.Debug("read stack pointer error: %s\n", err)
+		return 0, false
+	}
+	if sp < uintptr(stackRedZone+size) {
+		return 0, false
+	}
+	addr := (sp - stackRedZone - uintptr(size)) &^ (stackAlign - 1)
+	start, err := mappingStart(pid, sp-1)
+	if err != nil {
+		logger.Debug("find stack mapping error: %s\n", err)
+		return 0, false
+	}
+	if addr < start {
+		logger.Debug("only %d bytes of stack below %#x, %d needed\n", sp-start, sp, sp-addr)
+		return 0, false
+	}
+	return addr, true
+}
+
+// mappingStart is where the mapping of pid holding addr starts, read
+// from /proc/<pid>/maps
+func mappingStart(pid int, addr uintptr) (uintptr, error) {
+	f, err := os.Open(fmt.Sprintf("%s/%d/maps", procfs, pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		bounds := strings.Fields(scanner.Text())[0]
+		i := strings.IndexByte(bounds, '-')
+		if i < 0 {
+			continue
+		}
+		start, err1 := strconv.ParseUint(bounds[:i], 16, 64)
+		end, err2 := strconv.ParseUint(bounds[i+1:], 16, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if uint64(addr) >= start && uint64(addr) < end {
+			return uintptr(start), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no mapping holds %#x", addr)
+}
@@ -0,0 +1,132 @@
+package flip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// stdioFds are standard output and error of process
+var stdioFds = []int{1, 2}
+
+// stdioFile is a file some standard descriptors are redirected to
+type stdioFile struct {
+	path string
+	info os.FileInfo
+	fds  []int
+}
+
+// FlipStdio flips the files standard output and error of pid are
+// redirected to, e.g. a daemon started as "app > app.log 2>&1".
+// Descriptors which are not regular files are skipped, and both are
+// flipped together if they share a file
+func FlipStdio(ctx context.Context, pid int, opts Options) ([]*Result, error) {
+	if err := checkProcfs(); err != nil {
+		return nil, err
+	}
+	files, err := stdioFiles(pid, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, newError(env.ExitIgn, "no standard output or error of process %d is a regular file, nothing to do", pid)
+	}
+
+	var results []*Result
+	for _, file := range files {
+		fileOpts := opts
+		fileOpts.Fd = file.fds[0]
+		fileOpts.sharedFds, fileOpts.extraFds = groupFds(pid, file.fds, opts.logger())
+		result, err := FlipContext(ctx, pid, file.path, fileOpts)
+		if result != nil {
+			results = append(results, result)
+		}
+		opts.report(pid, file.path, result, err)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// stdioFiles groups standard descriptors of pid by the regular file
+// they point to
+func stdioFiles(pid int, logger log.Logger) ([]*stdioFile, error) {
+	var files []*stdioFile
+next:
+	for _, fd := range stdioFds {
+		fdPath := fmt.Sprintf("%s/%d/fd/%d", procfs, pid, fd)
+		info, err := os.Stat(fdPath)
+		if os.IsPermission(err) {
+			return nil, newError(env.ExitPerm, "%s", err)
+		}
+		if err != nil {
+			logger.Info("fd %d of process %d is not opened, skipped\n", fd, pid)
+			continue
+		}
+		if info.Mode().IsRegular() == false {
+			logger.Info("fd %d of process %d is not a regular file but %s, skipped\n", fd, pid, fileType(info.Mode()))
+			continue
+		}
+		for _, file := range files {
+			if os.SameFile(file.info, info) {
+				file.fds = append(file.fds, fd)
+				continue next
+			}
+		}
+		path, err := os.Readlink(fdPath)
+		if err != nil {
+			return nil, newError(env.ExitNotFound, "%s", err)
+		}
+		files = append(files, &stdioFile{
+			path: strings.TrimSuffix(path, deletedSuffix),
+			info: info,
+			fds:  []int{fd},
+		})
+	}
+	return files, nil
+}
+
+// kcmpFile is the kcmp type comparing open file descriptions
+const kcmpFile = 0
+
+// sameDescription tells if fd1 and fd2 of pid share one open file
+// description, i.e. one is dup'ed from the other. Without kcmp they
+// are taken as separate
+func sameDescription(pid int, fd1 int, fd2 int, logger log.Logger) bool {
+	ret, _, errno := syscall.Syscall6(sysKcmp,
+		uintptr(pid), uintptr(pid), kcmpFile, uintptr(fd1), uintptr(fd2), 0)
+	if errno != 0 {
+		logger.Debug("kcmp fd %d and %d of process %d error: %s\n", fd1, fd2, pid, errno)
+		return false
+	}
+	return ret == 0
+}
+
+// groupFds sorts fds[1:] of pid by open file description. Those sharing
+// the one of fds[0] are shared, the others are grouped by their own
+// description, which the first of a group stands for
+func groupFds(pid int, fds []int, logger log.Logger) ([]int, [][]int) {
+	var shared []int
+	var extra [][]int
+next:
+	for _, fd := range fds[1:] {
+		if sameDescription(pid, fds[0], fd, logger) {
+			shared = append(shared, fd)
+			continue
+		}
+		for i, group := range extra {
+			if sameDescription(pid, group[0], fd, logger) {
+				extra[i] = append(group, fd)
+				continue next
+			}
+		}
+		extra = append(extra, []int{fd})
+	}
+	return shared, extra
+}
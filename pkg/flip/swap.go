@@ -0,0 +1,102 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// renameExchange is RENAME_EXCHANGE flag of renameat2
+const renameExchange = 2
+
+// swapSuffix is appended to the flipped file for the new file until
+// it is exchanged with the original
+const swapSuffix = ".flip-swap"
+
+// noExchange is set when kernel or filesystem lacks RENAME_EXCHANGE
+var noExchange bool
+
+// swapOver replaces filePath with an empty file in one renameat2
+// RENAME_EXCHANGE, the original ends up at rolledPath, so the path
+// never goes missing. It falls back to rollover without RENAME_EXCHANGE
+func swapOver(filePath string, rolledPath string, logger log.Logger) (os.FileMode, error) {
+	if noExchange {
+		return rollover(filePath, rolledPath, logger)
+	}
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0, newError(env.ExitNotFound, "%s", err)
+	}
+	if _, err := os.Lstat(rolledPath); err == nil {
+		return 0, fmt.Errorf("file %s already exsits", rolledPath)
+	}
+
+	swapPath := filePath + swapSuffix
+	if err := createLike(swapPath, fInfo); err != nil {
+		return 0, err
+	}
+	err = renameat2(swapPath, filePath, renameExchange)
+	if err == syscall.ENOSYS || err == syscall.EINVAL {
+		logger.Debug("renameat2 RENAME_EXCHANGE not supported, rename instead\n")
+		noExchange = true
+		os.Remove(swapPath)
+		return rollover(filePath, rolledPath, logger)
+	}
+	if err != nil {
+		os.Remove(swapPath)
+		return 0, err
+	}
+
+	// swapPath now holds the original
+	if err := renameExclusive(swapPath, rolledPath, logger); err != nil {
+		if undoErr := renameat2(swapPath, filePath, renameExchange); undoErr != nil {
+			logger.Error("swap %s back error: %s, original is left at %s\n", filePath, undoErr, swapPath)
+			return 0, err
+		}
+		os.Remove(swapPath)
+		if errors.Is(err, syscall.EEXIST) {
+			return 0, fmt.Errorf("file %s already exsits", rolledPath)
+		}
+		return 0, err
+	}
+	return fInfo.Mode(), nil
+}
+
+// swapBack is the inverse of swapOver, the original is exchanged
+// back and the new file dropped if nothing was written to it
+func swapBack(filePath string, rolledPath string, logger log.Logger) {
+	if _, err := os.Lstat(filePath); err != nil {
+		rollback(filePath, rolledPath, logger)
+		return
+	}
+	if err := renameat2(rolledPath, filePath, renameExchange); err != nil {
+		logger.Error("%s\n", err)
+		return
+	}
+	discardCreated(rolledPath, logger)
+}
+
+// createLike creates an empty path with the permission and owner of
+// original, as the process never opens it with O_CREAT
+func createLike(path string, original os.FileInfo) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat := original.Sys().(*syscall.Stat_t)
+	err = file.Chown(int(stat.Uid), int(stat.Gid))
+	if err == nil {
+		// chmod after chown, which clears setuid and setgid bits
+		err = file.Chmod(original.Mode())
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("prepare %s error: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package flip
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlipSwapPathNeverAbsent(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	var missing, checks int32
+	// every injected syscall sees the path
+	fake := &fakeTracer{fail: func(nr int) error {
+		atomic.AddInt32(&checks, 1)
+		if _, err := os.Lstat(path); err != nil {
+			atomic.AddInt32(&missing, 1)
+		}
+		return nil
+	}}
+	useFakeTracer(t, fake)
+	// and so does a watcher in between
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			atomic.AddInt32(&checks, 1)
+			if _, err := os.Lstat(path); err != nil {
+				atomic.AddInt32(&missing, 1)
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		// the fake never reopens, hold the new file as process would
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Flip(os.Getpid(), path, Options{Swap: true, Logger: testLogger{t}})
+		if err == nil {
+			err = os.Remove(result.RolledPath)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if missing > 0 {
+		t.Errorf("path missing %d times out of %d checks", missing, checks)
+	}
+}
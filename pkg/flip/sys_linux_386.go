@@ -0,0 +1,69 @@
+// +build linux,386
+
+package flip
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"math"
+	"syscall"
+)
+
+const (
+	// old mmap takes a pointer to argument struct, mmap2 takes
+	// arguments in registers with offset counted in pages
+	sysMmap  = syscall.SYS_MMAP2
+	sysFcntl = syscall.SYS_FCNTL64
+	// syscall package has no kcmp and renameat2
+	sysKcmp      = 349
+	sysRenameat2 = 353
+)
+
+// traceeClass is the only ELF class we can inject syscalls into
+const traceeClass = elf.ELFCLASS32
+
+// supportedMachines lists uname machine names this build works on,
+// a 32-bit build also runs on x86_64 kernels with ia32 emulation
+var supportedMachines = []string{"i386", "i486", "i586", "i686", "x86_64"}
+
+// fallocateArgs build fallocate(fd, mode, offset, len) arguments
+// with offset fixed to zero, 64-bit offset and len are split
+// into low and high words on 32-bit
+func fallocateArgs(fd int64, mode int, size int64) []uint64 {
+	return []uint64{
+		uint64(fd), uint64(mode),
+		0, 0,
+		uint64(uint32(size)), uint64(uint32(size >> 32))}
+}
+
+// maxSeek is the largest offset lseek takes, off_t is 32 bits
+// and _llseek would need a result buffer in child
+const maxSeek = math.MaxInt32
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, sized for a long though the
+// kernel moves an int
+const (
+	fsIocGetflags = 0x80046601
+	fsIocSetflags = 0x40046602
+)
+
+// stackRedZone is zero, the i386 ABI has no red zone below esp
+const stackRedZone = 0
+
+// fSetlk is F_SETLK64 so fcntl64 takes struct flock64
+const (
+	fSetlk     = syscall.F_SETLK64
+	fSetlkName = "F_SETLK64"
+)
+
+// flockBytes lays out struct flock64, which has 4-byte aligned 64-bit
+// fields on 386, the kernel ignores l_pid
+func flockBytes(lockType int16, start int64, length int64) []byte {
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint16(buf[0:], uint16(lockType))
+	binary.LittleEndian.PutUint16(buf[2:], io.SeekStart)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(start))
+	binary.LittleEndian.PutUint64(buf[12:], uint64(length))
+	return buf
+}
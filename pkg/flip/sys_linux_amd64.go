@@ -0,0 +1,61 @@
+// +build linux,amd64
+
+package flip
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"math"
+	"syscall"
+)
+
+const (
+	sysMmap  = syscall.SYS_MMAP
+	sysFcntl = syscall.SYS_FCNTL
+	// syscall package has no kcmp and renameat2
+	sysKcmp      = 312
+	sysRenameat2 = 316
+)
+
+// traceeClass is the only ELF class we can inject syscalls into
+const traceeClass = elf.ELFCLASS64
+
+// supportedMachines lists uname machine names this build works on
+var supportedMachines = []string{"x86_64"}
+
+// fallocateArgs build fallocate(fd, mode, offset, len) arguments
+// with offset fixed to zero
+func fallocateArgs(fd int64, mode int, size int64) []uint64 {
+	return []uint64{uint64(fd), uint64(mode), 0, uint64(size)}
+}
+
+// maxSeek is the largest offset lseek takes
+const maxSeek = math.MaxInt64
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, sized for a long though the
+// kernel moves an int
+const (
+	fsIocGetflags = 0x80086601
+	fsIocSetflags = 0x40086602
+)
+
+// stackRedZone is what a leaf function may use below rsp without
+// moving it, the x86-64 ABI keeps signal handlers out of it
+const stackRedZone = 128
+
+// fSetlk sets a POSIX lock described by flockBytes
+const (
+	fSetlk     = syscall.F_SETLK
+	fSetlkName = "F_SETLK"
+)
+
+// flockBytes lays out struct flock, the kernel ignores l_pid
+func flockBytes(lockType int16, start int64, length int64) []byte {
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint16(buf[0:], uint16(lockType))
+	binary.LittleEndian.PutUint16(buf[2:], io.SeekStart)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(start))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(length))
+	return buf
+}
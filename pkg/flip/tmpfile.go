@@ -0,0 +1,77 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// O_TMPFILE includes O_DIRECTORY, kernels not knowing it open the directory
+	oTmpfile        = 020200000
+	atFdcwd         = -100
+	atSymlinkFollow = 0x400
+)
+
+// errNoTmpfile means O_TMPFILE can't be used and caller should create
+// the file directly
+var errNoTmpfile = errors.New("O_TMPFILE not available")
+
+// openTmpfile creates an unnamed file in directory of filePath in child,
+// the directory name is written at bufAddr which has bufSize bytes free
+func openTmpfile(trace Tracer, bufAddr uintptr, bufSize int,
+	filePath string, flag int64, mode os.FileMode) (int64, error) {
+	dirBytes := append([]byte(filepath.Dir(filePath)), 0)
+	if len(dirBytes) > bufSize {
+		return -1, errNoTmpfile
+	}
+	// O_TMPFILE requires write access
+	if flag&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return -1, errNoTmpfile
+	}
+
+	if err := trace.RemoteMemcp(dirBytes, bufAddr, len(dirBytes)); err != nil {
+		return -1, fmt.Errorf("memcp error: %w", err)
+	}
+	tmpFd, err := trace.RemoteSyscall(
+		syscall.SYS_OPEN,
+		uint64(bufAddr),
+		uint64(flag&^syscall.O_CREAT|oTmpfile),
+		uint64(mode))
+	switch {
+	case err == nil:
+		return tmpFd, nil
+	case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.EISDIR), errors.Is(err, syscall.EINVAL):
+		// filesystem or kernel without O_TMPFILE
+		return -1, errNoTmpfile
+	}
+	return -1, fmt.Errorf("open O_TMPFILE error: %w", err)
+}
+
+// linkTmpfile gives the unnamed file tmpFd the name at pathAddr,
+// /proc/self/fd/N of child is written at bufAddr
+func linkTmpfile(trace Tracer, bufAddr uintptr, bufSize int,
+	pathAddr uintptr, tmpFd int64) error {
+	procBytes := append([]byte(fmt.Sprintf("/proc/self/fd/%d", tmpFd)), 0)
+	if len(procBytes) > bufSize {
+		return fmt.Errorf("no room for %s in child buffer", procBytes)
+	}
+	if err := trace.RemoteMemcp(procBytes, bufAddr, len(procBytes)); err != nil {
+		return fmt.Errorf("memcp error: %w", err)
+	}
+
+	fdcwd := int64(atFdcwd)
+	_, err := trace.RemoteSyscall(
+		syscall.SYS_LINKAT,
+		uint64(fdcwd),
+		uint64(bufAddr),
+		uint64(fdcwd),
+		uint64(pathAddr),
+		atSymlinkFollow)
+	if err != nil {
+		return fmt.Errorf("linkat error: %w", err)
+	}
+	return nil
+}
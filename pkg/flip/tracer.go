@@ -0,0 +1,106 @@
+package flip
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+// Tracer controls target process and invokes syscalls on its behalf,
+// ptrace.Child is the real one
+type Tracer interface {
+	Setup() error
+	Cleanup() error
+	RemoteMemcp(src []byte, addr uintptr, size int) error
+	RemotePeek(addr uintptr, size int) ([]byte, error)
+	RemoteSyscall(nr int, args ...uint64) (int64, error)
+	StackPointer() (uintptr, error)
+	StoppedDuration() time.Duration
+}
+
+// newTracer can be replaced to drive a flip without a live process
+var newTracer = func(pid int, opts Options) Tracer {
+	child := ptrace.NewChild(pid)
+	if opts.Retries > 0 {
+		child.Retries = opts.Retries
+	}
+	child.ExitKill = opts.ExitKill
+	child.Log = opts.logger()
+	return child
+}
+
+// heldTracer is a tracer kept attached over several flips, Setup and
+// Cleanup of each flip leave it as it is, the owner attaches and
+// detaches it once
+type heldTracer struct {
+	Tracer
+}
+
+func (heldTracer) Setup() error {
+	return nil
+}
+
+func (heldTracer) Cleanup() error {
+	return nil
+}
+
+// interruptible fails every injected syscall once ctx is done,
+// so flip takes its error path at the next step
+type interruptible struct {
+	Tracer
+	ctx context.Context
+	// timeout is the error once OpTimeout passed
+	timeout error
+	// maxStopped is MaxStopped, slowest the longest injected syscall
+	// so far which the next one is expected to take
+	maxStopped time.Duration
+	slowest    *time.Duration
+}
+
+// newInterruptible wraps tracer, with opts.OpTimeout ctx is also done
+// once the timeout passes, the timer starts here right before Setup
+func newInterruptible(ctx context.Context, tracer Tracer, opts Options) (interruptible, context.CancelFunc) {
+	t := interruptible{Tracer: tracer, ctx: ctx, maxStopped: opts.MaxStopped, slowest: new(time.Duration)}
+	if opts.OpTimeout <= 0 {
+		return t, func() {}
+	}
+	t.timeout = fmt.Errorf("flip held process longer than %s, aborted", opts.OpTimeout)
+	ctx, cancel := context.WithTimeoutCause(ctx, opts.OpTimeout, t.timeout)
+	t.ctx = ctx
+	return t, cancel
+}
+
+// err tells why ctx is done, a deadline is also checked by clock as
+// its timer may not fire yet while we keep the thread busy
+func (t interruptible) err() error {
+	if t.ctx.Err() != nil {
+		return context.Cause(t.ctx)
+	}
+	if deadline, ok := t.ctx.Deadline(); ok && time.Now().After(deadline) {
+		if t.timeout != nil {
+			return t.timeout
+		}
+		return context.DeadlineExceeded
+	}
+	// the process is stopped from attach on, over several flips too
+	// when FlipPlan holds it
+	if stopped := t.Tracer.StoppedDuration(); t.maxStopped > 0 && stopped+*t.slowest > t.maxStopped {
+		return fmt.Errorf("process stopped %s, one more syscall taking %s would pass %s, aborted",
+			stopped, *t.slowest, t.maxStopped)
+	}
+	return nil
+}
+
+func (t interruptible) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	if err := t.err(); err != nil {
+		return -1, err
+	}
+	start := time.Now()
+	ret, err := t.Tracer.RemoteSyscall(nr, args...)
+	if took := time.Since(start); took > *t.slowest {
+		*t.slowest = took
+	}
+	return ret, err
+}
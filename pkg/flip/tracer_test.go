@@ -0,0 +1,459 @@
+package flip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/ptrace"
+)
+
+// fakeTracer answers injected syscalls without a process, so a flip
+// of a file held by the test itself runs every step but the dup3 for
+// real. getfl is the F_GETFL result, O_WRONLY|O_APPEND if zero.
+// setupErr fails the attach. fail, if set, is asked before each syscall and can make it
+// fail or panic. Each syscall is recorded in calls with its args, and
+// each copy to process memory in copies
+type fakeTracer struct {
+	getfl    int64
+	setupErr error
+	fail     func(nr int) error
+	setups   int
+	cleanups int
+	calls    []int
+	args     [][]uint64
+	copies   []fakeCopy
+	// attached is when Setup was called, process counts as stopped
+	// since then
+	attached time.Time
+}
+
+// fakeCopy is a RemoteMemcp of size bytes of data to addr
+type fakeCopy struct {
+	addr uintptr
+	data []byte
+	size int
+}
+
+func (f *fakeTracer) Setup() error {
+	f.setups++
+	f.attached = time.Now()
+	return f.setupErr
+}
+
+func (f *fakeTracer) Cleanup() error {
+	f.cleanups++
+	return nil
+}
+
+func (f *fakeTracer) RemoteMemcp(src []byte, addr uintptr, size int) error {
+	f.copies = append(f.copies, fakeCopy{addr, append([]byte(nil), src...), size})
+	return nil
+}
+
+func (f *fakeTracer) RemotePeek(addr uintptr, size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func (f *fakeTracer) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	f.calls = append(f.calls, nr)
+	f.args = append(f.args, args)
+	if f.fail != nil {
+		if err := f.fail(nr); err != nil {
+			return -1, err
+		}
+	}
+	switch {
+	case nr == sysFcntl && args[1] == syscall.F_GETFL && f.getfl != 0:
+		return f.getfl, nil
+	case nr == sysFcntl && args[1] == syscall.F_GETFL:
+		return syscall.O_WRONLY | syscall.O_APPEND, nil
+	case nr == sysMmap:
+		return 0x10000, nil
+	case nr == syscall.SYS_OPEN:
+		return 100, nil
+	}
+	return 0, nil
+}
+
+func (f *fakeTracer) StackPointer() (uintptr, error) {
+	return 0, fmt.Errorf("no stack in fake tracer")
+}
+
+func (f *fakeTracer) StoppedDuration() time.Duration {
+	if f.attached.IsZero() {
+		return 0
+	}
+	return time.Since(f.attached)
+}
+
+// called returns args of each call of syscall nr
+func (f *fakeTracer) called(nr int) [][]uint64 {
+	var calls [][]uint64
+	for i, called := range f.calls {
+		if called == nr {
+			calls = append(calls, f.args[i])
+		}
+	}
+	return calls
+}
+
+// useFakeTracer makes flips of the test go through fake
+func useFakeTracer(t *testing.T, fake *fakeTracer) {
+	saved := newTracer
+	newTracer = func(int, Options) Tracer {
+		return fake
+	}
+	t.Cleanup(func() {
+		newTracer = saved
+	})
+}
+
+// testLogger sends diagnostics of a flip to the test log
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Debug(format string, v ...interface{}) { l.t.Logf("debug: "+format, v...) }
+func (l testLogger) Info(format string, v ...interface{})  { l.t.Logf("info: "+format, v...) }
+func (l testLogger) Warn(format string, v ...interface{})  { l.t.Logf("warn: "+format, v...) }
+func (l testLogger) Error(format string, v ...interface{}) { l.t.Logf("error: "+format, v...) }
+
+// openedFile creates a file holding content in a temp directory and
+// keeps it open for appending until the test ends
+func openedFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+	})
+	return path
+}
+
+func TestFlipProcessGoneRollsBack(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	rolledPath := path + rolledSuffix
+	renamed := false
+	fake := &fakeTracer{fail: func(nr int) error {
+		// process quits once the file is renamed aside
+		if _, err := os.Stat(rolledPath); err == nil {
+			renamed = true
+			return ptrace.ErrProcessGone
+		}
+		return nil
+	}}
+	useFakeTracer(t, fake)
+
+	_, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err == nil {
+		t.Fatal("flip succeeded although process is gone")
+	}
+	if renamed == false {
+		t.Fatalf("flip failed before renaming: %s", err)
+	}
+	if code := ExitCode(err); code != env.ExitGone {
+		t.Errorf("exit code is %d, want %d (%s)", code, env.ExitGone, err)
+	}
+	content, readErr := os.ReadFile(path)
+	if readErr != nil || string(content) != "before\n" {
+		t.Errorf("original not put back at %s: %q %v", path, content, readErr)
+	}
+	if _, statErr := os.Stat(rolledPath); os.IsNotExist(statErr) == false {
+		t.Errorf("%s is left behind after rollback", rolledPath)
+	}
+	if fake.cleanups != 1 {
+		t.Errorf("tracer cleaned up %d times, want 1", fake.cleanups)
+	}
+}
+
+func TestFlipPanicStillCleansUp(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	rolledPath := path + rolledSuffix
+	fake := &fakeTracer{fail: func(nr int) error {
+		if _, err := os.Stat(rolledPath); err == nil {
+			panic("tracer broke")
+		}
+		return nil
+	}}
+	useFakeTracer(t, fake)
+
+	_, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if err == nil {
+		t.Fatal("flip succeeded although tracer panicked")
+	}
+	if fake.cleanups != 1 {
+		t.Errorf("tracer cleaned up %d times after panic, want 1", fake.cleanups)
+	}
+	content, readErr := os.ReadFile(path)
+	if readErr != nil || string(content) != "before\n" {
+		t.Errorf("original not put back at %s: %q %v", path, content, readErr)
+	}
+}
+
+func TestFlipPanicUnmaps(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	fake := &fakeTracer{fail: func(nr int) error {
+		if nr == syscall.SYS_OPEN {
+			panic("tracer broke")
+		}
+		return nil
+	}}
+	useFakeTracer(t, fake)
+
+	if _, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}}); err == nil {
+		t.Fatal("flip succeeded although tracer panicked")
+	}
+	mmaps, munmaps := fake.called(sysMmap), fake.called(syscall.SYS_MUNMAP)
+	if len(mmaps) != 1 || len(munmaps) != 1 {
+		t.Fatalf("%d mmap and %d munmap, want one each", len(mmaps), len(munmaps))
+	}
+	if munmaps[0][0] != 0x10000 || munmaps[0][1] != mmaps[0][1] {
+		t.Errorf("munmap(%#x, %d) after mmap of %d bytes at %#x", munmaps[0][0], munmaps[0][1], mmaps[0][1], 0x10000)
+	}
+	if fake.cleanups != 1 {
+		t.Errorf("tracer cleaned up %d times after panic, want 1", fake.cleanups)
+	}
+}
+
+// failOn makes each call of syscall nr fail with err
+func failOn(nr int, err error) func(int) error {
+	return func(called int) error {
+		if called == nr {
+			return err
+		}
+		return nil
+	}
+}
+
+// closedFds are fds closed in process by fake
+func closedFds(fake *fakeTracer) []uint64 {
+	var fds []uint64
+	for _, args := range fake.called(syscall.SYS_CLOSE) {
+		fds = append(fds, args[0])
+	}
+	return fds
+}
+
+func TestFlipDup3FailsRollsBack(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	fake := &fakeTracer{fail: failOn(syscall.SYS_DUP3, syscall.EBADF)}
+	useFakeTracer(t, fake)
+
+	result, err := Flip(os.Getpid(), path, Options{Logger: testLogger{t}})
+	if errors.Is(err, syscall.EBADF) == false {
+		t.Fatalf("flip returned %v, want the dup3 failure", err)
+	}
+	if code := ExitCode(err); code != env.ExitErr {
+		t.Errorf("exit code is %d, want %d (%s)", code, env.ExitErr, err)
+	}
+	if result != nil && result.replaced {
+		t.Errorf("fd %v reported replaced", result.Fds)
+	}
+	content, readErr := os.ReadFile(path)
+	if readErr != nil || string(content) != "before\n" {
+		t.Errorf("original not put back at %s: %q %v", path, content, readErr)
+	}
+	if _, statErr := os.Stat(path + rolledSuffix); os.IsNotExist(statErr) == false {
+		t.Errorf("%s is left behind after rollback", path+rolledSuffix)
+	}
+	// the new file is open as fd 100 in process
+	if closed := closedFds(fake); reflect.DeepEqual(closed, []uint64{100}) == false {
+		t.Errorf("closed fds %v in process, want the new one 100", closed)
+	}
+	if fake.cleanups != 1 {
+		t.Errorf("tracer cleaned up %d times, want 1", fake.cleanups)
+	}
+}
+
+func TestFlipClosesOrphanedFd(t *testing.T) {
+	cases := []struct {
+		name string
+		fail func(int) error
+		opts Options
+	}{
+		{"fchmod fails", failOn(syscall.SYS_FCHMOD, syscall.EPERM), Options{ExactMode: true}},
+		{"fallocate fails", failOn(syscall.SYS_FALLOCATE, syscall.EIO), Options{Prealloc: 1 << 20}},
+		{"dup3 panics", func(nr int) error {
+			if nr == syscall.SYS_DUP3 {
+				panic("tracer broke")
+			}
+			return nil
+		}, Options{}},
+	}
+	for _, c := range cases {
+		path := openedFile(t, "app.log", "before\n")
+		fake := &fakeTracer{fail: c.fail}
+		useFakeTracer(t, fake)
+		c.opts.Logger = testLogger{t}
+
+		if _, err := Flip(os.Getpid(), path, c.opts); err == nil {
+			t.Fatalf("%s: flip succeeded", c.name)
+		}
+		// the new file is open as fd 100 in process
+		if closed := closedFds(fake); reflect.DeepEqual(closed, []uint64{100}) == false {
+			t.Errorf("%s: closed fds %v in process, want the new one 100", c.name, closed)
+		}
+		if fake.cleanups != 1 {
+			t.Errorf("%s: tracer cleaned up %d times, want 1", c.name, fake.cleanups)
+		}
+	}
+}
+
+// slowOn makes each call of syscall nr take took
+func slowOn(nr int, took time.Duration) func(int) error {
+	return func(called int) error {
+		if called == nr {
+			time.Sleep(took)
+		}
+		return nil
+	}
+}
+
+// checkAborted checks a flip made slow at mmap by fake failed with
+// abortErr in it, undone before the open, with the map unmapped and
+// the process detached
+func checkAborted(t *testing.T, fake *fakeTracer, path string, err error, abortErr string) {
+	t.Helper()
+	if err == nil || strings.Contains(err.Error(), abortErr) == false {
+		t.Fatalf("flip returned %v, want %q", err, abortErr)
+	}
+	if opens := fake.called(syscall.SYS_OPEN); len(opens) != 0 {
+		t.Errorf("%d opens after abort", len(opens))
+	}
+	if munmaps := fake.called(syscall.SYS_MUNMAP); len(munmaps) != 1 {
+		t.Errorf("%d munmaps after abort, want 1", len(munmaps))
+	}
+	if fake.cleanups != 1 {
+		t.Errorf("tracer cleaned up %d times after abort, want 1", fake.cleanups)
+	}
+	content, readErr := os.ReadFile(path)
+	if readErr != nil || string(content) != "before\n" {
+		t.Errorf("original not put back at %s: %q %v", path, content, readErr)
+	}
+	if _, statErr := os.Stat(path + rolledSuffix); os.IsNotExist(statErr) == false {
+		t.Errorf("%s is left behind after abort", path+rolledSuffix)
+	}
+}
+
+func TestFlipOpTimeout(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	fake := &fakeTracer{fail: slowOn(sysMmap, 200*time.Millisecond)}
+	useFakeTracer(t, fake)
+
+	start := time.Now()
+	_, err := Flip(os.Getpid(), path, Options{OpTimeout: 100 * time.Millisecond, Logger: testLogger{t}})
+	checkAborted(t, fake, path, err, "longer than 100ms, aborted")
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("abort took %s", took)
+	}
+
+	// a flip within the timeout is left alone
+	path = openedFile(t, "app.log", "before\n")
+	useFakeTracer(t, &fakeTracer{})
+	if _, err := Flip(os.Getpid(), path, Options{OpTimeout: time.Second, Logger: testLogger{t}}); err != nil {
+		t.Errorf("flip within timeout: %s", err)
+	}
+}
+
+func TestFlipMaxStopped(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	fake := &fakeTracer{fail: slowOn(sysMmap, 200*time.Millisecond)}
+	useFakeTracer(t, fake)
+
+	_, err := Flip(os.Getpid(), path, Options{MaxStopped: 150 * time.Millisecond, Logger: testLogger{t}})
+	checkAborted(t, fake, path, err, "would pass 150ms, aborted")
+
+	// a flip stopping process shorter is left alone, and tells how long
+	path = openedFile(t, "app.log", "before\n")
+	useFakeTracer(t, &fakeTracer{fail: slowOn(sysMmap, 10*time.Millisecond)})
+	result, err := Flip(os.Getpid(), path, Options{MaxStopped: time.Second, Logger: testLogger{t}})
+	if err != nil {
+		t.Fatalf("flip within max stopped: %s", err)
+	}
+	if result.Stopped < 10*time.Millisecond || result.Stopped > time.Second {
+		t.Errorf("process stopped %s, want between 10ms and 1s", result.Stopped)
+	}
+}
+
+// recordLogger keeps each message with its level
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) record(level string, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+": "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Debug(format string, v ...interface{}) { l.record("debug", format, v...) }
+func (l *recordLogger) Info(format string, v ...interface{})  { l.record("info", format, v...) }
+func (l *recordLogger) Warn(format string, v ...interface{})  { l.record("warn", format, v...) }
+func (l *recordLogger) Error(format string, v ...interface{}) { l.record("error", format, v...) }
+
+// logged tells if a message of level holding text was recorded
+func (l *recordLogger) logged(level string, text string) bool {
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, level+": ") && strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFlipLogsToLogger(t *testing.T) {
+	path := openedFile(t, "app.log", "before\n")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	liveTracer := newTracer
+	useFakeTracer(t, &fakeTracer{})
+	// nothing may go to stderr behind the logger
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedStderr := os.Stderr
+	os.Stderr = writer
+	logger := &recordLogger{}
+	_, err = Flip(os.Getpid(), path, Options{Logger: logger})
+	os.Stderr = savedStderr
+	writer.Close()
+	leaked, _ := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logger.logged("warn", "was deleted while opened") == false {
+		t.Errorf("warning of the deleted file not logged, got %q", logger.lines)
+	}
+	// the logger decides what to drop, debug messages reach it
+	if logger.logged("debug", "lock") == false {
+		t.Errorf("debug messages not logged, got %q", logger.lines)
+	}
+	if len(leaked) > 0 {
+		t.Errorf("written to stderr instead of the logger: %q", leaked)
+	}
+
+	// the tracer of a live process logs there too
+	if child, ok := liveTracer(os.Getpid(), Options{Logger: logger}).(*ptrace.Child); ok == false || child.Log != logger {
+		t.Errorf("ptrace diagnostics don't go to the logger")
+	}
+}
@@ -0,0 +1,53 @@
+package flip
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pendulm/fileflip/pkg/env"
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+// verifyDetached looks again at /proc once process runs on its own and
+// checks each of result.Fds still opens result.Path, not the archive.
+// It is independent of the checks done while process was stopped
+func verifyDetached(result *Result, opts Options) error {
+	logger := opts.logger()
+	var fileStat syscall.Stat_t
+	if err := syscall.Stat(result.Path, &fileStat); err != nil {
+		return newError(env.ExitUnverified, "can't verify fds of pid %d after detach: %s", result.Pid, err)
+	}
+	for _, fd := range result.Fds {
+		fdPath := fmt.Sprintf("%s/%d/fd/%d", procfs, result.Pid, fd)
+		if sameInode(fdPath, &fileStat, logger) {
+			continue
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s/%d", procfs, result.Pid)); os.IsNotExist(err) {
+			logger.Warn("process %d exited after detach, fds are not verified\n", result.Pid)
+			return nil
+		}
+		target, err := os.Readlink(fdPath)
+		switch {
+		case err != nil:
+			return newError(env.ExitUnverified, "fd %d of pid %d is closed after detach", fd, result.Pid)
+		case result.RolledPath != "" && isRolled(fdPath, result.RolledPath, logger):
+			return newError(env.ExitUnverified, "fd %d of pid %d still opens archive %s after detach", fd, result.Pid, target)
+		case target == opts.procPath(result.Path):
+			// e.g. another rotation renamed it in between
+			return newError(env.ExitUnverified, "fd %d of pid %d opens a file replaced at %s after detach", fd, result.Pid, target)
+		}
+		return newError(env.ExitUnverified, "fd %d of pid %d opens %s instead of %s after detach", fd, result.Pid, target, result.Path)
+	}
+	logger.Debug("verified fd %s of pid %d open %s after detach\n", result.fdList(), result.Pid, result.Path)
+	return nil
+}
+
+// isRolled tells if fdPath opens the file at rolledPath
+func isRolled(fdPath string, rolledPath string, logger log.Logger) bool {
+	var rolledStat syscall.Stat_t
+	if err := syscall.Stat(rolledPath, &rolledStat); err != nil {
+		return false
+	}
+	return sameInode(fdPath, &rolledStat, logger)
+}
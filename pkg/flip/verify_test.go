@@ -0,0 +1,83 @@
+package flip
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pendulm/fileflip/pkg/env"
+)
+
+// ownFd opens path for appending until the test ends and returns its
+// descriptor
+func ownFd(t *testing.T, path string) int {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+	})
+	return int(f.Fd())
+}
+
+func TestVerifyDetached(t *testing.T) {
+	cases := []struct {
+		name string
+		// prepare returns the result of a flip of path to check
+		prepare func(t *testing.T, path string) *Result
+		code    int
+	}{
+		{"new file open", func(t *testing.T, path string) *Result {
+			fd := ownFd(t, path)
+			return &Result{Pid: os.Getpid(), Path: path, RolledPath: path + rolledSuffix, Fds: []int{fd}}
+		}, env.ExitOk},
+		{"archive still open", func(t *testing.T, path string) *Result {
+			fd := ownFd(t, path)
+			if err := os.Rename(path, path+rolledSuffix); err != nil {
+				t.Fatal(err)
+			}
+			ownFd(t, path)
+			return &Result{Pid: os.Getpid(), Path: path, RolledPath: path + rolledSuffix, Fds: []int{fd}}
+		}, env.ExitUnverified},
+		{"other file open", func(t *testing.T, path string) *Result {
+			ownFd(t, path)
+			fd := ownFd(t, path+".other")
+			return &Result{Pid: os.Getpid(), Path: path, RolledPath: path + rolledSuffix, Fds: []int{fd}}
+		}, env.ExitUnverified},
+		{"one of several wrong", func(t *testing.T, path string) *Result {
+			fd := ownFd(t, path)
+			other := ownFd(t, path+".other")
+			return &Result{Pid: os.Getpid(), Path: path, Fds: []int{fd, other}}
+		}, env.ExitUnverified},
+		{"fd closed", func(t *testing.T, path string) *Result {
+			ownFd(t, path)
+			return &Result{Pid: os.Getpid(), Path: path, Fds: []int{1 << 20}}
+		}, env.ExitUnverified},
+		{"file gone", func(t *testing.T, path string) *Result {
+			fd := ownFd(t, path)
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			return &Result{Pid: os.Getpid(), Path: path, Fds: []int{fd}}
+		}, env.ExitUnverified},
+		{"process exited", func(t *testing.T, path string) *Result {
+			ownFd(t, path)
+			cmd := exec.Command(os.Args[0], "-test.run=^$")
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			return &Result{Pid: cmd.Process.Pid, Path: path, Fds: []int{3}}
+		}, env.ExitOk},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			err := verifyDetached(c.prepare(t, path), Options{Logger: testLogger{t}})
+			if code := ExitCode(err); code != c.code {
+				t.Errorf("exit code %d, want %d (%v)", code, c.code, err)
+			}
+		})
+	}
+}
@@ -2,50 +2,153 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/pendulm/fileflip/pkg/env"
 )
 
-var debugEnable bool
+const (
+	// TimeRFC3339 is RFC3339 with milliseconds, the default
+	TimeRFC3339 = "rfc3339"
+	// TimeNano is nanoseconds since epoch
+	TimeNano = "nano"
+	// TimeNone prints no timestamp
+	TimeNone = "none"
+)
+
+const rfc3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// Level orders messages, those below the threshold are dropped
+type Level int
+
+const (
+	// LevelDebug shows everything, set by FILEFLIP_DEBUG
+	LevelDebug Level = iota
+	// LevelInfo shows operational messages, the default
+	LevelInfo
+	// LevelWarn shows only warnings and errors
+	LevelWarn
+	// LevelError shows only errors
+	LevelError
+)
+
+var threshold = LevelInfo
+
+// infoOutput receives info messages, other levels are diagnostics
+// and go to stderr
+var infoOutput io.Writer = os.Stdout
+
+// timeFormat is one of Time* picked by FILEFLIP_LOG_TIME
+var timeFormat string
 
 func init() {
 	if os.Getenv("FILEFLIP_DEBUG") != "" {
-		debugEnable = true
-	} else {
-		debugEnable = false
+		threshold = LevelDebug
+	}
+
+	switch format := os.Getenv("FILEFLIP_LOG_TIME"); format {
+	case TimeNano, TimeNone, TimeRFC3339:
+		timeFormat = format
+	case "":
+		timeFormat = TimeRFC3339
+	default:
+		fmt.Fprintf(os.Stderr, "unknown FILEFLIP_LOG_TIME %q, use %s\n", format, TimeRFC3339)
+		timeFormat = TimeRFC3339
 	}
 }
 
 // IsDebug use for bypass building expensive debug argument when debug is not toggled
 func IsDebug() bool {
-	return debugEnable == true
+	return threshold <= LevelDebug
+}
+
+// SetLevel drops messages below level, errors are always shown
+func SetLevel(level Level) {
+	threshold = level
+}
+
+// SetInfoOutput sends info messages to w instead of stdout, e.g. to
+// keep stdout for machine readable output
+func SetInfoOutput(w io.Writer) {
+	infoOutput = w
+}
+
+// stamp formats now as timeFormat says, it's shared by all levels
+func stamp(now time.Time) string {
+	switch timeFormat {
+	case TimeNano:
+		return strconv.FormatInt(now.UnixNano(), 10) + " "
+	case TimeNone:
+		return ""
+	}
+	return now.Format(rfc3339Milli) + " "
+}
+
+// output print message of level with timestamp to w
+func output(w io.Writer, level string, format string, v ...interface{}) {
+	fmt.Fprintf(w, "%s%s: ", stamp(time.Now()), level)
+	fmt.Fprintf(w, format, v...)
 }
 
-// Debug print message with nanosecond timestamp
+// Debug print message when FILEFLIP_DEBUG is set
 func Debug(format string, v ...interface{}) {
-	if debugEnable == false {
+	if threshold > LevelDebug {
 		return
 	}
-	unixNano := time.Now().UnixNano()
-	fmt.Fprintf(os.Stderr, "%v debug: ", unixNano)
-	fmt.Fprintf(os.Stderr, format, v...)
+	output(os.Stderr, "debug", format, v...)
 }
 
 // DieWithCode print message and exit with specific code
 func DieWithCode(code int, format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, v...)
-	os.Exit(code)
+	output(os.Stderr, "error", format, v...)
+	env.Exit(code)
 }
 
 // Die print message and exit
 func Die(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, v...)
-	os.Exit(env.ExitErr)
+	output(os.Stderr, "error", format, v...)
+	env.Exit(env.ExitErr)
+}
+
+// Info print informational message to stdout
+func Info(format string, v ...interface{}) {
+	if threshold > LevelInfo {
+		return
+	}
+	output(infoOutput, "info", format, v...)
+}
+
+// Warn print message about something done in a degraded way
+func Warn(format string, v ...interface{}) {
+	if threshold > LevelWarn {
+		return
+	}
+	output(os.Stderr, "warning", format, v...)
 }
 
 // Error print error message
 func Error(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, v...)
+	output(os.Stderr, "error", format, v...)
+}
+
+// Logger receives diagnostics of flips, a library user may give one
+// passing them to its own logging
+type Logger interface {
+	Debug(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	Error(format string, v ...interface{})
 }
+
+// Std is the Logger printing as the package functions do
+var Std Logger = std{}
+
+type std struct{}
+
+func (std) Debug(format string, v ...interface{}) { Debug(format, v...) }
+func (std) Info(format string, v ...interface{})  { Info(format, v...) }
+func (std) Warn(format string, v ...interface{})  { Warn(format, v...) }
+func (std) Error(format string, v ...interface{}) { Error(format, v...) }
@@ -0,0 +1,121 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// statuses as wait4 encodes them
+func exitedStatus(code int) syscall.WaitStatus {
+	return syscall.WaitStatus(code << 8)
+}
+
+func signaledStatus(sig syscall.Signal) syscall.WaitStatus {
+	return syscall.WaitStatus(sig)
+}
+
+func stoppedStatus(sig syscall.Signal) syscall.WaitStatus {
+	return syscall.WaitStatus(int(sig)<<8 | 0x7f)
+}
+
+const continuedStatus = syscall.WaitStatus(0xffff)
+
+func TestDecodeWait(t *testing.T) {
+	syscallStop := syscall.SIGTRAP | bit7thSet
+	cases := []struct {
+		name       string
+		current    int
+		status     syscall.WaitStatus
+		attached   bool
+		wasStopped bool
+
+		state       int
+		sig         syscall.Signal
+		nowAttached bool
+		err         bool
+	}{
+		{"syscall enter", childSignalDelivery, stoppedStatus(syscallStop), true, false,
+			childSyscallEnter, 0, true, false},
+		{"syscall exit", childSyscallEnter, stoppedStatus(syscallStop), true, false,
+			childSyscallExit, 0, true, false},
+		{"next syscall enter", childSyscallExit, stoppedStatus(syscallStop), true, false,
+			childSyscallEnter, 0, true, false},
+		{"first SIGSTOP attaches", childRunning, stoppedStatus(syscall.SIGSTOP), false, false,
+			childSignalDelivery, syscall.SIGSTOP, true, false},
+		{"other signal before attach", childRunning, stoppedStatus(syscall.SIGTERM), false, false,
+			childSignalDelivery, syscall.SIGTERM, false, false},
+		{"stopped child attaches on its stop", childRunning, stoppedStatus(syscall.SIGTSTP), false, true,
+			childSignalDelivery, syscall.SIGTSTP, true, false},
+		{"signal delivery", childSyscallExit, stoppedStatus(syscall.SIGUSR1), true, false,
+			childSignalDelivery, syscall.SIGUSR1, true, false},
+		{"second SIGSTOP", childSignalDelivery, stoppedStatus(syscall.SIGSTOP), true, false,
+			childSignalDelivery, syscall.SIGSTOP, true, false},
+		{"exited", childSyscallEnter, exitedStatus(3), true, false,
+			childExited, 0, true, false},
+		{"killed", childSignalDelivery, signaledStatus(syscall.SIGKILL), true, false,
+			childKilled, syscall.SIGKILL, true, false},
+		{"killed by a suppressed signal", childSignalDelivery, signaledStatus(syscall.SIGTERM), true, false,
+			childKilled, syscall.SIGTERM, true, true},
+		{"continued", childSyscallExit, continuedStatus, true, false,
+			childSyscallExit, 0, true, true},
+	}
+	for _, c := range cases {
+		state, sig, attached, err := decodeWait(c.current, c.status, c.attached, c.wasStopped)
+		if (err != nil) != c.err {
+			t.Errorf("%s: error %v, want error %t", c.name, err, c.err)
+		}
+		if state != c.state || sig != c.sig || attached != c.nowAttached {
+			t.Errorf("%s: decoded %s %d attached %t, want %s %d attached %t", c.name,
+				childStateStr[state], sig, attached, childStateStr[c.state], c.sig, c.nowAttached)
+		}
+	}
+}
+
+func TestSaveSignal(t *testing.T) {
+	cases := []struct {
+		name        string
+		wasStopped  bool
+		stopSent    bool
+		wasAttached []bool
+		sigs        []syscall.Signal
+		saved       []syscall.Signal
+	}{
+		{"stop of attach dropped", false, false,
+			[]bool{false, true},
+			[]syscall.Signal{syscall.SIGSTOP, syscall.SIGUSR1},
+			[]syscall.Signal{syscall.SIGUSR1}},
+		{"stop of stopped child dropped", true, false,
+			[]bool{false},
+			[]syscall.Signal{syscall.SIGTSTP},
+			nil},
+		{"second SIGSTOP kept", false, false,
+			[]bool{false, true},
+			[]syscall.Signal{syscall.SIGSTOP, syscall.SIGSTOP},
+			[]syscall.Signal{syscall.SIGSTOP}},
+		{"SIGSTOP we sent dropped once", false, true,
+			[]bool{true, true},
+			[]syscall.Signal{syscall.SIGSTOP, syscall.SIGSTOP},
+			[]syscall.Signal{syscall.SIGSTOP}},
+		{"standard signal kept once", false, false,
+			[]bool{true, true, true},
+			[]syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGUSR1},
+			[]syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2}},
+		{"realtime signal queued", false, false,
+			[]bool{true, true},
+			[]syscall.Signal{sigRtmin + 1, sigRtmin + 1},
+			[]syscall.Signal{sigRtmin + 1, sigRtmin + 1}},
+	}
+	for _, c := range cases {
+		pt := NewChild(0)
+		pt.wasStopped, pt.stopSent = c.wasStopped, c.stopSent
+		for i, sig := range c.sigs {
+			pt.saveSignal(sig, c.wasAttached[i])
+		}
+		if reflect.DeepEqual(pt.savedSignals, c.saved) == false {
+			t.Errorf("%s: saved %v, want %v", c.name, pt.savedSignals, c.saved)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// syscallNames names the syscalls fileflip injects, the rest are
+// shown by number
+var syscallNames = map[int]string{
+	syscall.SYS_CLOSE:     "close",
+	syscall.SYS_DUP3:      "dup3",
+	syscall.SYS_FALLOCATE: "fallocate",
+	syscall.SYS_FCHMOD:    "fchmod",
+	syscall.SYS_FCNTL:     "fcntl",
+	syscall.SYS_FLOCK:     "flock",
+	syscall.SYS_FTRUNCATE: "ftruncate",
+	syscall.SYS_LINKAT:    "linkat",
+	syscall.SYS_LSEEK:     "lseek",
+	syscall.SYS_MUNMAP:    "munmap",
+	syscall.SYS_OPEN:      "open",
+}
+
+func init() {
+	for nr, name := range archSyscallNames {
+		syscallNames[nr] = name
+	}
+}
+
+// RemoteSyscallError is a syscall injected into child which failed,
+// errors.Is matches it against its Errno
+type RemoteSyscallError struct {
+	// Nr is the syscall number
+	Nr int
+	// Args are arguments as passed in registers
+	Args []uint64
+	// Errno is what the syscall failed with
+	Errno syscall.Errno
+}
+
+// SyscallName names syscall nr, e.g. "open" or "syscall 285"
+func SyscallName(nr int) string {
+	if name, ok := syscallNames[nr]; ok {
+		return name
+	}
+	return fmt.Sprintf("syscall %d", nr)
+}
+
+func (e *RemoteSyscallError) Error() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = fmt.Sprintf("%#x", arg)
+	}
+	return fmt.Sprintf("remote %s(%s) failed: %s",
+		SyscallName(e.Nr), strings.Join(args, ", "), e.Errno)
+}
+
+func (e *RemoteSyscallError) Unwrap() error {
+	return e.Errno
+}
@@ -0,0 +1,55 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestRemoteSyscallError(t *testing.T) {
+	err := &RemoteSyscallError{Nr: syscall.SYS_CLOSE, Args: []uint64{7}, Errno: syscall.EBADF}
+	if got, want := err.Error(), "remote close(0x7) failed: bad file descriptor"; got != want {
+		t.Errorf("message %q, want %q", got, want)
+	}
+	if err.Unwrap() != syscall.EBADF {
+		t.Errorf("unwrapped %v, want %v", err.Unwrap(), syscall.EBADF)
+	}
+
+	// callers wrap it again with what they were doing
+	wrapped := fmt.Errorf("close error: %w", err)
+	if errors.Is(wrapped, syscall.EBADF) == false {
+		t.Errorf("%v is not EBADF", wrapped)
+	}
+	if errors.Is(wrapped, syscall.ENOENT) {
+		t.Errorf("%v is ENOENT", wrapped)
+	}
+	var remoteErr *RemoteSyscallError
+	if errors.As(wrapped, &remoteErr) == false || remoteErr != err {
+		t.Fatalf("%v holds no RemoteSyscallError", wrapped)
+	}
+	var errno syscall.Errno
+	if errors.As(wrapped, &errno) == false || errno != syscall.EBADF {
+		t.Errorf("errno of %v is %v, want %v", wrapped, errno, syscall.EBADF)
+	}
+	if name := SyscallName(100000); name != "syscall 100000" {
+		t.Errorf("unknown syscall named %q", name)
+	}
+}
+
+func TestRemoteSyscallReturnsError(t *testing.T) {
+	pt := tracedChild(t)
+	_, err := pt.RemoteSyscall(syscall.SYS_CLOSE, 1<<20)
+	var remoteErr *RemoteSyscallError
+	if errors.As(err, &remoteErr) == false {
+		t.Fatalf("close of a bad fd returned %v, want a RemoteSyscallError", err)
+	}
+	if remoteErr.Nr != syscall.SYS_CLOSE || len(remoteErr.Args) == 0 || remoteErr.Args[0] != 1<<20 {
+		t.Errorf("error %v doesn't tell the syscall made", remoteErr)
+	}
+	if errors.Is(err, syscall.EBADF) == false {
+		t.Errorf("close of a bad fd returned %v, want EBADF", err)
+	}
+}
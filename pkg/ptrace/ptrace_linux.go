@@ -0,0 +1,692 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pendulm/fileflip/pkg/log"
+)
+
+const (
+	bit7thSet = 0x80
+	// __WALL flag does not include the WSTOPPED
+	// and WEXITED flags, but implies their functionality
+	waitOptWALL = 0x40000000
+)
+
+const (
+	childRunning = iota
+	childSignalDelivery
+	childSyscallEnter
+	childSyscallExit
+	childExited
+	childKilled
+)
+
+var childStateStr = map[int]string{
+	childRunning:        "childRunning",
+	childSignalDelivery: "childSignalDelivery",
+	childSyscallEnter:   "childSyscallEnter",
+	childSyscallExit:    "childSyscallExit",
+	childExited:         "childExited",
+	childKilled:         "childKilled",
+}
+
+// DefaultRetries is how many times a transient ptrace failure is tried
+const DefaultRetries = 3
+
+// retryBackoff is the first sleep between retries, doubled each time
+const retryBackoff = 10 * time.Millisecond
+
+// sigRtmin is the first realtime signal, those are queued each time
+const sigRtmin = 34
+
+// ErrProcessGone is returned when child exited or was killed
+// while we are tracing it
+var ErrProcessGone = errors.New("process quit by killed or exited")
+
+// Child include common methods for control target process and
+// mask tracing status internally
+type Child struct {
+	// pid is child pid
+	pid int
+	// childState store ptrace state of pid
+	childState int
+	// savedRegs keeps registers before syscall and
+	// restore it after our action was done
+	savedRegs *syscall.PtraceRegs
+	// savedSignals are signals for child caught while it was traced,
+	// resuming a signal-delivery-stop without them drops them, so they
+	// are sent again after detach
+	savedSignals []syscall.Signal
+	// stopSent means a SIGSTOP of ours is on its way, it is not saved
+	stopSent bool
+	// attached is a flag means we wait for first SIGSTOP
+	attached bool
+	// noVMWritev is set when kernel lacks process_vm_writev
+	noVMWritev bool
+	// Retries is attempts made on transient attach and wait failures
+	Retries int
+	// Log receives diagnostics, log.Std by default
+	Log log.Logger
+	// ExitKill makes kernel kill child if we die while attached,
+	// instead of detaching it with registers we may have changed
+	ExitKill bool
+	// stoppedAt is when child was stopped by our attach
+	stoppedAt time.Time
+	// stopped accumulates time child was held by us
+	stopped time.Duration
+	// wasStopped means child was in job control stop before attach,
+	// its stop signal may not be SIGSTOP and it stays stopped after detach
+	wasStopped bool
+	// injected means child sits at syscall-exit-stop of our syscall,
+	// registers are restored from savedRegs only before detach
+	injected bool
+}
+
+// NewChild return a new Child form given pid
+func NewChild(pid int) *Child {
+	return &Child{
+		pid:         pid,
+		childState:  childRunning,
+		savedRegs:   nil,
+		attached:    false,
+		Retries:     DefaultRetries,
+		Log:         log.Std,
+	}
+}
+
+// procState reads process state letter from /proc/<pid>/stat
+func procState(pid int) (byte, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// comm may contain spaces and parentheses, state follows the last ")"
+	stat := string(content)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 || idx+2 >= len(stat) {
+		return 0, fmt.Errorf("bad stat format of %d", pid)
+	}
+	return stat[idx+2], nil
+}
+
+// alive tells a live process from one exited or being reaped
+func alive(pid int) bool {
+	state, err := procState(pid)
+	if err != nil {
+		return false
+	}
+	return state != 'Z' && state != 'X' && state != 'x'
+}
+
+// transient tells if err may go away by trying again, ESRCH is only
+// transient when the task still exists but is not ready to be traced
+func (pt *Child) transient(err error) bool {
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN:
+		return true
+	case syscall.ESRCH:
+		return alive(pt.pid)
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, fails permanently or attempts
+// are used up, sleeping a growing backoff in between
+func (pt *Child) retry(op string, fn func() error) error {
+	backoff := retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || pt.transient(err) == false || attempt >= pt.Retries {
+			return err
+		}
+		pt.Log.Debug("%s failed with %s, retry %d after %s\n", op, err, attempt, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Setup starts attach to child then tracer can control tracee
+func (pt *Child) Setup() error {
+	pt.Log.Debug("setup attaching\n")
+	start := time.Now()
+	switch pt.childState {
+	case childExited, childKilled:
+		return ErrProcessGone
+	case childRunning:
+		if pt.attached == false {
+			if state, err := procState(pt.pid); err == nil && state == 'T' {
+				pt.Log.Debug("process %d is stopped before attach\n", pt.pid)
+				pt.wasStopped = true
+			}
+			if err := pt.retry("attach", func() error {
+				return syscall.PtraceAttach(pt.pid)
+			}); err != nil {
+				return fmt.Errorf("attach %d failed: %w", pt.pid, err)
+			}
+			if err := pt.waitAttach(); err != nil {
+				return err
+			}
+		} else if err := pt.stopChild(); err != nil {
+			return err
+		}
+		if pt.gone() {
+			return ErrProcessGone
+		}
+		pt.stoppedAt = time.Now()
+	default:
+		break
+	}
+	if log.IsDebug() {
+		pt.Log.Debug("setup took %s\n", time.Since(start))
+	}
+
+	if err := syscall.PtraceSetOptions(pt.pid, pt.options()); err != nil {
+		return fmt.Errorf("ptrace set option error: %w", err)
+	}
+	return nil
+}
+
+// ptraceOExitkill is missing in syscall package
+const ptraceOExitkill = 0x100000
+
+// options are ptrace options set on child after attached
+func (pt *Child) options() int {
+	options := syscall.PTRACE_O_TRACESYSGOOD
+	if pt.ExitKill {
+		options |= ptraceOExitkill
+	}
+	return options
+}
+
+// Cleanup detach from child and child continue to run,
+// calling it again after detached does nothing
+func (pt *Child) Cleanup() error {
+	start := time.Now()
+	switch pt.childState {
+	case childExited, childKilled:
+		// kernel already released the tracee
+		pt.attached = false
+		return ErrProcessGone
+	case childRunning:
+		if pt.attached == false {
+			return nil
+		}
+		if err := pt.stopChild(); err != nil {
+			return err
+		}
+		if pt.gone() {
+			pt.attached = false
+			return ErrProcessGone
+		}
+	default:
+		break
+	}
+	if err := pt.restoreRegs(); err != nil {
+		return err
+	}
+	// a stopped process is detached with SIGSTOP to stay stopped
+	var sig syscall.Signal
+	if pt.wasStopped {
+		sig = syscall.SIGSTOP
+	}
+	if err := ptraceDetach(pt.pid, sig); err != nil {
+		return fmt.Errorf("detach %d failed: %w", pt.pid, err)
+	}
+	pt.attached = false
+	pt.childState = childRunning
+	pt.savedRegs = nil
+	pt.injected = false
+	pt.stopped += time.Since(pt.stoppedAt)
+	pt.resendSignals()
+	if log.IsDebug() {
+		pt.Log.Debug("cleanup detached, took %s, process stopped %s in total\n",
+			time.Since(start), pt.stopped)
+	}
+	return nil
+}
+
+// waitAttach waits for the stop of attach, a signal coming first is
+// saved and child goes on until the stop
+func (pt *Child) waitAttach() error {
+	for {
+		if err := pt.waitChild(); err != nil {
+			return err
+		}
+		if pt.gone() || pt.attached {
+			return nil
+		}
+		if err := syscall.PtraceCont(pt.pid, 0); err != nil {
+			return fmt.Errorf("resume %d to its attach stop failed: %w", pt.pid, err)
+		}
+	}
+}
+
+// stopChild stops a running child with SIGSTOP. A signal of someone
+// else may stop it first, it is saved and child goes on until ours
+func (pt *Child) stopChild() error {
+	pt.stopSent = true
+	if err := syscall.Kill(pt.pid, syscall.SIGSTOP); err != nil {
+		pt.stopSent = false
+		return fmt.Errorf("send SIGSTOP to %d failed: %w", pt.pid, err)
+	}
+	for {
+		if err := pt.waitChild(); err != nil {
+			return err
+		}
+		if pt.gone() || pt.stopSent == false {
+			return nil
+		}
+		if err := syscall.PtraceCont(pt.pid, 0); err != nil {
+			return fmt.Errorf("resume %d to its SIGSTOP failed: %w", pt.pid, err)
+		}
+	}
+}
+
+// resendSignals sends signals caught while child was traced once it
+// runs on its own, handlers then see them as if we weren't there.
+// They come from us now, so si_pid and si_code differ
+func (pt *Child) resendSignals() {
+	for _, sig := range pt.savedSignals {
+		pt.Log.Debug("send %s caught during flip again\n", sig)
+		if err := syscall.Kill(pt.pid, sig); err != nil {
+			pt.Log.Error("send %s to %d again error: %s\n", sig, pt.pid, err)
+		}
+	}
+	pt.savedSignals = nil
+}
+
+// StoppedDuration is how long child has been held stopped by us
+func (pt *Child) StoppedDuration() time.Duration {
+	if pt.attached {
+		return pt.stopped + time.Since(pt.stoppedAt)
+	}
+	return pt.stopped
+}
+
+// ptraceDetach is syscall.PtraceDetach which can deliver sig
+func ptraceDetach(pid int, sig syscall.Signal) error {
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_PTRACE,
+		syscall.PTRACE_DETACH,
+		uintptr(pid), 0, uintptr(sig), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// gone reports whether child has exited or been killed
+func (pt *Child) gone() bool {
+	return pt.childState == childExited || pt.childState == childKilled
+}
+
+func (pt *Child) waitChild() error {
+	wstatus := new(syscall.WaitStatus)
+
+	pt.Log.Debug("waitChild enter with status: %s\n", childStateStr[pt.childState])
+	// with __WALL an event of another task may surface, e.g. a thread
+	// of the same group, its status says nothing about our task, so
+	// it is dropped and we wait again
+	for {
+		var wpid int
+		err := pt.retry("wait", func() error {
+			var err error
+			wpid, err = pt.wait4(wstatus)
+			return err
+		})
+		if err != nil {
+			// leave kernel to detach the child when we exit
+			return fmt.Errorf("waiting child error: %w", err)
+		}
+		if wpid == pt.pid {
+			break
+		}
+		pt.Log.Debug("wait returned task %d instead of %d, wait again\n", wpid, pt.pid)
+	}
+
+	wasAttached := pt.attached
+	state, sig, attached, err := decodeWait(pt.childState, *wstatus, pt.attached, pt.wasStopped)
+	if err != nil {
+		panic(err.Error())
+	}
+	pt.childState, pt.attached = state, attached
+	if state == childSignalDelivery {
+		pt.saveSignal(sig, wasAttached)
+		pt.Log.Debug("wait notified with status: childSignalDelivery(%d)\n", sig)
+	} else {
+		pt.Log.Debug("wait notified with status: %s\n", childStateStr[state])
+	}
+	return nil
+}
+
+// saveSignal keeps sig stopping child unless it is the stop of our
+// attach or one we sent. A standard signal is kept once, as pending
+// ones are merged by kernel too
+func (pt *Child) saveSignal(sig syscall.Signal, wasAttached bool) {
+	if wasAttached == false && (sig == syscall.SIGSTOP || pt.wasStopped) {
+		return
+	}
+	if sig == syscall.SIGSTOP && pt.stopSent {
+		pt.stopSent = false
+		return
+	}
+	for _, saved := range pt.savedSignals {
+		if saved == sig && sig < sigRtmin {
+			return
+		}
+	}
+	pt.savedSignals = append(pt.savedSignals, sig)
+}
+
+// sysWait4 is wait4 of child, replaced by tests
+var sysWait4 = syscall.Wait4
+
+// ptrace requests of syscall injection, replaced by tests
+var (
+	ptraceSyscall = syscall.PtraceSyscall
+	ptraceGetRegs = syscall.PtraceGetRegs
+	ptraceSetRegs = syscall.PtraceSetRegs
+)
+
+// wait4 waits on child, restarting as long as it is interrupted by a
+// signal to us, e.g. SIGCHLD or SIGWINCH, which tells nothing about
+// the child and must not cut the wait short while it is held stopped
+func (pt *Child) wait4(wstatus *syscall.WaitStatus) (int, error) {
+	for {
+		wpid, err := sysWait4(pt.pid, wstatus, waitOptWALL, nil)
+		if err != syscall.EINTR {
+			return wpid, err
+		}
+		pt.Log.Debug("wait of %d interrupted, wait again\n", pt.pid)
+	}
+}
+
+// decodeWait works out the state child moved to from current by
+// status wait4 reported, with the signal it stopped or was killed by.
+// Until attached the first SIGSTOP, or any stop of a child which was
+// already stopped, completes the attach. It only fails on statuses
+// our wait options never produce, or a kill we should have suppressed
+func decodeWait(current int, status syscall.WaitStatus, attached bool, wasStopped bool) (int, syscall.Signal, bool, error) {
+	switch {
+	case status.Exited():
+		return childExited, 0, attached, nil
+	case status.Signaled():
+		sig := status.Signal()
+		if sig != syscall.SIGKILL {
+			// killed by signal injected
+			return childKilled, sig, attached, fmt.Errorf("killed by %s, all signal suppressed, this should not happend", sig)
+		}
+		// unstoppable kill
+		return childKilled, sig, attached, nil
+	case status.Stopped():
+		// no PTRACE_O_TRACE_* option is turned on, so no PTRACE_EVENT occurs
+		sig := status.StopSignal()
+		// syscall-stop
+		if sig == syscall.SIGTRAP|bit7thSet {
+			if current != childSyscallEnter {
+				return childSyscallEnter, 0, attached, nil
+			}
+			return childSyscallExit, 0, attached, nil
+		}
+		// we suppress all signal and wait for first SIGSTOP, a process
+		// already stopped reports the stop it is in, e.g. SIGTSTP
+		if attached == false && (sig == syscall.SIGSTOP || wasStopped) {
+			attached = true
+		}
+		return childSignalDelivery, sig, attached, nil
+	case status.Continued():
+		return current, 0, attached, errors.New("waitpid without WCONTINUED, this should not happend")
+	}
+	return current, 0, attached, fmt.Errorf("unknown wait status: %d, this should not happend", status)
+}
+
+// catchSyscall wait for child issue next syscall, after that
+// we can play our magic
+func (pt *Child) catchSyscall() error {
+	for {
+		pt.Log.Debug("catchSyscall loop current state: %s\n", childStateStr[pt.childState])
+		if pt.childState == childSyscallEnter {
+			break
+		}
+		if pt.gone() {
+			return ErrProcessGone
+		}
+		if err := ptraceSyscall(pt.pid, 0); err != nil {
+			return fmt.Errorf("catchSyscall resume syscall failed: %w", err)
+		}
+		if err := pt.waitChild(); err != nil {
+			return err
+		}
+		pt.Log.Debug("catchSyscall loop new state: %s\n", childStateStr[pt.childState])
+	}
+
+	if pt.savedRegs != nil {
+		return nil
+	}
+	pt.savedRegs = &syscall.PtraceRegs{}
+
+	if err := ptraceGetRegs(pt.pid, pt.savedRegs); err != nil {
+		pt.savedRegs = nil
+		return fmt.Errorf("save catched syscall failed: %w", err)
+	}
+	return nil
+}
+
+// restoreRegs puts back registers of the syscall we catched, it's
+// done once after all injected syscalls. The syscall of child was taken
+// over at its syscall-enter-stop and never ran, so if child sits at
+// syscall-exit-stop of ours, it is rewound to enter its own syscall
+// again on resume, rather than returning -ENOSYS from it
+func (pt *Child) restoreRegs() error {
+	if pt.savedRegs == nil {
+		return nil
+	}
+	reg := *pt.savedRegs
+	if pt.injected {
+		rewindSyscall(&reg)
+	}
+	if err := ptraceSetRegs(pt.pid, &reg); err != nil {
+		return fmt.Errorf("restore registers failed: %w", err)
+	}
+	pt.injected = false
+	return nil
+}
+
+// reenterSyscall rewinds child from syscall-exit-stop of the last
+// injected syscall to the syscall instruction with reg filled, so it
+// stops at syscall-enter again without running any code of its own
+func (pt *Child) reenterSyscall(reg *syscall.PtraceRegs) error {
+	rewindSyscall(reg)
+	if err := ptraceSetRegs(pt.pid, reg); err != nil {
+		return fmt.Errorf("rewind syscall failed: %w", err)
+	}
+	pt.injected = false
+	return pt.catchSyscall()
+}
+
+// remoteIovec is struct iovec with a base address of child
+type remoteIovec struct {
+	base   uintptr
+	length uintptr
+}
+
+// remoteWritev copy data to child with process_vm_writev in one call,
+// it returns bytes actually copied which can be short
+func (pt *Child) remoteWritev(src []byte, addr uintptr) (int, error) {
+	local := syscall.Iovec{Base: &src[0]}
+	local.SetLen(len(src))
+	remote := remoteIovec{base: addr, length: uintptr(len(src))}
+
+	n, _, errno := syscall.Syscall6(
+		sysProcessVMWritev,
+		uintptr(pt.pid),
+		uintptr(unsafe.Pointer(&local)), 1,
+		uintptr(unsafe.Pointer(&remote)), 1,
+		0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// RemoteMemcp copy date to child's memory, process_vm_writev is tried
+// first and poking word by word is the fallback
+func (pt *Child) RemoteMemcp(src []byte, addr uintptr, size int) error {
+	done := 0
+	if size > 0 && pt.noVMWritev == false {
+		n, err := pt.remoteWritev(src[:size], addr)
+		if err == syscall.ENOSYS {
+			pt.noVMWritev = true
+		}
+		if err != nil {
+			pt.Log.Debug("process_vm_writev failed, fallback to poke: %s\n", err)
+		} else if n < size {
+			pt.Log.Debug("process_vm_writev copied %d of %d bytes, poke the rest\n", n, size)
+		}
+		done = n
+	}
+	if done == size {
+		return nil
+	}
+
+	count, err := pokeData(pt.pid, addr+uintptr(done), src[done:size])
+	if err != nil {
+		pt.Log.Error("memcp to child error: %s\n", err)
+		return err
+	}
+	if done+count != size {
+		pt.Log.Error("memcp %d bytes but only successed %d bytes\n", size, done+count)
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// RemotePeek reads size bytes of child's memory at addr
+func (pt *Child) RemotePeek(addr uintptr, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	count, err := peekData(pt.pid, addr, buf)
+	if err != nil {
+		return nil, err
+	}
+	if count != size {
+		return nil, fmt.Errorf("peek %d bytes but only read %d bytes", size, count)
+	}
+	return buf, nil
+}
+
+// StackPointer is the stack pointer of child where its syscall was
+// caught, injected syscalls never move it
+func (pt *Child) StackPointer() (uintptr, error) {
+	if pt.savedRegs == nil {
+		if err := pt.catchSyscall(); err != nil {
+			return 0, err
+		}
+	}
+	return stackPointer(pt.savedRegs), nil
+}
+
+// hijack turns the syscall child is entering into nr with args and
+// resumes child into it. ESRCH means child is not in a ptrace-stop
+// right now, e.g. during a group-stop transition
+func (pt *Child) hijack(reg *syscall.PtraceRegs, nr int, args []uint64) error {
+	if pt.injected && pt.childState == childSyscallExit {
+		// registers set before re-entering are kept at syscall-enter-stop
+		*reg = *pt.savedRegs
+		fillSyscallRegs(reg, nr, args)
+		if err := pt.reenterSyscall(reg); err != nil {
+			return err
+		}
+	} else {
+		// wait for syscall-enter-stop
+		if err := pt.catchSyscall(); err != nil {
+			return err
+		}
+		*reg = *pt.savedRegs
+		fillSyscallRegs(reg, nr, args)
+		if err := ptraceSetRegs(pt.pid, reg); err != nil {
+			return fmt.Errorf("fill syscall %d regs failed: %w", nr, err)
+		}
+	}
+	if err := ptraceSyscall(pt.pid, 0); err != nil {
+		return fmt.Errorf("hijack syscall %d failed: %w", nr, err)
+	}
+	return nil
+}
+
+// RemoteSyscall invoke a syscall on behalf of child
+func (pt *Child) RemoteSyscall(nr int, args ...uint64) (int64, error) {
+	if log.IsDebug() == true {
+		format := "remoteSyscall invoke nr=%d"
+		if args == nil {
+			pt.Log.Debug(format+"\n", nr)
+		} else {
+			for i := range args {
+				endl := " "
+				if i == len(args)-1 {
+					endl = "\n"
+				}
+				format += fmt.Sprintf(" arg%d=%v%s", i, args[i], endl)
+			}
+			pt.Log.Debug(format, nr)
+		}
+	}
+	start := time.Now()
+	reg := &syscall.PtraceRegs{}
+	for attempt := 1; ; attempt++ {
+		err := pt.hijack(reg, nr, args)
+		if err == nil {
+			break
+		}
+		// until resumed into it the syscall has not run, so trying
+		// again never runs it twice
+		if errors.Is(err, syscall.ESRCH) == false {
+			return -1, err
+		}
+		if alive(pt.pid) == false {
+			return -1, ErrProcessGone
+		}
+		if attempt >= pt.Retries {
+			return -1, fmt.Errorf("process %d is alive but never stopped for ptrace: %w", pt.pid, err)
+		}
+		pt.Log.Debug("syscall %d got ESRCH while process %d is alive, wait for its stop and retry %d\n",
+			nr, pt.pid, attempt)
+		if err := pt.waitChild(); err != nil {
+			return -1, err
+		}
+		if pt.gone() {
+			return -1, ErrProcessGone
+		}
+	}
+	// wait for syscall-exit-stop
+	if err := pt.waitChild(); err != nil {
+		return -1, err
+	}
+	if pt.gone() {
+		return -1, ErrProcessGone
+	}
+	pt.injected = true
+
+	if err := ptraceGetRegs(pt.pid, reg); err != nil {
+		return -1, fmt.Errorf("get syscall result failed: %w", err)
+	}
+
+	rv, errno := syscallResult(reg)
+	if log.IsDebug() {
+		pt.Log.Debug("remoteSyscall return nr=%d retval=%v took %s\n", nr, rv, time.Since(start))
+	}
+
+	if errno != 0 {
+		return -1, &RemoteSyscallError{Nr: nr, Args: args, Errno: errno}
+	}
+	return rv, nil
+}
@@ -0,0 +1,78 @@
+// +build linux,386
+
+package ptrace
+
+import (
+	"syscall"
+)
+
+// uint(-4095)
+const maxErrnoValue uint32 = 4294963201
+
+// missing in syscall package
+const sysProcessVMWritev = 348
+
+// wordSize is the bytes PTRACE_PEEKDATA and PTRACE_POKEDATA move
+const wordSize = 4
+
+// archSyscallNames names injected syscalls only 386 has
+var archSyscallNames = map[int]string{
+	syscall.SYS_FCNTL64: "fcntl64",
+	syscall.SYS_MMAP2:   "mmap2",
+}
+
+// fillSyscallRegs put syscall number and arguments into registers,
+// arguments are truncated to 32 bits as the tracee only sees 32-bit registers
+func fillSyscallRegs(reg *syscall.PtraceRegs, nr int, args []uint64) {
+	if args != nil {
+		// syscall convention:
+		// SEE: https://github.com/torvalds/linux/blob/v5.0/arch/x86/entry/entry_32.S#L382
+		switch len(args) {
+		case 6:
+			reg.Ebp = int32(args[5])
+			fallthrough
+		case 5:
+			reg.Edi = int32(args[4])
+			fallthrough
+		case 4:
+			reg.Esi = int32(args[3])
+			fallthrough
+		case 3:
+			reg.Edx = int32(args[2])
+			fallthrough
+		case 2:
+			reg.Ecx = int32(args[1])
+			fallthrough
+		case 1:
+			reg.Ebx = int32(args[0])
+		default:
+			panic("too many syscall args\n")
+		}
+	}
+
+	reg.Orig_eax = int32(nr)
+}
+
+// syscallResult split syscall return value into value and errno,
+// the value is zero extended so addresses above 2G stay positive
+func syscallResult(reg *syscall.PtraceRegs) (int64, syscall.Errno) {
+	rv := uint32(reg.Eax)
+	if rv > maxErrnoValue {
+		return int64(rv), syscall.Errno(-int32(rv))
+	}
+	return int64(rv), 0
+}
+
+// stackPointer is esp in reg
+func stackPointer(reg *syscall.PtraceRegs) uintptr {
+	return uintptr(uint32(reg.Esp))
+}
+
+// rewindSyscall points instruction pointer back to the syscall
+// instruction and its number register to the syscall being entered,
+// both syscall and int 0x80 are 2 bytes long, the same way kernel
+// restarts an interrupted syscall
+func rewindSyscall(reg *syscall.PtraceRegs) {
+	reg.Eip -= 2
+	reg.Eax = reg.Orig_eax
+}
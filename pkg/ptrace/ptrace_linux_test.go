@@ -0,0 +1,372 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// childEnv makes the test binary a child which only sleeps, it is
+// traced instead of another program so its arch is ours
+const childEnv = "PTRACE_TEST_CHILD"
+
+// tracerEnv makes the test binary attach the pid it names with
+// ExitKill, tell so on stdout and sleep until killed
+const tracerEnv = "PTRACE_TEST_TRACER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	if pid := os.Getenv(tracerEnv); pid != "" {
+		runtime.LockOSThread()
+		n, _ := strconv.Atoi(pid)
+		pt := NewChild(n)
+		pt.ExitKill = true
+		if err := pt.Setup(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("attached")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// exitedPid is the pid of a child which exited and was reaped
+func exitedPid(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		name  string
+		pid   int
+		errs  []error
+		err   error
+		calls int
+	}{
+		{"success", os.Getpid(), nil, nil, 1},
+		{"interrupted then success", os.Getpid(), []error{syscall.EINTR, syscall.EINTR}, nil, 3},
+		{"again until used up", os.Getpid(), []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}, syscall.EAGAIN, 3},
+		{"permanent", os.Getpid(), []error{syscall.EPERM, nil}, syscall.EPERM, 1},
+		{"no such task while alive", os.Getpid(), []error{syscall.ESRCH}, nil, 2},
+		{"no such task after exit", exitedPid(t), []error{syscall.ESRCH, nil}, syscall.ESRCH, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pt := NewChild(c.pid)
+			calls := 0
+			err := pt.retry("test", func() error {
+				calls++
+				if calls <= len(c.errs) {
+					return c.errs[calls-1]
+				}
+				return nil
+			})
+			if err != c.err {
+				t.Errorf("retry returned %v, want %v", err, c.err)
+			}
+			if calls != c.calls {
+				t.Errorf("fn called %d times, want %d", calls, c.calls)
+			}
+		})
+	}
+}
+
+// sysMmapNr is mmap taking its arguments in registers, on 386 it is
+// mmap2 as mmap there takes a pointer to them
+func sysMmapNr() int {
+	if runtime.GOARCH == "386" {
+		return 192
+	}
+	return 9
+}
+
+// tracedChild starts a sleeping child and attaches to it from the
+// calling thread, which stays locked to it. Each run of a benchmark
+// may be another goroutine, so each attaches its own. It is skipped
+// without the privilege to attach
+func tracedChild(b testing.TB) *Child {
+	b.Helper()
+	runtime.LockOSThread()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if err := cmd.Start(); err != nil {
+		runtime.UnlockOSThread()
+		b.Skipf("start child: %s", err)
+	}
+	pt := NewChild(cmd.Process.Pid)
+	if err := pt.Setup(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		runtime.UnlockOSThread()
+		b.Skipf("can't attach: %s", err)
+	}
+	b.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		runtime.UnlockOSThread()
+	})
+	return pt
+}
+
+// mapPage maps a writable page in child
+func mapPage(b *testing.B, pt *Child) uintptr {
+	b.Helper()
+	addr, err := pt.RemoteSyscall(sysMmapNr(), 0, uint64(os.Getpagesize()),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANONYMOUS|syscall.MAP_PRIVATE, 0, 0)
+	if err != nil {
+		b.Fatalf("mmap in child: %s", err)
+	}
+	return uintptr(addr)
+}
+
+// benchmarkCopyPage copies a full page into child by copyPage
+func benchmarkCopyPage(b *testing.B, copyPage func(pt *Child, page []byte, addr uintptr) error) {
+	pt := tracedChild(b)
+	addr := mapPage(b, pt)
+	page := make([]byte, os.Getpagesize())
+	for i := range page {
+		page[i] = byte(i)
+	}
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := copyPage(pt, page, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyPageVMWritev(b *testing.B) {
+	benchmarkCopyPage(b, func(pt *Child, page []byte, addr uintptr) error {
+		n, err := pt.remoteWritev(page, addr)
+		if err == nil && n != len(page) {
+			b.Fatalf("process_vm_writev copied %d of %d bytes", n, len(page))
+		}
+		return err
+	})
+}
+
+func BenchmarkCopyPagePoke(b *testing.B) {
+	benchmarkCopyPage(b, func(pt *Child, page []byte, addr uintptr) error {
+		_, err := pokeData(pt.pid, addr, page)
+		return err
+	})
+}
+
+// benchmarkSyscalls injects getpid into child b.N times, with
+// restoreEach registers are put back after each one so child runs
+// into its own syscall before the next, as before they were re-entered
+// in place
+func benchmarkSyscalls(b *testing.B, restoreEach bool) {
+	pt := tracedChild(b)
+	pid := int64(pt.pid)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ret, err := pt.RemoteSyscall(syscall.SYS_GETPID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if ret != pid {
+			b.Fatalf("getpid in child returned %d, want %d", ret, pid)
+		}
+		if restoreEach {
+			if err := pt.restoreRegs(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRemoteSyscallInPlace(b *testing.B) {
+	benchmarkSyscalls(b, false)
+}
+
+func BenchmarkRemoteSyscallRestoreEach(b *testing.B) {
+	benchmarkSyscalls(b, true)
+}
+
+func TestWait4RestartsOnEINTR(t *testing.T) {
+	saved := sysWait4
+	defer func() {
+		sysWait4 = saved
+	}()
+	calls := 0
+	sysWait4 = func(pid int, wstatus *syscall.WaitStatus, options int, rusage *syscall.Rusage) (int, error) {
+		calls++
+		if calls <= 2 {
+			return -1, syscall.EINTR
+		}
+		if calls == 3 {
+			*wstatus = stoppedStatus(syscall.SIGSTOP)
+			return pid, nil
+		}
+		return -1, syscall.ECHILD
+	}
+
+	pt := NewChild(100)
+	var wstatus syscall.WaitStatus
+	wpid, err := pt.wait4(&wstatus)
+	if err != nil || wpid != 100 {
+		t.Fatalf("wait4 returned %d %v, want 100", wpid, err)
+	}
+	if calls != 3 {
+		t.Errorf("wait4 called %d times, want 3", calls)
+	}
+	if wstatus.Stopped() == false || wstatus.StopSignal() != syscall.SIGSTOP {
+		t.Errorf("status %#x is not the stop reported", wstatus)
+	}
+	// any other error is returned as is
+	if _, err := pt.wait4(&wstatus); err != syscall.ECHILD {
+		t.Errorf("wait4 returned %v, want %v", err, syscall.ECHILD)
+	}
+}
+
+func TestOptionsExitKill(t *testing.T) {
+	pt := NewChild(100)
+	if options := pt.options(); options&ptraceOExitkill != 0 || options&syscall.PTRACE_O_TRACESYSGOOD == 0 {
+		t.Errorf("options %#x, want TRACESYSGOOD only", options)
+	}
+	pt.ExitKill = true
+	if options := pt.options(); options&ptraceOExitkill == 0 || options&syscall.PTRACE_O_TRACESYSGOOD == 0 {
+		t.Errorf("options %#x with ExitKill, want TRACESYSGOOD and EXITKILL", options)
+	}
+}
+
+func TestExitKillTracerDies(t *testing.T) {
+	child := exec.Command(os.Args[0])
+	child.Env = append(os.Environ(), childEnv+"=1")
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		child.Process.Kill()
+		child.Wait()
+	}()
+	tracer := exec.Command(os.Args[0])
+	tracer.Env = append(os.Environ(), tracerEnv+"="+strconv.Itoa(child.Process.Pid))
+	out, err := tracer.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	if line != "attached\n" {
+		tracer.Wait()
+		t.Skipf("can't attach: %s", line)
+	}
+
+	// the tracer dies while child is stopped by it
+	tracer.Process.Kill()
+	tracer.Wait()
+	exited := make(chan error)
+	go func() {
+		exited <- child.Wait()
+	}()
+	select {
+	case err := <-exited:
+		status, ok := err.(*exec.ExitError)
+		if ok == false || status.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+			t.Errorf("child ended with %v, want killed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("child survived its tracer with ExitKill")
+	}
+}
+
+// fakeInjection replaces the ptrace requests of an injection, every
+// wait reports a syscall-stop and PTRACE_SYSCALL fails with errs in
+// turn, then succeeds. It returns the count of PTRACE_SYSCALL
+func fakeInjection(t *testing.T, errs ...error) *int {
+	savedWait4, savedSyscall := sysWait4, ptraceSyscall
+	savedGetRegs, savedSetRegs := ptraceGetRegs, ptraceSetRegs
+	t.Cleanup(func() {
+		sysWait4, ptraceSyscall = savedWait4, savedSyscall
+		ptraceGetRegs, ptraceSetRegs = savedGetRegs, savedSetRegs
+	})
+	calls := new(int)
+	sysWait4 = func(pid int, wstatus *syscall.WaitStatus, options int, rusage *syscall.Rusage) (int, error) {
+		*wstatus = stoppedStatus(syscall.SIGTRAP | bit7thSet)
+		return pid, nil
+	}
+	ptraceSyscall = func(pid int, signal int) error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}
+	ptraceGetRegs = func(pid int, regs *syscall.PtraceRegs) error {
+		return nil
+	}
+	ptraceSetRegs = func(pid int, regs *syscall.PtraceRegs) error {
+		return nil
+	}
+	return calls
+}
+
+// stoppedAtSyscall is a child of pid held at syscall-enter-stop
+func stoppedAtSyscall(pid int) *Child {
+	pt := NewChild(pid)
+	pt.attached = true
+	pt.childState = childSyscallEnter
+	return pt
+}
+
+func TestRemoteSyscallRetriesESRCH(t *testing.T) {
+	calls := fakeInjection(t, syscall.ESRCH)
+	// our own pid is alive, so ESRCH is only a missed stop
+	pt := stoppedAtSyscall(os.Getpid())
+	ret, err := pt.RemoteSyscall(syscall.SYS_CLOSE, 7)
+	if err != nil || ret != 0 {
+		t.Fatalf("remote close returned %d %v after one ESRCH", ret, err)
+	}
+	// the refused one, the resume to the next syscall-enter-stop, and
+	// the injection which went through
+	if *calls != 3 {
+		t.Errorf("PTRACE_SYSCALL made %d times, want 3", *calls)
+	}
+	if pt.childState != childSyscallExit || pt.injected == false {
+		t.Errorf("child in %s, injected %t, want at exit of the injected syscall", childStateStr[pt.childState], pt.injected)
+	}
+}
+
+func TestRemoteSyscallESRCHGivesUp(t *testing.T) {
+	esrch := make([]error, DefaultRetries*2)
+	for i := range esrch {
+		esrch[i] = syscall.ESRCH
+	}
+	fakeInjection(t, esrch...)
+	pt := stoppedAtSyscall(os.Getpid())
+	pt.Retries = 2
+	_, err := pt.RemoteSyscall(syscall.SYS_CLOSE, 7)
+	if errors.Is(err, syscall.ESRCH) == false || errors.Is(err, ErrProcessGone) {
+		t.Errorf("remote close returned %v, want ESRCH of a live process", err)
+	}
+
+	// ESRCH of a process which exited is no missed stop
+	fakeInjection(t, syscall.ESRCH)
+	pt = stoppedAtSyscall(exitedPid(t))
+	if _, err := pt.RemoteSyscall(syscall.SYS_CLOSE, 7); err != ErrProcessGone {
+		t.Errorf("remote close returned %v, want %v", err, ErrProcessGone)
+	}
+}
@@ -0,0 +1,110 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// peekWord reads the word of child at addr, which is word aligned
+func peekWord(pid int, addr uintptr) ([wordSize]byte, error) {
+	var word [wordSize]byte
+	// the raw request stores the word at data, unlike the libc wrapper
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_PEEKDATA,
+		uintptr(pid), addr, uintptr(unsafe.Pointer(&word[0])), 0, 0)
+	if errno != 0 {
+		return word, errno
+	}
+	return word, nil
+}
+
+// pokeWord writes word to child at addr, which is word aligned
+func pokeWord(pid int, addr uintptr, word [wordSize]byte) error {
+	data := *(*uintptr)(unsafe.Pointer(&word[0]))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_POKEDATA,
+		uintptr(pid), addr, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// wordIO moves memory of child through word sized peeks and pokes,
+// the word size is a field so the splitting is the same on every arch
+type wordIO struct {
+	size int
+	// peek reads the word at addr into word, poke writes it, addr is
+	// word aligned and word is size long
+	peek func(addr uintptr, word []byte) error
+	poke func(addr uintptr, word []byte) error
+}
+
+// childWords is wordIO of child pid by PTRACE_PEEKDATA and
+// PTRACE_POKEDATA
+func childWords(pid int) wordIO {
+	return wordIO{
+		size: wordSize,
+		peek: func(addr uintptr, word []byte) error {
+			data, err := peekWord(pid, addr)
+			copy(word, data[:])
+			return err
+		},
+		poke: func(addr uintptr, word []byte) error {
+			var data [wordSize]byte
+			copy(data[:], word)
+			return pokeWord(pid, addr, data)
+		},
+	}
+}
+
+// pokeData copies src to child at addr a word at a time. Words only
+// partly covered by src, at an unaligned start or at the end, are read
+// first so the bytes around src are kept. It returns bytes copied
+func pokeData(pid int, addr uintptr, src []byte) (int, error) {
+	return childWords(pid).pokeData(addr, src)
+}
+
+// peekData reads len(dst) bytes of child at addr a word at a time,
+// addr needs no alignment. It returns bytes read
+func peekData(pid int, addr uintptr, dst []byte) (int, error) {
+	return childWords(pid).peekData(addr, dst)
+}
+
+func (w wordIO) pokeData(addr uintptr, src []byte) (int, error) {
+	size := uintptr(w.size)
+	word := make([]byte, w.size)
+	done := 0
+	for done < len(src) {
+		at := addr + uintptr(done)
+		start := at - at%size
+		offset := int(at - start)
+		// a word fully covered by src is overwritten as a whole
+		if offset != 0 || len(src)-done < w.size {
+			if err := w.peek(start, word); err != nil {
+				return done, err
+			}
+		}
+		n := copy(word[offset:], src[done:])
+		if err := w.poke(start, word); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return done, nil
+}
+
+func (w wordIO) peekData(addr uintptr, dst []byte) (int, error) {
+	size := uintptr(w.size)
+	word := make([]byte, w.size)
+	done := 0
+	for done < len(dst) {
+		at := addr + uintptr(done)
+		start := at - at%size
+		if err := w.peek(start, word); err != nil {
+			return done, err
+		}
+		done += copy(dst[done:], word[at-start:])
+	}
+	return done, nil
+}
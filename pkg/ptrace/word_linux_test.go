@@ -0,0 +1,122 @@
+// +build linux,amd64 linux,386
+
+package ptrace
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// fakeMemory is memory of a child at base, moved a word at a time,
+// an unaligned or out of range word fails
+type fakeMemory struct {
+	base  uintptr
+	mem   []byte
+	peeks int
+	pokes int
+}
+
+func (m *fakeMemory) words(size int) wordIO {
+	check := func(addr uintptr) (int, error) {
+		if addr%uintptr(size) != 0 {
+			return 0, fmt.Errorf("unaligned word at %#x", addr)
+		}
+		if addr < m.base || addr+uintptr(size) > m.base+uintptr(len(m.mem)) {
+			return 0, fmt.Errorf("word at %#x out of range", addr)
+		}
+		return int(addr - m.base), nil
+	}
+	return wordIO{
+		size: size,
+		peek: func(addr uintptr, word []byte) error {
+			i, err := check(addr)
+			if err == nil {
+				m.peeks++
+				copy(word, m.mem[i:i+size])
+			}
+			return err
+		},
+		poke: func(addr uintptr, word []byte) error {
+			i, err := check(addr)
+			if err == nil {
+				m.pokes++
+				copy(m.mem[i:i+size], word)
+			}
+			return err
+		},
+	}
+}
+
+// newFakeMemory is four words filled with 0xff
+func newFakeMemory(size int) *fakeMemory {
+	return &fakeMemory{base: 0x1000, mem: bytes.Repeat([]byte{0xff}, 4*size)}
+}
+
+func TestWordIO(t *testing.T) {
+	for _, size := range []int{4, 8} {
+		cases := []struct {
+			name   string
+			offset int
+			length int
+			// words poked, those partly covered are peeked first
+			pokes, peeks int
+		}{
+			{"one byte", 0, 1, 1, 1},
+			{"word less one", 0, size - 1, 1, 1},
+			{"word", 0, size, 1, 0},
+			{"word and one", 0, size + 1, 2, 1},
+			{"two words", 0, 2 * size, 2, 0},
+			{"unaligned in a word", 1, size - 2, 1, 1},
+			{"unaligned across words", size - 1, 2, 2, 2},
+			{"unaligned over a whole word", 3, 2 * size, 3, 2},
+		}
+		for _, c := range cases {
+			name := fmt.Sprintf("%d byte words %s", size, c.name)
+			m := newFakeMemory(size)
+			addr := m.base + uintptr(c.offset)
+			src := make([]byte, c.length)
+			for i := range src {
+				src[i] = byte(i + 1)
+			}
+
+			n, err := m.words(size).pokeData(addr, src)
+			if err != nil || n != len(src) {
+				t.Errorf("%s: poked %d of %d bytes: %v", name, n, len(src), err)
+				continue
+			}
+			want := bytes.Repeat([]byte{0xff}, len(m.mem))
+			copy(want[c.offset:], src)
+			if bytes.Equal(m.mem, want) == false {
+				t.Errorf("%s: memory % x, want % x", name, m.mem, want)
+			}
+			if m.pokes != c.pokes || m.peeks != c.peeks {
+				t.Errorf("%s: %d pokes %d peeks, want %d %d", name, m.pokes, m.peeks, c.pokes, c.peeks)
+			}
+
+			dst := make([]byte, c.length)
+			n, err = m.words(size).peekData(addr, dst)
+			if err != nil || n != len(dst) {
+				t.Errorf("%s: peeked %d of %d bytes: %v", name, n, len(dst), err)
+				continue
+			}
+			if bytes.Equal(dst, src) == false {
+				t.Errorf("%s: read back % x, want % x", name, dst, src)
+			}
+		}
+	}
+}
+
+func TestWordIOFailure(t *testing.T) {
+	m := newFakeMemory(8)
+	// the last word is out of range, the ones before are copied
+	addr := m.base + uintptr(len(m.mem)) - 8
+	n, err := m.words(8).pokeData(addr, make([]byte, 12))
+	if err == nil || n != 8 {
+		t.Errorf("poke past the end copied %d bytes, error %v, want 8 and an error", n, err)
+	}
+	n, err = m.words(8).peekData(addr+4, make([]byte, 8))
+	if err == nil || n != 4 {
+		t.Errorf("peek past the end read %d bytes, error %v, want 4 and an error", n, err)
+	}
+}
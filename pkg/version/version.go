@@ -0,0 +1,23 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// set at build time with
+// -ldflags "-X github.com/pendulm/fileflip/pkg/version.Version=..."
+var (
+	// Version is the release of fileflip
+	Version = "dev"
+	// Commit is the git commit fileflip is built from
+	Commit = "unknown"
+	// Date is when fileflip is built
+	Date = "unknown"
+)
+
+// String formats build info in one line
+func String() string {
+	return fmt.Sprintf("fileflip %s (commit %s, built %s, %s %s/%s)",
+		Version, Commit, Date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,102 @@
+#!/usr/bin/env bash
+# Flips live writer processes end to end with a fresh build of fileflip.
+# Each case checks that the lines written before the flip are in the
+# archive and the ones after in the new file, none lost or repeated.
+# Without the privilege to attach, it skips and exits 0.
+set -u
+
+cd "$(dirname "$0")/.."
+work=$(mktemp -d)
+trap 'kill $(jobs -p) 2>/dev/null; chattr -R -ai "$work" 2>/dev/null; rm -rf "$work"' EXIT
+
+skip() {
+	echo "SKIP: $*"
+	exit 0
+}
+
+go build -o "$work/fileflip" . || exit 1
+fileflip=$work/fileflip
+"$fileflip" --check >"$work/check" || skip "$(grep FAIL "$work/check")"
+if [ "$(id -u)" != 0 ] && grep -q "^warn  CAP_SYS_PTRACE" "$work/check"; then
+	# only our descendants could be attached, fileflip is not their parent
+	grep -q "^pass  ptrace_scope .*0," "$work/check" || skip "needs root or CAP_SYS_PTRACE"
+fi
+
+failed=0
+
+# writer REDIRECT FILE appends a counter to FILE every 10ms, REDIRECT is
+# >> for an O_APPEND descriptor or > for one with its own offset
+writer() {
+	bash -c "exec 3$1\"\$0\"; i=0; while :; do echo \$i >&3; i=\$((i+1)); sleep 0.01; done" "$2" &
+	writer_pid=$!
+}
+
+# contiguous FILE... tells if the lines of the files in order count up
+# by one from 0
+contiguous() {
+	cat "$@" | awk 'NR-1 != $1 { bad = 1; exit } END { exit bad || NR == 0 }'
+}
+
+# appendonly FILE... tells if the files all have chattr +a
+appendonly() {
+	lsattr "$@" 2>/dev/null | awk '$1 !~ /a/ { bad = 1 } END { exit bad || NR == 0 }'
+}
+
+# run NAME REDIRECT ROLLED OPTION... flips a writer and checks the result,
+# with $setup set it is run on the file before the flip
+run() {
+	local name=$1 redirect=$2 rolled=$3
+	shift 3
+	local dir=$work/$name
+	mkdir -p "$dir"
+	writer "$redirect" "$dir/app.log"
+	sleep 0.3
+	if [ -n "${setup:-}" ]; then
+		$setup "$dir/app.log"
+	fi
+	local out
+	out=$("$fileflip" "$@" "$writer_pid" "$dir/app.log" 2>&1)
+	local code=$?
+	sleep 0.3
+	local alive=yes
+	kill -0 "$writer_pid" 2>/dev/null || alive=no
+	kill "$writer_pid" 2>/dev/null
+	wait "$writer_pid" 2>/dev/null
+
+	case $code in
+	5 | 13) skip "attach refused: $out" ;;
+	esac
+	if [ $code != 0 ]; then
+		echo "FAIL $name: exit $code: $out"
+	elif [ $alive = no ]; then
+		echo "FAIL $name: writer died"
+	elif [ ! -s "$dir/$rolled" ] || [ ! -s "$dir/app.log" ]; then
+		echo "FAIL $name: archive or new file is empty"
+	elif ! contiguous "$dir/$rolled" "$dir/app.log"; then
+		echo "FAIL $name: lines lost or repeated across the flip"
+	elif [ -n "${setup:-}" ] && ! appendonly "$dir/$rolled" "$dir/app.log"; then
+		echo "FAIL $name: chattr +a is not kept"
+	else
+		echo "ok   $name"
+		return
+	fi
+	failed=1
+}
+
+run append '>>' app.log.flipped
+run offset '>' app.log.flipped
+run tmpfile '>>' app.log.flipped --tmpfile
+run swap '>>' app.log.flipped --swap
+run numbered '>>' app.log.1 --numbered
+run verify '>>' app.log.flipped --verify
+run dest '>>' archive/app.log --mkdir --dest "$work/dest/archive/app.log"
+
+# chattr +a needs a filesystem with inode flags and CAP_LINUX_IMMUTABLE
+touch "$work/probe"
+if chattr +a "$work/probe" 2>/dev/null; then
+	setup="chattr +a" run attrs '>>' app.log.flipped --keep-attrs
+else
+	echo "skip attrs: chattr +a is not allowed here"
+fi
+
+exit $failed